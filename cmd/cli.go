@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/google/uuid"
@@ -11,27 +13,91 @@ import (
 	"github.com/ping-42/42lib/db/models"
 	"github.com/ping-42/42lib/sensor"
 	"github.com/ping-42/server/wsServer"
+	"github.com/ping-42/server/wsServer/blobstore"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Define a struct for the 'run' command options
 type RunOptions struct {
-	Port string `short:"p" long:"port" default:"8080" description:"Port to listen for sensor connections"`
+	Port              string                   `short:"p" long:"port" default:"8080" description:"Port to listen for sensor connections"`
+	AdminPort         string                   `long:"admin-port" env:"ADMIN_PORT" description:"Port to listen for the internal admin api, disabled if not set"`
+	AdminToken        string                   `long:"admin-token" env:"ADMIN_TOKEN" description:"Bearer token required by the internal admin api"`
+	InstanceId        string                   `long:"instance-id" env:"INSTANCE_ID" description:"Unique id of this server instance, defaults to the hostname"`
+	LiveFeedToken     string                   `long:"live-feed-token" env:"LIVE_FEED_TOKEN" description:"Bearer token of the /live feed of the admin port following every subscription, disabled if not set"`
+	LiveFeedSubTokens map[string]string        `long:"live-feed-subscription-token" env:"LIVE_FEED_SUBSCRIPTION_TOKENS" env-delim:"," description:"Bearer token of the /live feed following a single subscription, as SUBSCRIPTION_ID:token, can be repeated"`
+	OtlpEndpoint      string                   `long:"otlp-endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT" description:"OTLP/HTTP url to export the traces to, e.g. http://localhost:4318/v1/traces, disabled if not set"`
+	JwtAudience       string                   `long:"jwt-audience" env:"JWT_AUDIENCE" default:"ping42-server" description:"aud claim required in the sensor tokens"`
+	JwtMaxLifetime    time.Duration            `long:"jwt-max-lifetime" env:"JWT_MAX_LIFETIME" default:"15m" description:"Max lifetime (exp - iat) accepted for the sensor tokens"`
+	TrustedProxies    []string                 `long:"trusted-proxy" env:"TRUSTED_PROXIES" env-delim:"," description:"Proxy address or CIDR allowed to set X-Real-IP/X-Forwarded-For, can be repeated"`
+	TaskRouting       string                   `long:"task-routing" env:"TASK_ROUTING" default:"broadcast" choice:"broadcast" choice:"targeted" description:"broadcast: every instance receives every task, targeted: tasks are routed to the instance holding the sensor"`
+	TaskIntake        string                   `long:"task-intake" env:"TASK_INTAKE" default:"pubsub" choice:"pubsub" choice:"streams" description:"pubsub: tasks from the scheduler channel (compatibility), streams: tasks from the scheduler stream, acked once sent to the sensor"`
+	TaskMaxDeliveries int                      `long:"task-max-deliveries" env:"TASK_MAX_DELIVERIES" default:"5" description:"Deliveries of a stream task before it is moved to the dead letter stream"`
+	PendingTaskTtl    time.Duration            `long:"pending-task-ttl" env:"PENDING_TASK_TTL" default:"5m" description:"How long the tasks of an offline sensor are queued when they carry no deadline, 0 drops them"`
+	TaskTimeouts      map[string]time.Duration `long:"task-timeout" env:"TASK_TIMEOUTS" env-delim:"," description:"Time the sensors have to answer a task type, as TASK_TYPE:duration, e.g. TRACEROUTE_TASK:5m, can be repeated"`
+	IngestQueueSize   int                      `long:"ingest-queue-size" env:"INGEST_QUEUE_SIZE" default:"1000" description:"Sensor messages waiting to be stored before the reads of the sensors block"`
+	IngestWorkers     int                      `long:"ingest-workers" env:"INGEST_WORKERS" default:"4" description:"Workers storing the sensor messages"`
+	IngestBatchSize   int                      `long:"ingest-batch-size" env:"INGEST_BATCH_SIZE" default:"100" description:"Sensor messages stored together in one transaction"`
+	IngestFlushEvery  time.Duration            `long:"ingest-flush-interval" env:"INGEST_FLUSH_INTERVAL" default:"200ms" description:"Max time a sensor message waits for its batch to fill up"`
+	CredentialsTtl    time.Duration            `long:"credentials-cache-ttl" env:"CREDENTIALS_CACHE_TTL" default:"5m" description:"How long the sensor credentials are cached, changes made with the cli are applied immediately"`
+	HttpBodyPolicy    string                   `long:"http-body-policy" env:"HTTP_BODY_POLICY" default:"truncated" choice:"none" choice:"hash" choice:"truncated" choice:"full" description:"How the http bodies are stored for the subscriptions without a policy set with set-http-body-policy"`
+	HttpBodyMaxBytes  int                      `long:"http-body-max-bytes" env:"HTTP_BODY_MAX_BYTES" default:"65536" description:"Length of the http bodies kept by the truncated policy"`
+	BlobStore         string                   `long:"blob-store" env:"BLOB_STORE" description:"Where the full http bodies are kept, a directory, file:///path or s3://bucket/prefix, the full policy is stored truncated if not set"`
+	S3Endpoint        string                   `long:"s3-endpoint" env:"S3_ENDPOINT" description:"Url of the S3-compatible service of an s3:// blob store, defaults to AWS"`
+	S3Region          string                   `long:"s3-region" env:"S3_REGION" default:"us-east-1" description:"Region of an s3:// blob store"`
+	S3AccessKey       string                   `long:"s3-access-key" env:"AWS_ACCESS_KEY_ID" description:"Access key of an s3:// blob store"`
+	S3SecretKey       string                   `long:"s3-secret-key" env:"AWS_SECRET_ACCESS_KEY" description:"Secret key of an s3:// blob store"`
+	IpDatasets        []string                 `long:"ip-dataset" env:"IP_DATASETS" env-delim:"," description:"MMDB (GeoLite2 ASN or Country, IPinfo) or ip2asn TSV file the traceroute hops are looked up in, can be repeated, the first file knowing a field wins"`
 }
 
 // Define a struct for the 'mksensor' command options
 type CreateNewSensorOptions struct {
 	Name     string `short:"n" long:"name" description:"The new sensor name" required:"true"`
 	Location string `short:"l" long:"location" description:"The new sensor location" required:"true"`
+	// PublicKey registers the sensor by its public key, so the server never holds a secret of it
+	PublicKey string `long:"public-key" description:"Path to the PEM public key (Ed25519 or ECDSA) the sensor signs its tokens with, no secret is created when set"`
 }
 type MigrateOptions struct{}
 
+// Define a struct for the 'rotate-sensor' command options
+type RotateSensorOptions struct {
+	SensorId  string `short:"s" long:"sensor-id" description:"The sensor id" required:"true"`
+	PublicKey string `long:"public-key" description:"Path to the new PEM public key, the old keys are revoked. A new secret is generated if not set"`
+}
+
+// Define a struct for the 'disable-sensor' command options
+type DisableSensorOptions struct {
+	SensorId string `short:"s" long:"sensor-id" description:"The sensor id" required:"true"`
+}
+
+// Define a struct for the 'set-policy' command options
+type SetPolicyOptions struct {
+	SensorId        string   `short:"s" long:"sensor-id" description:"The sensor id" required:"true"`
+	AllowedCidrs    []string `long:"allow-cidr" description:"CIDR or address the sensor may connect from, can be repeated. Any if not set"`
+	AllowedTaskType []string `long:"allow-task-type" description:"Task type the sensor may receive, e.g. ICMP_TASK, can be repeated. Any if not set"`
+	ValidFrom       string   `long:"valid-from" description:"RFC3339 time the sensor may connect from"`
+	ValidUntil      string   `long:"valid-until" description:"RFC3339 time the sensor may connect until"`
+	Remove          bool     `long:"remove" description:"Remove the policy, the sensor is then unrestricted"`
+}
+
+// Define a struct for the 'set-http-body-policy' command options
+type SetHttpBodyPolicyOptions struct {
+	SubscriptionId uint64 `long:"subscription-id" description:"The subscription id" required:"true"`
+	Policy         string `long:"policy" choice:"none" choice:"hash" choice:"truncated" choice:"full" description:"none: size only, hash: size and SHA-256, truncated: the start of the body, full: the body in the blob store"`
+	MaxBytes       int    `long:"max-bytes" description:"Length of the body kept by the truncated policy, the server default if not set"`
+	Remove         bool   `long:"remove" description:"Remove the policy, the server default then applies"`
+}
+
 // opts defines and handles the CLI parameters
 type opts struct {
-	Run             RunOptions             `command:"run" description:"Run telemetry server" required:"false"`
-	Migrate         MigrateOptions         `command:"migrate" description:"Run database migrations and exit" required:"false"`
-	CreateNewSensor CreateNewSensorOptions `command:"mksensor" description:"Create new sensor" required:"false"`
+	Run               RunOptions               `command:"run" description:"Run telemetry server" required:"false"`
+	Migrate           MigrateOptions           `command:"migrate" description:"Run database migrations and exit" required:"false"`
+	CreateNewSensor   CreateNewSensorOptions   `command:"mksensor" description:"Create new sensor" required:"false"`
+	RotateSensor      RotateSensorOptions      `command:"rotate-sensor" description:"Rotate the secret or public key of a sensor" required:"false"`
+	DisableSensor     DisableSensorOptions     `command:"disable-sensor" description:"Drop the credentials of a sensor and disconnect it" required:"false"`
+	SetPolicy         SetPolicyOptions         `command:"set-policy" description:"Restrict the addresses, task types and validity period of a sensor" required:"false"`
+	SetHttpBodyPolicy SetHttpBodyPolicyOptions `command:"set-http-body-policy" description:"Set how the http bodies of a subscription are stored" required:"false"`
 }
 
 var Flags opts
@@ -61,6 +127,18 @@ func (f *opts) Handle(opts HandleOpts) {
 	case "mksensor":
 		handleBuildNewSensor(&f.CreateNewSensor, opts)
 		os.Exit(0)
+	case "rotate-sensor":
+		handleRotateSensor(&f.RotateSensor, opts)
+		os.Exit(0)
+	case "disable-sensor":
+		handleDisableSensor(&f.DisableSensor, opts)
+		os.Exit(0)
+	case "set-policy":
+		handleSetPolicy(&f.SetPolicy, opts)
+		os.Exit(0)
+	case "set-http-body-policy":
+		handleSetHttpBodyPolicy(&f.SetHttpBodyPolicy, opts)
+		os.Exit(0)
 	}
 }
 
@@ -69,18 +147,62 @@ func handleServerRun(buildUserOpts *RunOptions, opts HandleOpts) {
 	if !strings.HasPrefix(buildUserOpts.Port, ":") {
 		buildUserOpts.Port = ":" + buildUserOpts.Port
 	}
-	server.Init(opts.DbClient, opts.RedisClient, opts.Logger, buildUserOpts.Port)
+	if buildUserOpts.AdminPort != "" && !strings.HasPrefix(buildUserOpts.AdminPort, ":") {
+		buildUserOpts.AdminPort = ":" + buildUserOpts.AdminPort
+	}
+	server.Init(opts.DbClient, opts.RedisClient, opts.Logger, server.Options{
+		Port:                       buildUserOpts.Port,
+		AdminPort:                  buildUserOpts.AdminPort,
+		AdminToken:                 buildUserOpts.AdminToken,
+		InstanceId:                 buildUserOpts.InstanceId,
+		LiveFeedToken:              buildUserOpts.LiveFeedToken,
+		LiveFeedSubscriptionTokens: buildUserOpts.LiveFeedSubTokens,
+		OtlpEndpoint:               buildUserOpts.OtlpEndpoint,
+		TrustedProxies:             buildUserOpts.TrustedProxies,
+		JwtAudience:                buildUserOpts.JwtAudience,
+		JwtMaxLifetime:             buildUserOpts.JwtMaxLifetime,
+		CredentialsCacheTtl:        buildUserOpts.CredentialsTtl,
+		TaskRouting:                buildUserOpts.TaskRouting,
+		TaskIntake:                 buildUserOpts.TaskIntake,
+		TaskMaxDeliveries:          buildUserOpts.TaskMaxDeliveries,
+		PendingTaskTtl:             buildUserOpts.PendingTaskTtl,
+		TaskTimeouts:               buildUserOpts.TaskTimeouts,
+		IngestQueueSize:            buildUserOpts.IngestQueueSize,
+		IngestWorkers:              buildUserOpts.IngestWorkers,
+		IngestBatchSize:            buildUserOpts.IngestBatchSize,
+		IngestFlushInterval:        buildUserOpts.IngestFlushEvery,
+		HttpBodyPolicy:             buildUserOpts.HttpBodyPolicy,
+		HttpBodyMaxBytes:           buildUserOpts.HttpBodyMaxBytes,
+		BlobStore:                  buildUserOpts.BlobStore,
+		S3: blobstore.S3Config{
+			Endpoint:  buildUserOpts.S3Endpoint,
+			Region:    buildUserOpts.S3Region,
+			AccessKey: buildUserOpts.S3AccessKey,
+			SecretKey: buildUserOpts.S3SecretKey,
+		},
+		IpDatasets: buildUserOpts.IpDatasets,
+	})
 }
 
 // Function to handle logic for the 'migrate' command
 func handleMigrate(buildUserOpts *MigrateOptions, opts HandleOpts) {
 	migrations.MigrateAndSeed(opts.DbClient)
+	err := server.Migrate(opts.DbClient)
+	if err != nil {
+		opts.Logger.Errorf("server migrations err:%v", err)
+		os.Exit(1)
+	}
 	opts.Logger.Info("Migrations DONE")
 	os.Exit(0)
 }
 
 // Function to handle logic for the 'CreateNewSensor' command
 func handleBuildNewSensor(buildUserOpts *CreateNewSensorOptions, opts HandleOpts) {
+	if buildUserOpts.PublicKey != "" {
+		handleBuildNewSensorWithPublicKey(buildUserOpts, opts)
+		return
+	}
+
 	// Insert the new Sensor
 	newSensor := models.Sensor{
 		ID:       uuid.New(),
@@ -104,8 +226,51 @@ func handleBuildNewSensor(buildUserOpts *CreateNewSensorOptions, opts HandleOpts
 		return
 	}
 
+	announceCredentialsChange(opts, newSensor.ID, server.CredentialsCreated)
+
 	opts.Logger.Infof("new sensor Id:%v", newSensor.ID)
 	opts.Logger.Infof("new sensor Name:%v", newSensor.Name)
 	opts.Logger.Infof("new sensor Location:%v", newSensor.Location)
 	opts.Logger.Infof("new sensor EnvToken:%v", envToken)
 }
+
+// handleBuildNewSensorWithPublicKey creates a sensor without secret, it authenticates with tokens signed by its private key
+func handleBuildNewSensorWithPublicKey(buildUserOpts *CreateNewSensorOptions, opts HandleOpts) {
+	publicKeyPem, err := os.ReadFile(buildUserOpts.PublicKey)
+	if err != nil {
+		opts.Logger.Errorf("reading the public key err:%v", err)
+		return
+	}
+
+	newSensor := models.Sensor{
+		ID:       uuid.New(),
+		Name:     buildUserOpts.Name,
+		Location: buildUserOpts.Location,
+	}
+	publicKey, err := server.NewSensorPublicKey(newSensor.ID, publicKeyPem)
+	if err != nil {
+		opts.Logger.Errorf("invalid public key err:%v", err)
+		return
+	}
+
+	err = opts.DbClient.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newSensor).Error; err != nil {
+			return fmt.Errorf("creating newSensor err:%v", err)
+		}
+		if err := tx.Omit(clause.Associations).Create(&publicKey).Error; err != nil {
+			return fmt.Errorf("creating the sensor public key err:%v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		opts.Logger.Error(err)
+		return
+	}
+	announceCredentialsChange(opts, newSensor.ID, server.CredentialsCreated)
+
+	opts.Logger.Infof("new sensor Id:%v", newSensor.ID)
+	opts.Logger.Infof("new sensor Name:%v", newSensor.Name)
+	opts.Logger.Infof("new sensor Location:%v", newSensor.Location)
+	opts.Logger.Infof("new sensor key Id (kid):%v", publicKey.ID)
+	opts.Logger.Infof("new sensor key Algorithm:%v", publicKey.Algorithm)
+}
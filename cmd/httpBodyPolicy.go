@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"github.com/ping-42/server/wsServer/results"
+	"gorm.io/gorm/clause"
+)
+
+// Function to handle logic for the 'set-http-body-policy' command
+func handleSetHttpBodyPolicy(buildUserOpts *SetHttpBodyPolicyOptions, opts HandleOpts) {
+	if buildUserOpts.Remove {
+		err := opts.DbClient.Delete(&results.HttpBodyPolicy{}, "subscription_id = ?", buildUserOpts.SubscriptionId).Error
+		if err != nil {
+			opts.Logger.Errorf("removing the http body policy err:%v", err)
+			return
+		}
+		opts.Logger.Infof("subscription %v http body policy removed", buildUserOpts.SubscriptionId)
+		return
+	}
+
+	if !results.ValidHttpBodyPolicy(buildUserOpts.Policy) {
+		opts.Logger.Errorf("invalid policy %q, expected none, hash, truncated or full", buildUserOpts.Policy)
+		return
+	}
+	if buildUserOpts.MaxBytes < 0 {
+		opts.Logger.Errorf("invalid max-bytes %v", buildUserOpts.MaxBytes)
+		return
+	}
+
+	policy := results.HttpBodyPolicy{
+		SubscriptionID: buildUserOpts.SubscriptionId,
+		Policy:         buildUserOpts.Policy,
+		MaxBytes:       buildUserOpts.MaxBytes,
+	}
+	err := opts.DbClient.Omit(clause.Associations).Clauses(clause.OnConflict{UpdateAll: true}).Create(&policy).Error
+	if err != nil {
+		opts.Logger.Errorf("storing the http body policy err:%v", err)
+		return
+	}
+
+	// the policy is read for each result, no instance needs to be notified
+	opts.Logger.Infof("subscription %v http body policy set, policy:%v, max bytes:%v", policy.SubscriptionID, policy.Policy, policy.MaxBytes)
+}
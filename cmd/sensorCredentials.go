@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/sensor"
+	"github.com/ping-42/server/wsServer"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Function to handle logic for the 'rotate-sensor' command
+func handleRotateSensor(buildUserOpts *RotateSensorOptions, opts HandleOpts) {
+	sensorId, err := uuid.Parse(buildUserOpts.SensorId)
+	if err != nil {
+		opts.Logger.Errorf("invalid sensor id err:%v", err)
+		return
+	}
+
+	if buildUserOpts.PublicKey != "" {
+		publicKeyPem, err := os.ReadFile(buildUserOpts.PublicKey)
+		if err != nil {
+			opts.Logger.Errorf("reading the public key err:%v", err)
+			return
+		}
+		publicKey, err := server.NewSensorPublicKey(sensorId, publicKeyPem)
+		if err != nil {
+			opts.Logger.Errorf("invalid public key err:%v", err)
+			return
+		}
+
+		// the new key replaces the secret and the old keys
+		err = opts.DbClient.Transaction(func(tx *gorm.DB) error {
+			if err := dropSensorCredentials(tx, sensorId); err != nil {
+				return err
+			}
+			if err := tx.Omit(clause.Associations).Create(&publicKey).Error; err != nil {
+				return fmt.Errorf("creating the sensor public key err:%v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			opts.Logger.Error(err)
+			return
+		}
+		announceCredentialsChange(opts, sensorId, server.CredentialsRotated)
+
+		opts.Logger.Infof("sensor Id:%v", sensorId)
+		opts.Logger.Infof("new sensor key Id (kid):%v", publicKey.ID)
+		opts.Logger.Infof("new sensor key Algorithm:%v", publicKey.Algorithm)
+		return
+	}
+
+	secret := uuid.New().String()
+	tx := opts.DbClient.Model(&models.Sensor{}).Where("id = ?", sensorId).Update("secret", secret)
+	if tx.Error != nil {
+		opts.Logger.Errorf("updating the sensor secret err:%v", tx.Error)
+		return
+	}
+	if tx.RowsAffected == 0 {
+		opts.Logger.Errorf("sensor %v not found", sensorId)
+		return
+	}
+	announceCredentialsChange(opts, sensorId, server.CredentialsRotated)
+
+	sensorCreds := sensor.Creds{
+		SensorId: sensorId,
+		Secret:   secret,
+	}
+	envToken, err := sensorCreds.GetSensorEnvToken()
+	if err != nil {
+		opts.Logger.Errorf("GetSensorEnvToken err:%v", err)
+		return
+	}
+
+	opts.Logger.Infof("sensor Id:%v", sensorId)
+	opts.Logger.Infof("new sensor EnvToken:%v", envToken)
+}
+
+// Function to handle logic for the 'disable-sensor' command
+func handleDisableSensor(buildUserOpts *DisableSensorOptions, opts HandleOpts) {
+	sensorId, err := uuid.Parse(buildUserOpts.SensorId)
+	if err != nil {
+		opts.Logger.Errorf("invalid sensor id err:%v", err)
+		return
+	}
+
+	err = opts.DbClient.Transaction(func(tx *gorm.DB) error {
+		return dropSensorCredentials(tx, sensorId)
+	})
+	if err != nil {
+		opts.Logger.Error(err)
+		return
+	}
+	announceCredentialsChange(opts, sensorId, server.CredentialsDisabled)
+
+	opts.Logger.Infof("sensor %v disabled", sensorId)
+}
+
+// dropSensorCredentials clears the secret and revokes the public keys of the sensor
+func dropSensorCredentials(tx *gorm.DB, sensorId uuid.UUID) error {
+	update := tx.Model(&models.Sensor{}).Where("id = ?", sensorId).Update("secret", "")
+	if update.Error != nil {
+		return fmt.Errorf("clearing the sensor secret err:%v", update.Error)
+	}
+	if update.RowsAffected == 0 {
+		return fmt.Errorf("sensor %v not found", sensorId)
+	}
+
+	err := tx.Model(&server.SensorPublicKey{}).
+		Where("sensor_id = ? AND revoked_at IS NULL", sensorId).
+		Update("revoked_at", time.Now().UTC()).Error
+	if err != nil {
+		return fmt.Errorf("revoking the sensor public keys err:%v", err)
+	}
+	return nil
+}
+
+// announceCredentialsChange drops the cached credentials on the running servers,
+// they expire on their own if this fails
+func announceCredentialsChange(opts HandleOpts, sensorId uuid.UUID, change server.CredentialsChange) {
+	err := server.PublishCredentialsChange(opts.RedisClient, sensorId, change)
+	if err != nil {
+		opts.Logger.Errorf("%v, the running servers apply it once their credentials cache expires", err)
+	}
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/server/wsServer"
+	"gorm.io/gorm/clause"
+)
+
+// Function to handle logic for the 'set-policy' command
+func handleSetPolicy(buildUserOpts *SetPolicyOptions, opts HandleOpts) {
+	sensorId, err := uuid.Parse(buildUserOpts.SensorId)
+	if err != nil {
+		opts.Logger.Errorf("invalid sensor id err:%v", err)
+		return
+	}
+
+	if buildUserOpts.Remove {
+		err = opts.DbClient.Delete(&server.SensorPolicy{}, "sensor_id = ?", sensorId).Error
+		if err != nil {
+			opts.Logger.Errorf("removing the sensor policy err:%v", err)
+			return
+		}
+		announceCredentialsChange(opts, sensorId, server.PolicyChanged)
+		opts.Logger.Infof("sensor %v policy removed", sensorId)
+		return
+	}
+
+	validFrom, err := parseOptionalTime(buildUserOpts.ValidFrom)
+	if err != nil {
+		opts.Logger.Errorf("invalid valid-from err:%v", err)
+		return
+	}
+	validUntil, err := parseOptionalTime(buildUserOpts.ValidUntil)
+	if err != nil {
+		opts.Logger.Errorf("invalid valid-until err:%v", err)
+		return
+	}
+
+	policy, err := server.NewSensorPolicy(sensorId, buildUserOpts.AllowedCidrs, buildUserOpts.AllowedTaskType, validFrom, validUntil)
+	if err != nil {
+		opts.Logger.Errorf("invalid policy err:%v", err)
+		return
+	}
+
+	err = opts.DbClient.Omit(clause.Associations).Clauses(clause.OnConflict{UpdateAll: true}).Create(&policy).Error
+	if err != nil {
+		opts.Logger.Errorf("storing the sensor policy err:%v", err)
+		return
+	}
+	announceCredentialsChange(opts, sensorId, server.PolicyChanged)
+
+	opts.Logger.Infof("sensor %v policy set, allowed CIDRs:%v, allowed task types:%v, valid from:%v, valid until:%v",
+		sensorId, policy.AllowedCidrs, policy.AllowedTaskTypes, buildUserOpts.ValidFrom, buildUserOpts.ValidUntil)
+}
+
+func parseOptionalTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
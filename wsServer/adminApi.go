@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errSensorNotConnected = errors.New("sensor is not connected to this server")
+
+// controlApiRequest is the admin api body for sending a control request to a sensor
+type controlApiRequest struct {
+	Command ControlCommand
+	TaskId  uuid.UUID
+	Config  *RuntimeConfig
+	// TimeoutSeconds to wait for the sensor reply, defaults to defaultControlTimeout
+	TimeoutSeconds int
+}
+
+// apiError is the body of every failed admin api response
+type apiError struct {
+	Error string
+}
+
+// runAdminApi starts the internal admin api on its own listener
+func (w *wsServer) runAdminApi() (*http.Server, error) {
+	if w.opts.AdminToken == "" {
+		return nil, fmt.Errorf("admin api requires an admin token")
+	}
+
+	ln, err := net.Listen("tcp", w.opts.AdminPort)
+	if err != nil {
+		return nil, fmt.Errorf("admin api listen error: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /instances", w.handleAdminListInstances)
+	mux.HandleFunc("GET /sensors", w.handleAdminListSensors)
+	mux.HandleFunc("GET /sensors/{sensorId}", w.handleAdminGetSensor)
+	mux.HandleFunc("GET /sensors/{sensorId}/sessions", w.handleAdminSensorSessions)
+	mux.HandleFunc("GET /sensors/{sensorId}/uptime", w.handleAdminSensorUptime)
+	mux.HandleFunc("GET /sensors/flapping", w.handleAdminFlappingSensors)
+	mux.HandleFunc("GET /sensors/{sensorId}/reputation", w.handleAdminSensorReputation)
+	mux.HandleFunc("POST /sensors/{sensorId}/disconnect", w.handleAdminDisconnectSensor)
+	mux.HandleFunc("POST /sensors/{sensorId}/drain", w.handleAdminDrainSensor)
+	mux.HandleFunc("POST /sensors/{sensorId}/control", w.handleAdminControl)
+	mux.HandleFunc("GET /tls/expiring", w.handleAdminExpiringCertificates)
+	mux.HandleFunc("GET /tcp/reachability", w.handleAdminTcpReachability)
+	mux.HandleFunc("GET /http/bodies/{sha256}", w.handleAdminHttpBody)
+	mux.HandleFunc("GET /traceroute/path-changes", w.handleAdminPathChanges)
+	mux.HandleFunc("GET /dead-letters/results", w.handleAdminListResultDeadLetters)
+	mux.HandleFunc("POST /dead-letters/results/replay", w.handleAdminReplayResultDeadLetters)
+
+	// the live feed is checked against its own token, the dashboards do not get the admin one
+	root := http.NewServeMux()
+	root.HandleFunc("GET /live", w.handleLiveFeed)
+	root.Handle("/", w.adminAuth(mux))
+
+	s := &http.Server{
+		Handler:           root,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := s.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			w.serverLogger.Error("admin api serve error: ", err)
+		}
+	}()
+
+	w.serverLogger.Info("Admin api listening", ln.Addr())
+	return s, nil
+}
+
+// adminAuth requires the configured bearer token on every request
+func (w *wsServer) adminAuth(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + w.opts.AdminToken)
+	return http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeApiError(wr, http.StatusUnauthorized, fmt.Errorf("invalid admin token"))
+			return
+		}
+		next.ServeHTTP(wr, r)
+	})
+}
+
+// handleAdminControl sends a control request to a sensor connected to any instance and returns its reply
+func (w *wsServer) handleAdminControl(wr http.ResponseWriter, r *http.Request) {
+	sensorId, err := uuid.Parse(r.PathValue("sensorId"))
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sensorId: %v", err))
+		return
+	}
+
+	var body controlApiRequest
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+		return
+	}
+
+	timeout := time.Duration(body.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultControlTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	reply, err := w.controlSensor(ctx, sensorId, ControlRequest{
+		Command: body.Command,
+		TaskId:  body.TaskId,
+		Config:  body.Config,
+	})
+	switch {
+	case errors.Is(err, errSensorNotConnected):
+		writeApiError(wr, http.StatusNotFound, err)
+	case errors.Is(err, errInvalidControlRequest):
+		writeApiError(wr, http.StatusBadRequest, err)
+	case errors.Is(err, errControlNoReply):
+		writeApiError(wr, http.StatusGatewayTimeout, err)
+	case err != nil:
+		writeApiError(wr, http.StatusBadGateway, err)
+	default:
+		writeJson(wr, http.StatusOK, reply)
+	}
+}
+
+// handleAdminListInstances lists the running server instances with their load
+func (w *wsServer) handleAdminListInstances(wr http.ResponseWriter, r *http.Request) {
+	instances, err := w.listInstances()
+	if err != nil {
+		writeApiError(wr, http.StatusBadGateway, err)
+		return
+	}
+	if instances == nil {
+		instances = []serverInstance{}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].InstanceId < instances[j].InstanceId
+	})
+	writeJson(wr, http.StatusOK, instances)
+}
+
+func writeJson(wr http.ResponseWriter, status int, v interface{}) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+	_ = json.NewEncoder(wr).Encode(v)
+}
+
+func writeApiError(wr http.ResponseWriter, status int, err error) {
+	writeJson(wr, status, apiError{Error: err.Error()})
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/logger"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminCommandChannel forwards admin actions to the instance holding the sensor connection
+const AdminCommandChannel = "SERVER_ADMIN_COMMAND_CHANNEL"
+
+type adminCommandType string
+
+const (
+	adminCommandDisconnect adminCommandType = "DISCONNECT"
+	adminCommandDrain      adminCommandType = "DRAIN"
+	// adminCommandDeliverPending sends the tasks queued while the sensor was offline
+	adminCommandDeliverPending adminCommandType = "DELIVER_PENDING"
+	// adminCommandControl sends a control request, the reply is pushed back to FromInstanceId
+	adminCommandControl adminCommandType = "CONTROL"
+)
+
+// adminCommand is published on AdminCommandChannel, only the instance holding the sensor acts on it
+type adminCommand struct {
+	Command  adminCommandType
+	SensorId uuid.UUID
+	// FromInstanceId is the instance that received the admin api call
+	FromInstanceId string
+	// ToInstanceId is the instance holding the sensor, when known
+	ToInstanceId   string
+	Reason         string
+	Drain          bool
+	Control        *ControlRequest `json:",omitempty"`
+	ControlTimeout time.Duration   `json:",omitempty"`
+}
+
+// publishAdminCommand forwards the command to all instances
+func (w *wsServer) publishAdminCommand(cmd adminCommand) error {
+	cmd.FromInstanceId = w.instanceId
+	msg, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("marshal adminCommand err:%v", err)
+	}
+	err = w.redisClient.Publish(AdminCommandChannel, msg).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("publish_admin_command").Inc()
+		return fmt.Errorf("failed to publish admin command:%v", err)
+	}
+	return nil
+}
+
+// adminCommandListener applies the admin commands for the sensors connected to this instance
+func (w *wsServer) adminCommandListener() {
+	pubsub := w.redisClient.Subscribe(AdminCommandChannel)
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			redisErrors.WithLabelValues("pubsub_receive").Inc()
+			logger.LogError(err.Error(), "adminCommandListener, error receiving message", w.serverLogger)
+			continue
+		}
+
+		var cmd adminCommand
+		err = json.Unmarshal([]byte(msg.Payload), &cmd)
+		if err != nil {
+			logger.LogError(err.Error(), fmt.Sprintf("adminCommandListener, error unmarshal message:%v", msg.Payload), w.serverLogger)
+			continue
+		}
+
+		// the instance that got the api call already applied it locally
+		if cmd.FromInstanceId == w.instanceId {
+			continue
+		}
+		if cmd.ToInstanceId != "" && cmd.ToInstanceId != w.instanceId {
+			continue
+		}
+
+		_, err = w.applyAdminCommand(cmd)
+		if err != nil {
+			w.serverLogger.WithFields(log.Fields{
+				"sensorId": cmd.SensorId,
+				"command":  cmd.Command,
+			}).Error(fmt.Sprintf("applyAdminCommand err: %v", err))
+		}
+	}
+}
+
+// applyAdminCommand acts on the sensor if it is connected to this instance
+func (w *wsServer) applyAdminCommand(cmd adminCommand) (applied bool, err error) {
+	wsConn, exists := w.getSensorWsConnection(cmd.SensorId)
+	if !exists {
+		return
+	}
+
+	var serverLogger = w.serverLogger.WithFields(log.Fields{
+		"connectionId": wsConn.ConnectionId.String(),
+		"sensorId":     cmd.SensorId,
+		"command":      cmd.Command,
+	})
+
+	switch cmd.Command {
+	case adminCommandDisconnect:
+		serverLogger.Info(fmt.Sprintf("Disconnecting sensor, reason: %v", cmd.Reason))
+		err = wsConn.close(cmd.Reason)
+		if err != nil {
+			err = fmt.Errorf("close connection err:%v", err)
+			return
+		}
+	case adminCommandDrain:
+		serverLogger.Info(fmt.Sprintf("Setting sensor drain: %v", cmd.Drain))
+		wsConn.draining.Store(cmd.Drain)
+		err = w.refreshActiveSensor(wsConn)
+		if err != nil {
+			return
+		}
+		if !cmd.Drain {
+			go w.deliverPendingTasks(wsConn)
+		}
+	case adminCommandDeliverPending:
+		go w.deliverPendingTasks(wsConn)
+	case adminCommandControl:
+		if cmd.Control == nil {
+			err = fmt.Errorf("%v command without a control request", cmd.Command)
+			return
+		}
+		go w.answerForwardedControl(cmd)
+	default:
+		err = fmt.Errorf("unknown admin command: %v", cmd.Command)
+		return
+	}
+	return true, nil
+}
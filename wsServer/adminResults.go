@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/server/wsServer/results"
+)
+
+const (
+	defaultExpiringDays = 30
+	maxExpiringDays     = 365
+	// expiringSeenWithin is how recent an inspection must be for its certificate to be reported
+	expiringSeenWithin = 7 * 24 * time.Hour
+
+	defaultReachabilityPeriod = 24 * time.Hour
+	defaultPathChangesPeriod  = 7 * 24 * time.Hour
+)
+
+// handleAdminExpiringCertificates lists the leaf certificates served by the inspected targets
+// expiring within ?days= (defaultExpiringDays), ?host= filters a single target
+func (w *wsServer) handleAdminExpiringCertificates(wr http.ResponseWriter, r *http.Request) {
+	days := defaultExpiringDays
+	if s := r.URL.Query().Get("days"); s != "" {
+		var err error
+		days, err = strconv.Atoi(s)
+		if err != nil || days < 0 || days > maxExpiringDays {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid days, expected 0 to %v", maxExpiringDays))
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	certs, err := results.ExpiringCertificates(w.dbClient.WithContext(r.Context()), now,
+		time.Duration(days)*24*time.Hour, now.Add(-expiringSeenWithin), r.URL.Query().Get("host"))
+	if err != nil {
+		dbErrors.WithLabelValues("load_certificates").Inc()
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(wr, http.StatusOK, certs)
+}
+
+// handleAdminTcpReachability summarizes by sensor the TCP checks of ?host= and ?port=
+// over the last ?period= (defaultReachabilityPeriod)
+func (w *wsServer) handleAdminTcpReachability(wr http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("missing host"))
+		return
+	}
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid port, expected 1 to 65535"))
+		return
+	}
+	period := defaultReachabilityPeriod
+	if s := r.URL.Query().Get("period"); s != "" {
+		period, err = time.ParseDuration(s)
+		if err != nil || period <= 0 {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid period %q", s))
+			return
+		}
+	}
+
+	reachability, err := results.GetTcpReachability(w.dbClient.WithContext(r.Context()), host, port, time.Now().UTC().Add(-period))
+	if err != nil {
+		dbErrors.WithLabelValues("load_tcp_reachability").Inc()
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(wr, http.StatusOK, reachability)
+}
+
+// handleAdminPathChanges lists the traceroute path changes over the last ?period= (defaultPathChangesPeriod),
+// ?sensorId= and ?target= filter a sensor and a target
+func (w *wsServer) handleAdminPathChanges(wr http.ResponseWriter, r *http.Request) {
+	var sensorId *uuid.UUID
+	if s := r.URL.Query().Get("sensorId"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sensorId %q", s))
+			return
+		}
+		sensorId = &id
+	}
+	var target net.IP
+	if s := r.URL.Query().Get("target"); s != "" {
+		target = net.ParseIP(s)
+		if target == nil {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid target %q, expected an IP address", s))
+			return
+		}
+	}
+	period := defaultPathChangesPeriod
+	if s := r.URL.Query().Get("period"); s != "" {
+		var err error
+		period, err = time.ParseDuration(s)
+		if err != nil || period <= 0 {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid period %q", s))
+			return
+		}
+	}
+
+	changes, err := results.GetPathChanges(w.dbClient.WithContext(r.Context()), sensorId, target, time.Now().UTC().Add(-period))
+	if err != nil {
+		dbErrors.WithLabelValues("load_path_changes").Inc()
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(wr, http.StatusOK, changes)
+}
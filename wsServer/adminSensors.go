@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// disconnectApiRequest is the admin api body for force disconnecting a sensor
+type disconnectApiRequest struct {
+	Reason string
+}
+
+// drainApiRequest is the admin api body for draining a sensor, Drain false puts it back in rotation
+type drainApiRequest struct {
+	Drain bool
+}
+
+// adminCommandResponse tells if the command was applied here or forwarded to the other instances
+type adminCommandResponse struct {
+	SensorId  uuid.UUID
+	Applied   bool
+	Forwarded bool
+}
+
+// handleAdminListSensors lists the connected sensors, from all instances unless scope=local
+func (w *wsServer) handleAdminListSensors(wr http.ResponseWriter, r *http.Request) {
+	presences := make(map[uuid.UUID]sensorPresence)
+
+	if r.URL.Query().Get("scope") != "local" {
+		remote, err := w.listSensorPresence()
+		if err != nil {
+			writeApiError(wr, http.StatusBadGateway, err)
+			return
+		}
+		for _, p := range remote {
+			presences[p.SensorId] = p
+		}
+	}
+
+	// the local connections have live counters
+	for _, p := range w.localSensorPresence() {
+		presences[p.SensorId] = p
+	}
+
+	list := make([]sensorPresence, 0, len(presences))
+	for _, p := range presences {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ConnectedSince.Before(list[j].ConnectedSince)
+	})
+	writeJson(wr, http.StatusOK, list)
+}
+
+// handleAdminGetSensor returns the connection detail of a single sensor
+func (w *wsServer) handleAdminGetSensor(wr http.ResponseWriter, r *http.Request) {
+	sensorId, err := uuid.Parse(r.PathValue("sensorId"))
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sensorId: %v", err))
+		return
+	}
+
+	if wsConn, exists := w.getSensorWsConnection(sensorId); exists {
+		writeJson(wr, http.StatusOK, wsConn.presence(w.instanceId))
+		return
+	}
+
+	presence, exists, err := w.getSensorPresence(sensorId)
+	if err != nil {
+		writeApiError(wr, http.StatusBadGateway, err)
+		return
+	}
+	if !exists {
+		writeApiError(wr, http.StatusNotFound, fmt.Errorf("sensor is not connected"))
+		return
+	}
+	writeJson(wr, http.StatusOK, presence)
+}
+
+// handleAdminDisconnectSensor force disconnects a sensor with the given reason
+func (w *wsServer) handleAdminDisconnectSensor(wr http.ResponseWriter, r *http.Request) {
+	var body disconnectApiRequest
+	if !decodeOptionalBody(wr, r, &body) {
+		return
+	}
+	if body.Reason == "" {
+		body.Reason = "disconnected by admin"
+	}
+	w.runAdminCommand(wr, r, adminCommand{
+		Command: adminCommandDisconnect,
+		Reason:  body.Reason,
+	})
+}
+
+// handleAdminDrainSensor stops sending new tasks to a sensor, or resumes it
+func (w *wsServer) handleAdminDrainSensor(wr http.ResponseWriter, r *http.Request) {
+	var body = drainApiRequest{Drain: true}
+	if !decodeOptionalBody(wr, r, &body) {
+		return
+	}
+
+	sensorId, err := uuid.Parse(r.PathValue("sensorId"))
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sensorId: %v", err))
+		return
+	}
+
+	// persisted, so the flag survives reconnects to any instance
+	err = w.setSensorDrain(sensorId, body.Drain)
+	if err != nil {
+		writeApiError(wr, http.StatusBadGateway, err)
+		return
+	}
+
+	w.runAdminCommand(wr, r, adminCommand{
+		Command: adminCommandDrain,
+		Drain:   body.Drain,
+	})
+}
+
+// runAdminCommand applies the command if the sensor is connected here, otherwise forwards it
+func (w *wsServer) runAdminCommand(wr http.ResponseWriter, r *http.Request, cmd adminCommand) {
+	sensorId, err := uuid.Parse(r.PathValue("sensorId"))
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sensorId: %v", err))
+		return
+	}
+	cmd.SensorId = sensorId
+
+	applied, err := w.applyAdminCommand(cmd)
+	if err != nil {
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	if applied {
+		writeJson(wr, http.StatusOK, adminCommandResponse{SensorId: sensorId, Applied: true})
+		return
+	}
+
+	err = w.publishAdminCommand(cmd)
+	if err != nil {
+		writeApiError(wr, http.StatusBadGateway, err)
+		return
+	}
+	writeJson(wr, http.StatusAccepted, adminCommandResponse{SensorId: sensorId, Forwarded: true})
+}
+
+// localSensorPresence returns the presence of the sensors connected to this instance
+func (w *wsServer) localSensorPresence() []sensorPresence {
+	w.connLock.Lock()
+	defer w.connLock.Unlock()
+
+	presences := make([]sensorPresence, 0, len(w.sensorConnections))
+	for _, conn := range w.sensorConnections {
+		presences = append(presences, conn.presence(w.instanceId))
+	}
+	return presences
+}
+
+// decodeOptionalBody decodes the JSON body into v if there is one, false if the error was already written
+func decodeOptionalBody(wr http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil && err != io.EOF {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+		return false
+	}
+	return true
+}
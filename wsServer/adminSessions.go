@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSessionsLimit   = 100
+	maxSessionsLimit       = 1000
+	defaultUptimePeriod    = 24 * time.Hour
+	defaultFlappingWindow  = time.Hour
+	defaultFlappingMinimum = 5
+)
+
+// handleAdminSensorSessions lists the latest sessions of a sensor, ?limit= defaults to defaultSessionsLimit
+func (w *wsServer) handleAdminSensorSessions(wr http.ResponseWriter, r *http.Request) {
+	sensorId, err := uuid.Parse(r.PathValue("sensorId"))
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sensorId: %v", err))
+		return
+	}
+
+	limit := defaultSessionsLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxSessionsLimit {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid limit, expected 1 to %v", maxSessionsLimit))
+			return
+		}
+	}
+
+	sessions, err := GetSensorSessions(w.dbClient.WithContext(r.Context()), sensorId, limit)
+	if err != nil {
+		dbErrors.WithLabelValues("load_sessions").Inc()
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(wr, http.StatusOK, sessions)
+}
+
+// handleAdminSensorUptime returns the uptime of a sensor between ?from= and ?to= (RFC3339),
+// the last defaultUptimePeriod by default
+func (w *wsServer) handleAdminSensorUptime(wr http.ResponseWriter, r *http.Request) {
+	sensorId, err := uuid.Parse(r.PathValue("sensorId"))
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sensorId: %v", err))
+		return
+	}
+
+	to := time.Now().UTC()
+	if s := r.URL.Query().Get("to"); s != "" {
+		to, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid to: %v", err))
+			return
+		}
+	}
+	from := to.Add(-defaultUptimePeriod)
+	if s := r.URL.Query().Get("from"); s != "" {
+		from, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid from: %v", err))
+			return
+		}
+	}
+	if !to.After(from) {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("from must be before to"))
+		return
+	}
+
+	uptimes, err := GetSensorUptime(w.dbClient.WithContext(r.Context()), from, to, []uuid.UUID{sensorId})
+	if err != nil {
+		dbErrors.WithLabelValues("load_uptime").Inc()
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+
+	// a sensor without sessions in the period was down all the time
+	uptime := SensorUptime{SensorID: sensorId}
+	if len(uptimes) > 0 {
+		uptime = uptimes[0]
+	}
+	writeJson(wr, http.StatusOK, uptime)
+}
+
+// handleAdminFlappingSensors lists the sensors with at least ?min= sessions within ?window= (e.g. 1h)
+func (w *wsServer) handleAdminFlappingSensors(wr http.ResponseWriter, r *http.Request) {
+	var err error
+
+	window := defaultFlappingWindow
+	if s := r.URL.Query().Get("window"); s != "" {
+		window, err = time.ParseDuration(s)
+		if err != nil || window <= 0 {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid window: %v", s))
+			return
+		}
+	}
+
+	minSessions := defaultFlappingMinimum
+	if s := r.URL.Query().Get("min"); s != "" {
+		minSessions, err = strconv.Atoi(s)
+		if err != nil || minSessions < 2 {
+			writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid min, expected at least 2"))
+			return
+		}
+	}
+
+	flapping, err := GetFlappingSensors(w.dbClient.WithContext(r.Context()), window, minSessions)
+	if err != nil {
+		dbErrors.WithLabelValues("load_flapping").Inc()
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	if flapping == nil {
+		flapping = []SensorFlapping{}
+	}
+	writeJson(wr, http.StatusOK, flapping)
+}
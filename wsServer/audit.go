@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditEventType is what happened, the detail is in AuditEvent.Detail
+type AuditEventType string
+
+const (
+	AuditPolicyAddrDenied     AuditEventType = "POLICY_ADDR_DENIED"
+	AuditPolicyTaskTypeDenied AuditEventType = "POLICY_TASK_TYPE_DENIED"
+	AuditPolicyExpired        AuditEventType = "POLICY_OUTSIDE_VALIDITY"
+
+	// the result mismatches count in the sensor reputation
+	AuditResultUnknownTask      AuditEventType = "RESULT_UNKNOWN_TASK"
+	AuditResultForeignTask      AuditEventType = "RESULT_FOREIGN_TASK"
+	AuditResultTaskTypeMismatch AuditEventType = "RESULT_TASK_TYPE_MISMATCH"
+	AuditResultNotDispatched    AuditEventType = "RESULT_NOT_DISPATCHED"
+	AuditResultInvalidTime      AuditEventType = "RESULT_INVALID_TIME"
+)
+
+// AuditEvent records a security relevant decision about a sensor
+type AuditEvent struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement"`
+	Time       time.Time `gorm:"type:TIMESTAMPTZ;not null"`
+	SensorID   uuid.UUID `gorm:"type:uuid;not null"`
+	Event      AuditEventType
+	TaskID     *uuid.UUID `gorm:"type:uuid;"`
+	RemoteAddr string
+	InstanceID string
+	Detail     string
+}
+
+// recordAuditEvent stores the event, failures are logged only since the decision is already made
+func (w *wsServer) recordAuditEvent(event AuditEvent) {
+	event.Time = time.Now().UTC()
+	event.InstanceID = w.instanceId
+
+	w.serverLogger.Warn(fmt.Sprintf("audit %v, sensorId:%v, detail:%v", event.Event, event.SensorID, event.Detail))
+	auditEvents.WithLabelValues(string(event.Event)).Inc()
+
+	err := w.dbClient.Create(&event).Error
+	if err != nil {
+		dbErrors.WithLabelValues("insert_audit_event").Inc()
+		w.serverLogger.Error(fmt.Sprintf("failed to store audit event %v of sensor %v: %v", event.Event, event.SensorID, err))
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultJwtAudience is the aud claim the sensor tokens must carry
+	DefaultJwtAudience = "ping42-server"
+	// DefaultJwtMaxLifetime is the max exp - iat accepted, the sensors sign a fresh token per connection
+	DefaultJwtMaxLifetime = 15 * time.Minute
+	// jwtLeeway tolerates the clock skew between the sensors and the server
+	jwtLeeway = 30 * time.Second
+	// redisJwtIdKeyPrefix stores the used jti of every sensor until the token expires
+	redisJwtIdKeyPrefix = "server_jwt_jti_"
+)
+
+var (
+	errTokenReplayed  = errors.New("token was already used")
+	errUnsupportedKey = errors.New("unsupported public key, expected Ed25519 or ECDSA P-256/P-384/P-521")
+	errNoSensorKey    = errors.New("sensor has neither a secret nor an active public key")
+)
+
+// SensorPublicKey is a public key the sensor signs its tokens with, the private key never leaves the sensor
+type SensorPublicKey struct {
+	ID       uuid.UUID     `gorm:"type:uuid;primaryKey"`
+	SensorID uuid.UUID     `gorm:"type:uuid;not null"`
+	Sensor   models.Sensor `gorm:"foreignKey:SensorID"`
+	// Algorithm is the JWT alg the key is used with: EdDSA, ES256, ES384 or ES512
+	Algorithm string
+	// PublicKey is PEM encoded, PKIX
+	PublicKey string
+	CreatedAt time.Time
+	// RevokedAt is set once the key must no longer be accepted
+	RevokedAt *time.Time
+}
+
+// NewSensorPublicKey parses a PEM encoded Ed25519 or ECDSA public key of the sensor
+func NewSensorPublicKey(sensorId uuid.UUID, publicKeyPem []byte) (key SensorPublicKey, err error) {
+	block, _ := pem.Decode(publicKeyPem)
+	if block == nil {
+		err = fmt.Errorf("public key is not PEM encoded")
+		return
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		err = fmt.Errorf("ParsePKIXPublicKey err: %v", err)
+		return
+	}
+	alg, err := publicKeyAlgorithm(pub)
+	if err != nil {
+		return
+	}
+
+	key = SensorPublicKey{
+		ID:        uuid.New(),
+		SensorID:  sensorId,
+		Algorithm: alg,
+		PublicKey: string(pem.EncodeToMemory(block)),
+	}
+	return
+}
+
+// publicKeyAlgorithm returns the JWT alg matching the key type and curve
+func publicKeyAlgorithm(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA.Alg(), nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256.Alg(), nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384.Alg(), nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512.Alg(), nil
+		}
+	}
+	return "", errUnsupportedKey
+}
+
+// sensorClaims are the claims of the token the sensor connects with
+type sensorClaims struct {
+	SensorId string `json:"sensorId"`
+	jwt.RegisteredClaims
+}
+
+// parseAndValidateJwtToken validates the sensor token: the signature with the sensor secret (HS*)
+// or one of its public keys (EdDSA, ES*), the required exp, iat, aud and jti claims, and the jti
+// was not used before. The token header kid selects the public key, all active keys are tried otherwise.
+func (w *wsServer) parseAndValidateJwtToken(jwtToken string) (sensorId uuid.UUID, err error) {
+
+	// Parse the token without validation in order to get the sensorId
+	var unverifiedClaims sensorClaims
+	_, _, err = new(jwt.Parser).ParseUnverified(jwtToken, &unverifiedClaims)
+	if err != nil {
+		err = fmt.Errorf("ParseUnverified: %v", err)
+		return
+	}
+	sensorIdNotValidated, err := uuid.Parse(unverifiedClaims.SensorId)
+	if err != nil {
+		err = fmt.Errorf("sensorId claim not found or not uuid.UUID: %v", err)
+		return
+	}
+
+	// load the credentials of the NOT VALIDATED sensor
+	creds, err := w.getSensorCredentials(sensorIdNotValidated)
+	if err != nil {
+		err = fmt.Errorf("Failed to load the sensor credentials, sensorIdNotValidated: %v, err: %w", sensorIdNotValidated, err)
+		return
+	}
+	if creds.secret == "" && len(creds.publicKeys) == 0 {
+		err = fmt.Errorf("%w, sensorIdNotValidated: %v", errNoSensorKey, sensorIdNotValidated)
+		return
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithAudience(w.jwtAudience()),
+		jwt.WithLeeway(jwtLeeway),
+	)
+
+	var claims sensorClaims
+	var token *jwt.Token
+	for _, keyFunc := range sensorKeyFuncs(creds.secret, creds.publicKeys) {
+		claims = sensorClaims{}
+		token, err = parser.ParseWithClaims(jwtToken, &claims, keyFunc)
+		// only a wrong key is worth trying the next one
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) && !errors.Is(err, jwt.ErrTokenUnverifiable) {
+			break
+		}
+	}
+
+	switch {
+	case err == nil && token.Valid:
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		err = fmt.Errorf("That's not even a JWT token, per sensorIdNotValidated: %v", sensorIdNotValidated)
+		return
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid) || errors.Is(err, jwt.ErrTokenUnverifiable):
+		err = fmt.Errorf("Invalid JWT signature, per sensorIdNotValidated: %v, err: %v", sensorIdNotValidated, err)
+		return
+	case errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet) || errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		err = fmt.Errorf("JWT Token is either expired or not active yet, per sensorIdNotValidated: %v", sensorIdNotValidated)
+		return
+	default:
+		err = fmt.Errorf("JWT Couldn't handle this token: %v, per sensorIdNotValidated: %v", err, sensorIdNotValidated)
+		return
+	}
+
+	// the signature is valid, now the claims the parser treats as optional
+	if claims.IssuedAt == nil {
+		err = fmt.Errorf("JWT Token without iat, per sensorIdNotValidated: %v", sensorIdNotValidated)
+		return
+	}
+	if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime > w.jwtMaxLifetime() {
+		err = fmt.Errorf("JWT Token lifetime %v exceeds %v, per sensorIdNotValidated: %v", lifetime, w.jwtMaxLifetime(), sensorIdNotValidated)
+		return
+	}
+	if claims.ID == "" {
+		err = fmt.Errorf("JWT Token without jti, per sensorIdNotValidated: %v", sensorIdNotValidated)
+		return
+	}
+
+	err = w.useJwtId(sensorIdNotValidated, claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		err = fmt.Errorf("%w, per sensorIdNotValidated: %v", err, sensorIdNotValidated)
+		return
+	}
+
+	sensorId = sensorIdNotValidated
+	return
+}
+
+// useJwtId records the jti until the token expires, a second use is rejected
+func (w *wsServer) useJwtId(sensorId uuid.UUID, jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt) + jwtLeeway
+	ok, err := w.redisClient.SetNX(redisJwtIdKeyPrefix+sensorId.String()+"_"+jti, 1, ttl).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("set_jwt_id").Inc()
+		return fmt.Errorf("failed to store the jti in Redis:%v", err)
+	}
+	if !ok {
+		return errTokenReplayed
+	}
+	return nil
+}
+
+// sensorKeyFuncs returns a key func per key the token may be signed with
+func sensorKeyFuncs(secret string, publicKeys []SensorPublicKey) (keyFuncs []jwt.Keyfunc) {
+	if secret != "" {
+		keyFuncs = append(keyFuncs, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("%w: unexpected signing method: %v", jwt.ErrTokenSignatureInvalid, token.Header["alg"])
+			}
+			return []byte(secret), nil
+		})
+	}
+
+	for _, key := range publicKeys {
+		keyFuncs = append(keyFuncs, func(token *jwt.Token) (interface{}, error) {
+			if kid, ok := token.Header["kid"].(string); ok && kid != key.ID.String() {
+				return nil, fmt.Errorf("%w: kid %v does not match key %v", jwt.ErrTokenSignatureInvalid, kid, key.ID)
+			}
+			if token.Method.Alg() != key.Algorithm {
+				return nil, fmt.Errorf("%w: unexpected signing method: %v, key %v is %v", jwt.ErrTokenSignatureInvalid, token.Header["alg"], key.ID, key.Algorithm)
+			}
+			return key.parse()
+		})
+	}
+	return
+}
+
+// parse returns the crypto key of the PEM
+func (k SensorPublicKey) parse() (interface{}, error) {
+	switch k.Algorithm {
+	case jwt.SigningMethodEdDSA.Alg():
+		return jwt.ParseEdPublicKeyFromPEM([]byte(k.PublicKey))
+	case jwt.SigningMethodES256.Alg(), jwt.SigningMethodES384.Alg(), jwt.SigningMethodES512.Alg():
+		return jwt.ParseECPublicKeyFromPEM([]byte(k.PublicKey))
+	}
+	return nil, fmt.Errorf("%w: key %v", errUnsupportedKey, k.ID)
+}
+
+// getActiveSensorPublicKeys returns the not revoked public keys of the sensor
+func getActiveSensorPublicKeys(db *gorm.DB, sensorId uuid.UUID) (keys []SensorPublicKey, err error) {
+	err = db.Where("sensor_id = ? AND revoked_at IS NULL", sensorId).
+		Order("created_at DESC").
+		Find(&keys).Error
+	return
+}
+
+func (w *wsServer) jwtAudience() string {
+	if w.opts.JwtAudience == "" {
+		return DefaultJwtAudience
+	}
+	return w.opts.JwtAudience
+}
+
+func (w *wsServer) jwtMaxLifetime() time.Duration {
+	if w.opts.JwtMaxLifetime <= 0 {
+		return DefaultJwtMaxLifetime
+	}
+	return w.opts.JwtMaxLifetime
+}
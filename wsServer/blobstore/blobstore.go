@@ -0,0 +1,39 @@
+// Package blobstore keeps the large payloads of the results, e.g. the http bodies,
+// out of Postgres, on the filesystem or in an S3-compatible bucket.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrNotFound is returned by Get when the key has no blob
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps blobs by key. The keys are content addressed by the callers,
+// so a Put of an existing key is a no-op.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// Open returns the store of location: a directory, file:///path or s3://bucket/prefix
+func Open(location string, s3 S3Config) (Store, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob store %q: %v", location, err)
+	}
+	switch u.Scheme {
+	case "", "file":
+		return NewFile(u.Path)
+	case "s3":
+		s3.Bucket = u.Host
+		s3.Prefix = strings.TrimPrefix(u.Path, "/")
+		return NewS3(s3)
+	default:
+		return nil, fmt.Errorf("unknown blob store scheme %q, expected file or s3", u.Scheme)
+	}
+}
@@ -0,0 +1,168 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultS3Region is the region of the requests when none is set
+const DefaultS3Region = "us-east-1"
+
+// s3Timeout bounds a single request to the bucket
+const s3Timeout = 30 * time.Second
+
+// S3Config locates an S3-compatible bucket, e.g. AWS S3, MinIO or Ceph
+type S3Config struct {
+	// Endpoint is the url of the service, defaults to the AWS endpoint of Region
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the keys, e.g. ping42/
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3 stores the blobs as objects of a bucket, with path-style requests signed with AWS Signature Version 4
+type S3 struct {
+	cfg    S3Config
+	client *http.Client
+}
+
+// NewS3 returns the store of the bucket
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("missing s3 bucket")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("missing s3 access key or secret key")
+	}
+	if cfg.Region == "" {
+		cfg.Region = DefaultS3Region
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", cfg.Region)
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint %q: %v", cfg.Endpoint, err)
+	}
+	return &S3{cfg: cfg, client: &http.Client{Timeout: s3Timeout}}, nil
+}
+
+// Put uploads the blob unless the object already exists
+func (s *S3) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodHead, key, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	resp, err = s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s.responseError("put", key, resp)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("get", key, resp)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading the s3 object %v err:%v", key, err)
+	}
+	return data, nil
+}
+
+func (s *S3) responseError(op string, key string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 %v %v: %v %s", op, key, resp.Status, bytes.TrimSpace(body))
+}
+
+// do sends the signed request of the object key
+func (s *S3) do(ctx context.Context, method string, key string, body []byte) (*http.Response, error) {
+	objectUrl := strings.TrimSuffix(s.cfg.Endpoint, "/") + "/" + path.Join(s.cfg.Bucket, s.cfg.Prefix, key)
+	req, err := http.NewRequestWithContext(ctx, method, objectUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("s3 request of %v err:%v", key, err)
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %v %v err:%v", strings.ToLower(method), key, err)
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 headers, the payload is signed with its hash
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+s.cfg.SecretKey), date)
+	signingKey = hmacSha256(signingKey, s.cfg.Region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
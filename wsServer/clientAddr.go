@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseTrustedProxies parses the proxy addresses or CIDRs allowed to set X-Real-IP and X-Forwarded-For
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes, err := parsePrefixes(proxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy %v", err)
+	}
+	return prefixes, nil
+}
+
+// parsePrefixes parses a list of addresses or CIDRs, an address is a single host prefix
+func parsePrefixes(list []string) (prefixes []netip.Prefix, err error) {
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, parseErr := netip.ParseAddr(s)
+			if parseErr != nil {
+				err = fmt.Errorf("%q: %v", s, parseErr)
+				return
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, parseErr := netip.ParsePrefix(s)
+		if parseErr != nil {
+			err = fmt.Errorf("%q: %v", s, parseErr)
+			return
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
+
+func (w *wsServer) isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range w.trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the sensor address. The proxy headers are honored only when
+// the request comes from a trusted proxy, otherwise anyone could spoof them.
+func (w *wsServer) clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !w.isTrustedProxy(peer) {
+		return host
+	}
+
+	// the closest untrusted hop of the chain is the client
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			if !w.isTrustedProxy(hop) || i == 0 {
+				return hop.Unmap().String()
+			}
+		}
+	}
+
+	if realIp, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIp.Unmap().String()
+	}
+	return host
+}
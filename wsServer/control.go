@@ -0,0 +1,332 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/logger"
+	"github.com/ping-42/42lib/wss"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultControlTimeout is how long we wait for the sensor to reply to a control request
+const defaultControlTimeout = 10 * time.Second
+
+// redisControlReplyKeyPrefix holds the reply of a control request forwarded to another instance, per RequestId
+const redisControlReplyKeyPrefix = "server_control_reply_"
+
+// Kinds of the errors of a forwarded control request, so the instance that got the api call answers the same
+const (
+	controlErrorNotConnected = "not_connected"
+	controlErrorInvalid      = "invalid"
+	controlErrorNoReply      = "no_reply"
+)
+
+var (
+	errInvalidControlRequest = errors.New("invalid control request")
+	errControlNoReply        = errors.New("no reply for control request")
+)
+
+// ControlCommand is the action the server asks the sensor to perform
+type ControlCommand string
+
+const (
+	// ControlCancelTask cancels the in-flight task with ControlRequest.TaskId
+	ControlCancelTask ControlCommand = "CANCEL_TASK"
+	// ControlUpdateConfig applies ControlRequest.Config to the sensor runtime
+	ControlUpdateConfig ControlCommand = "UPDATE_CONFIG"
+	// ControlRequestTelemetry asks for an immediate telemetry snapshot, returned as the reply payload
+	ControlRequestTelemetry ControlCommand = "REQUEST_TELEMETRY"
+	// ControlRequestDiagnostics asks for a diagnostics report, returned as the reply payload
+	ControlRequestDiagnostics ControlCommand = "REQUEST_DIAGNOSTICS"
+	// ControlRestart asks the sensor to finish its in-flight tasks and restart
+	ControlRestart ControlCommand = "RESTART"
+)
+
+// RuntimeConfig holds the sensor settings that can be changed at runtime, nil fields are left unchanged
+type RuntimeConfig struct {
+	TelemetryInterval *time.Duration `json:",omitempty"`
+	LogLevel          *string        `json:",omitempty"`
+}
+
+// ControlRequest is sent from the server to the sensor
+type ControlRequest struct {
+	// MessageGeneralType is required for all messages sent via WSS
+	wss.MessageGeneralType
+
+	// RequestId is echoed back in the ControlReply
+	RequestId uuid.UUID
+	Command   ControlCommand
+	TaskId    uuid.UUID
+	Config    *RuntimeConfig `json:",omitempty"`
+}
+
+// ControlReply is sent from the sensor as a response to a ControlRequest
+type ControlReply struct {
+	// MessageGeneralType is required for all messages sent via WSS
+	wss.MessageGeneralType
+
+	RequestId uuid.UUID
+	Ok        bool
+	Error     string          `json:",omitempty"`
+	Payload   json.RawMessage `json:",omitempty"`
+}
+
+// validate checks the request has everything its command needs
+func (r ControlRequest) validate() error {
+	switch r.Command {
+	case ControlCancelTask:
+		if r.TaskId == uuid.Nil {
+			return fmt.Errorf("%v requires TaskId", r.Command)
+		}
+	case ControlUpdateConfig:
+		if r.Config == nil {
+			return fmt.Errorf("%v requires Config", r.Command)
+		}
+	case ControlRequestTelemetry, ControlRequestDiagnostics, ControlRestart:
+	default:
+		return fmt.Errorf("unknown control command: %q", r.Command)
+	}
+	return nil
+}
+
+// controlReplies keeps the requests waiting for a reply, per RequestId
+type controlReplies struct {
+	sync.Mutex
+	pending map[uuid.UUID]pendingControl
+}
+
+// pendingControl is a request waiting for the reply of sensorId
+type pendingControl struct {
+	sensorId uuid.UUID
+	reply    chan ControlReply
+}
+
+func (c *controlReplies) add(requestId uuid.UUID, sensorId uuid.UUID) chan ControlReply {
+	c.Lock()
+	defer c.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[uuid.UUID]pendingControl)
+	}
+	ch := make(chan ControlReply, 1)
+	c.pending[requestId] = pendingControl{sensorId: sensorId, reply: ch}
+	return ch
+}
+
+func (c *controlReplies) remove(requestId uuid.UUID) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.pending, requestId)
+}
+
+// resolve passes the reply of sensorId to the waiting request,
+// false if nobody waits for it anymore or the request was sent to another sensor
+func (c *controlReplies) resolve(sensorId uuid.UUID, reply ControlReply) bool {
+	c.Lock()
+	defer c.Unlock()
+	p, ok := c.pending[reply.RequestId]
+	if !ok || p.sensorId != sensorId {
+		return false
+	}
+	delete(c.pending, reply.RequestId)
+	p.reply <- reply
+	return true
+}
+
+// sendControl sends the request to a sensor connected to this server and waits for its reply
+func (w *wsServer) sendControl(ctx context.Context, sensorId uuid.UUID, req ControlRequest) (reply ControlReply, err error) {
+	err = req.validate()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", errInvalidControlRequest, err)
+		return
+	}
+
+	wsConn, exists := w.getSensorWsConnection(sensorId)
+	if !exists {
+		err = errSensorNotConnected
+		return
+	}
+
+	req.MessageGeneralType = MessageTypeControl
+	// a forwarded request keeps the id its reply is waited for with
+	if req.RequestId == uuid.Nil {
+		req.RequestId = uuid.New()
+	}
+
+	msg, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("marshal ControlRequest err:%v", err)
+		return
+	}
+
+	replyCh := w.controlReplies.add(req.RequestId, sensorId)
+	defer w.controlReplies.remove(req.RequestId)
+
+	w.serverLogger.WithFields(log.Fields{
+		"connectionId": wsConn.ConnectionId.String(),
+		"sensorId":     sensorId,
+		"requestId":    req.RequestId,
+	}).Info(fmt.Sprintf("Sending control request: %v", req.Command))
+
+	err = wsConn.write(msg)
+	if err != nil {
+		err = fmt.Errorf("error sending ControlRequest to sensor: %v, %v", wsConn.ConnectionId.String(), err)
+		return
+	}
+
+	select {
+	case reply = <-replyCh:
+		return
+	case <-ctx.Done():
+		err = fmt.Errorf("%w %v: %v", errControlNoReply, req.RequestId, ctx.Err())
+		return
+	}
+}
+
+// controlSensor sends the request to the sensor, through the instance holding its connection
+func (w *wsServer) controlSensor(ctx context.Context, sensorId uuid.UUID, req ControlRequest) (reply ControlReply, err error) {
+	if _, exists := w.getSensorWsConnection(sensorId); exists {
+		return w.sendControl(ctx, sensorId, req)
+	}
+
+	err = req.validate()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", errInvalidControlRequest, err)
+		return
+	}
+	presence, exists, err := w.getSensorPresence(sensorId)
+	if err != nil {
+		return
+	}
+	if !exists || presence.InstanceId == w.instanceId {
+		err = errSensorNotConnected
+		return
+	}
+	return w.forwardControl(ctx, presence.InstanceId, sensorId, req)
+}
+
+// forwardedControlReply is pushed back by the instance holding the sensor, ErrorKind is set with Error
+type forwardedControlReply struct {
+	Reply     ControlReply
+	Error     string `json:",omitempty"`
+	ErrorKind string `json:",omitempty"`
+}
+
+func (r forwardedControlReply) err() error {
+	switch {
+	case r.Error == "":
+		return nil
+	case r.ErrorKind == controlErrorNotConnected:
+		return errSensorNotConnected
+	case r.ErrorKind == controlErrorInvalid:
+		return fmt.Errorf("%w: %v", errInvalidControlRequest, r.Error)
+	case r.ErrorKind == controlErrorNoReply:
+		return fmt.Errorf("%w: %v", errControlNoReply, r.Error)
+	}
+	return errors.New(r.Error)
+}
+
+// forwardControl publishes the request to the instance holding the sensor, and waits for the reply it pushes
+func (w *wsServer) forwardControl(ctx context.Context, instanceId string, sensorId uuid.UUID, req ControlRequest) (reply ControlReply, err error) {
+	timeout := defaultControlTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	req.RequestId = uuid.New()
+
+	err = w.publishAdminCommand(adminCommand{
+		Command:        adminCommandControl,
+		SensorId:       sensorId,
+		ToInstanceId:   instanceId,
+		Control:        &req,
+		ControlTimeout: timeout,
+	})
+	if err != nil {
+		return
+	}
+
+	// BLPOP waits whole seconds
+	res, err := w.redisClient.BLPop(max(timeout, time.Second), redisControlReplyKeyPrefix+req.RequestId.String()).Result()
+	if err == redis.Nil {
+		err = fmt.Errorf("%w %v: forwarded to instance %v", errControlNoReply, req.RequestId, instanceId)
+		return
+	}
+	if err != nil {
+		redisErrors.WithLabelValues("control_reply").Inc()
+		err = fmt.Errorf("failed to wait for the control reply:%v", err)
+		return
+	}
+
+	var forwarded forwardedControlReply
+	err = json.Unmarshal([]byte(res[1]), &forwarded)
+	if err != nil {
+		err = fmt.Errorf("unmarshal forwarded ControlReply err:%v", err)
+		return
+	}
+	return forwarded.Reply, forwarded.err()
+}
+
+// answerForwardedControl sends the request forwarded by another instance, and pushes the reply back to it
+func (w *wsServer) answerForwardedControl(cmd adminCommand) {
+	timeout := cmd.ControlTimeout
+	if timeout <= 0 {
+		timeout = defaultControlTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	reply, err := w.sendControl(ctx, cmd.SensorId, *cmd.Control)
+	forwarded := forwardedControlReply{Reply: reply}
+	if err != nil {
+		forwarded.Error = err.Error()
+		switch {
+		case errors.Is(err, errSensorNotConnected):
+			forwarded.ErrorKind = controlErrorNotConnected
+		case errors.Is(err, errInvalidControlRequest):
+			forwarded.ErrorKind = controlErrorInvalid
+		case errors.Is(err, errControlNoReply):
+			forwarded.ErrorKind = controlErrorNoReply
+		}
+	}
+
+	msg, err := json.Marshal(forwarded)
+	if err != nil {
+		logger.LogError(err.Error(), "answerForwardedControl, marshal reply", w.serverLogger)
+		return
+	}
+	// the key expires if the instance that waits for it is gone
+	key := redisControlReplyKeyPrefix + cmd.Control.RequestId.String()
+	_, err = w.redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(key, msg)
+		pipe.Expire(key, timeout+time.Minute)
+		return nil
+	})
+	if err != nil {
+		redisErrors.WithLabelValues("control_reply").Inc()
+		logger.LogError(err.Error(), fmt.Sprintf("answerForwardedControl, pushing the reply of %v", cmd.Control.RequestId), w.serverLogger)
+	}
+}
+
+func (w *wsServer) handleControlReplyMessage(conn *sensorConnection, msg []byte) (err error) {
+	var reply ControlReply
+	err = json.Unmarshal(msg, &reply)
+	if err != nil {
+		err = fmt.Errorf("Unmarshal ControlReply err:%v", err)
+		return
+	}
+
+	if !w.controlReplies.resolve(conn.SensorId, reply) {
+		w.serverLogger.WithFields(log.Fields{
+			"connectionId": conn.ConnectionId.String(),
+			"sensorId":     conn.SensorId,
+			"requestId":    reply.RequestId,
+		}).Warn("Unexpected control reply, the request timed out or was not sent to this sensor")
+	}
+	return
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestForwardedControlReplyErr(t *testing.T) {
+	tests := []struct {
+		reply    forwardedControlReply
+		expected error
+	}{
+		{forwardedControlReply{ErrorKind: controlErrorNotConnected, Error: "sensor is not connected"}, errSensorNotConnected},
+		{forwardedControlReply{ErrorKind: controlErrorInvalid, Error: "CANCEL_TASK requires TaskId"}, errInvalidControlRequest},
+		{forwardedControlReply{ErrorKind: controlErrorNoReply, Error: "context deadline exceeded"}, errControlNoReply},
+	}
+	for _, test := range tests {
+		if err := test.reply.err(); !errors.Is(err, test.expected) {
+			t.Errorf("%+v: err = %v, expected %v", test.reply, err, test.expected)
+		}
+	}
+
+	if err := (forwardedControlReply{}).err(); err != nil {
+		t.Errorf("err of a reply = %v", err)
+	}
+	err := forwardedControlReply{Error: "connection reset"}.err()
+	if err == nil || errors.Is(err, errSensorNotConnected) || errors.Is(err, errControlNoReply) {
+		t.Errorf("err of a send failure = %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/logger"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+)
+
+// SensorCredentialsChannel tells every instance to drop the cached credentials of a sensor
+const SensorCredentialsChannel = "SERVER_SENSOR_CREDENTIALS_CHANNEL"
+
+const (
+	// DefaultCredentialsCacheTtl bounds how long a change missed on the channel goes unnoticed
+	DefaultCredentialsCacheTtl = 5 * time.Minute
+	// credentialsNegativeTtl caches the unknown sensor ids, a new sensor is announced on the channel anyway
+	credentialsNegativeTtl = 30 * time.Second
+)
+
+// CredentialsChange is the reason the credentials of a sensor changed
+type CredentialsChange string
+
+const (
+	CredentialsCreated  CredentialsChange = "CREATED"
+	CredentialsRotated  CredentialsChange = "ROTATED"
+	CredentialsDisabled CredentialsChange = "DISABLED"
+	PolicyChanged       CredentialsChange = "POLICY_CHANGED"
+)
+
+// CredentialsChangeMessage is published on SensorCredentialsChannel
+type CredentialsChangeMessage struct {
+	SensorId uuid.UUID
+	Change   CredentialsChange
+}
+
+var errSensorNotFound = errors.New("sensor not found")
+
+// sensorCredentials is what the token of a sensor is validated with, and its policy
+type sensorCredentials struct {
+	secret     string
+	publicKeys []SensorPublicKey
+	policy     *SensorPolicy
+}
+
+type cachedCredentials struct {
+	creds     sensorCredentials
+	found     bool
+	expiresAt time.Time
+}
+
+// credentialCache keeps the sensor credentials in memory, so a reconnect storm does not hit the db
+// once per sensor connection. Concurrent misses for the same sensor share a single load.
+type credentialCache struct {
+	sync.Mutex
+	entries map[uuid.UUID]cachedCredentials
+	loads   singleflight.Group
+	ttl     time.Duration
+	// generation changes on every invalidation, a load started before is not stored
+	generation uint64
+}
+
+func newCredentialCache(ttl time.Duration) *credentialCache {
+	if ttl <= 0 {
+		ttl = DefaultCredentialsCacheTtl
+	}
+	return &credentialCache{
+		entries: make(map[uuid.UUID]cachedCredentials),
+		ttl:     ttl,
+	}
+}
+
+// get returns the cached credentials, or loads them with load
+func (c *credentialCache) get(sensorId uuid.UUID, load func() (sensorCredentials, bool, error)) (creds sensorCredentials, err error) {
+	c.Lock()
+	entry, ok := c.entries[sensorId]
+	c.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		credentialCacheLookups.WithLabelValues("hit").Inc()
+		if !entry.found {
+			return creds, errSensorNotFound
+		}
+		return entry.creds, nil
+	}
+	credentialCacheLookups.WithLabelValues("miss").Inc()
+
+	v, err, _ := c.loads.Do(sensorId.String(), func() (interface{}, error) {
+		c.Lock()
+		generation := c.generation
+		c.Unlock()
+
+		creds, found, err := load()
+		if err != nil {
+			// db errors are not cached
+			return nil, err
+		}
+		ttl := c.ttl
+		if !found {
+			ttl = credentialsNegativeTtl
+		}
+		entry := cachedCredentials{creds: creds, found: found, expiresAt: time.Now().Add(ttl)}
+		c.Lock()
+		if c.generation == generation {
+			c.entries[sensorId] = entry
+		}
+		c.Unlock()
+		return entry, nil
+	})
+	if err != nil {
+		return
+	}
+	entry = v.(cachedCredentials)
+	if !entry.found {
+		return creds, errSensorNotFound
+	}
+	return entry.creds, nil
+}
+
+// invalidate drops the cached credentials of the sensor, the loads in flight are not
+// stored and the next lookup loads again
+func (c *credentialCache) invalidate(sensorId uuid.UUID) {
+	c.Lock()
+	defer c.Unlock()
+	c.generation++
+	delete(c.entries, sensorId)
+	c.loads.Forget(sensorId.String())
+}
+
+// purgeExpired drops the expired entries every ttl, the unknown ids would otherwise pile up
+func (c *credentialCache) purgeExpired() {
+	for range time.Tick(c.ttl) {
+		c.Lock()
+		now := time.Now()
+		for sensorId, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, sensorId)
+			}
+		}
+		c.Unlock()
+	}
+}
+
+// getSensorCredentials returns the secret and the active public keys of the sensor
+func (w *wsServer) getSensorCredentials(sensorId uuid.UUID) (sensorCredentials, error) {
+	return w.credentials.get(sensorId, func() (creds sensorCredentials, found bool, err error) {
+		var sensor models.Sensor
+		err = w.dbClient.Select("id", "secret").First(&sensor, "id = ?", sensorId).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return creds, false, nil
+		}
+		if err != nil {
+			dbErrors.WithLabelValues("load_sensor").Inc()
+			err = fmt.Errorf("Failed to load Sensor record: %v", err)
+			return
+		}
+
+		creds.publicKeys, err = getActiveSensorPublicKeys(w.dbClient, sensorId)
+		if err != nil {
+			dbErrors.WithLabelValues("load_public_keys").Inc()
+			err = fmt.Errorf("Failed to load the sensor public keys: %v", err)
+			return
+		}
+		creds.policy, err = getSensorPolicy(w.dbClient, sensorId)
+		if err != nil {
+			dbErrors.WithLabelValues("load_policy").Inc()
+			err = fmt.Errorf("Failed to load the sensor policy: %v", err)
+			return
+		}
+		creds.secret = sensor.Secret
+		return creds, true, nil
+	})
+}
+
+// PublishCredentialsChange tells every server instance the credentials of the sensor changed
+func PublishCredentialsChange(redisClient *redis.Client, sensorId uuid.UUID, change CredentialsChange) error {
+	msg, err := json.Marshal(CredentialsChangeMessage{SensorId: sensorId, Change: change})
+	if err != nil {
+		return fmt.Errorf("marshal CredentialsChangeMessage err:%v", err)
+	}
+	err = redisClient.Publish(SensorCredentialsChannel, msg).Err()
+	if err != nil {
+		return fmt.Errorf("failed to publish credentials change:%v", err)
+	}
+	return nil
+}
+
+// credentialsListener drops the cached credentials and policies of the changed sensors,
+// and disconnects the sensors disabled or no longer allowed by their policy
+func (w *wsServer) credentialsListener() {
+	pubsub := w.redisClient.Subscribe(SensorCredentialsChannel)
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			redisErrors.WithLabelValues("pubsub_receive").Inc()
+			logger.LogError(err.Error(), "credentialsListener, error receiving message", w.serverLogger)
+			continue
+		}
+
+		var change CredentialsChangeMessage
+		err = json.Unmarshal([]byte(msg.Payload), &change)
+		if err != nil {
+			logger.LogError(err.Error(), fmt.Sprintf("credentialsListener, error unmarshal message:%v", msg.Payload), w.serverLogger)
+			continue
+		}
+
+		w.credentials.invalidate(change.SensorId)
+		w.serverLogger.WithFields(log.Fields{
+			"sensorId": change.SensorId,
+			"change":   change.Change,
+		}).Info("Sensor credentials changed")
+
+		var disconnectReason string
+		switch change.Change {
+		case CredentialsDisabled:
+			disconnectReason = "sensor disabled"
+		case PolicyChanged:
+			// a connection the new policy denies is closed
+			if wsConn, exists := w.getSensorWsConnection(change.SensorId); exists {
+				if policyErr := w.authorizeConnection(change.SensorId, wsConn.remoteAddr); policyErr != nil {
+					disconnectReason = "not allowed by the sensor policy"
+				}
+			}
+		}
+		if disconnectReason == "" {
+			continue
+		}
+
+		_, err = w.applyAdminCommand(adminCommand{
+			Command:  adminCommandDisconnect,
+			SensorId: change.SensorId,
+			Reason:   disconnectReason,
+		})
+		if err != nil {
+			logger.LogError(err.Error(), "credentialsListener, error disconnecting sensor", w.serverLogger)
+		}
+	}
+}
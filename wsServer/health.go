@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// healthCheckTimeout bounds each dependency check of the readiness probe
+const healthCheckTimeout = 2 * time.Second
+
+// healthStatus is the JSON body of the /healthz and /readyz endpoints
+type healthStatus struct {
+	Ok     bool
+	Checks map[string]healthCheck
+}
+
+// healthCheck is the outcome of a single check
+type healthCheck struct {
+	Ok        bool
+	Error     string `json:",omitempty"`
+	LatencyMs int64
+}
+
+// handleLiveness reports if the process is still doing its job,
+// it fails once the scheduler listener has stopped, so the instance gets restarted
+func (w *wsServer) handleLiveness(wr http.ResponseWriter, r *http.Request) {
+	w.writeHealth(wr, map[string]healthCheck{
+		"schedulerListener": w.checkSchedulerListener(),
+	})
+}
+
+// handleReadiness reports if the instance can serve sensors,
+// it fails when any of the dependencies is down, so no new sensors are routed to it
+func (w *wsServer) handleReadiness(wr http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	checks := map[string]healthCheck{
+		"postgres":          timedCheck(func() error { return w.pingPostgres(ctx) }),
+		"redis":             timedCheck(func() error { return w.redisClient.Ping().Err() }),
+		"schedulerListener": w.checkSchedulerListener(),
+	}
+	// the streams intake has no task subscription
+	if w.redisPubSub != nil {
+		checks["pubsub"] = timedCheck(func() error { return w.redisPubSub.Ping() })
+	}
+	w.writeHealth(wr, checks)
+}
+
+func (w *wsServer) writeHealth(wr http.ResponseWriter, checks map[string]healthCheck) {
+	status := healthStatus{Ok: true, Checks: checks}
+	for _, c := range checks {
+		if !c.Ok {
+			status.Ok = false
+		}
+	}
+
+	if !status.Ok {
+		writeJson(wr, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJson(wr, http.StatusOK, status)
+}
+
+func (w *wsServer) pingPostgres(ctx context.Context) error {
+	sqlDb, err := w.dbClient.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDb.PingContext(ctx)
+}
+
+func (w *wsServer) checkSchedulerListener() healthCheck {
+	if !w.listenerRunning.Load() {
+		return healthCheck{Error: "scheduler listener is not running"}
+	}
+	return healthCheck{Ok: true}
+}
+
+// timedCheck runs check and measures its latency
+func timedCheck(check func() error) healthCheck {
+	start := time.Now()
+	err := check()
+	res := healthCheck{
+		Ok:        err == nil,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		res.Error = fmt.Sprint(err)
+	}
+	return res
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/ping-42/server/wsServer/blobstore"
+	"github.com/ping-42/server/wsServer/results"
+)
+
+var sha256HexPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// handleAdminHttpBody returns the http body stored by the full policy under its SHA-256
+func (w *wsServer) handleAdminHttpBody(wr http.ResponseWriter, r *http.Request) {
+	sha256Hex := r.PathValue("sha256")
+	if !sha256HexPattern.MatchString(sha256Hex) {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sha256, expected 64 lowercase hex digits"))
+		return
+	}
+	if w.blobs == nil {
+		writeApiError(wr, http.StatusNotFound, fmt.Errorf("no blob store configured"))
+		return
+	}
+
+	body, err := w.blobs.Get(r.Context(), results.BlobKey(sha256Hex))
+	if errors.Is(err, blobstore.ErrNotFound) {
+		writeApiError(wr, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	wr.WriteHeader(http.StatusOK)
+	wr.Write(body)
+}
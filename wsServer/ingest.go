@@ -0,0 +1,365 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/logger"
+	"github.com/ping-42/42lib/sensor"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// Ingest defaults, used when the option is not set
+const (
+	DefaultIngestQueueSize     = 1000
+	DefaultIngestWorkers       = 4
+	DefaultIngestBatchSize     = 100
+	DefaultIngestFlushInterval = 200 * time.Millisecond
+)
+
+// Kinds of the messages passed to the ingest workers
+const (
+	ingestResult    = "result"
+	ingestTelemetry = "telemetry"
+	ingestBatch     = "batch"
+)
+
+// ingestItem is a message read from a sensor, waiting to be stored
+type ingestItem struct {
+	kind       string
+	conn       *sensorConnection
+	msg        []byte
+	receivedAt time.Time
+}
+
+// ingestPipeline decouples the reads of the sensor connections from the storage
+type ingestPipeline struct {
+	// queues has a queue per worker, the messages of a sensor always go to the same one
+	queues   []chan ingestItem
+	stopping chan struct{}
+	workers  sync.WaitGroup
+}
+
+// queued is the number of messages waiting in the queues
+func (p *ingestPipeline) queued() (n int) {
+	for _, queue := range p.queues {
+		n += len(queue)
+	}
+	return
+}
+
+// queueOf returns the queue of the sensor. A sensor is stored by a single worker, one flush at a time,
+// so its previous result is committed, or pending in the same flush, when the next one is stored.
+func (p *ingestPipeline) queueOf(sensorId uuid.UUID) chan ingestItem {
+	h := fnv.New32a()
+	h.Write(sensorId[:])
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+func (w *wsServer) ingestQueueSize() int {
+	if w.opts.IngestQueueSize <= 0 {
+		return DefaultIngestQueueSize
+	}
+	return w.opts.IngestQueueSize
+}
+
+func (w *wsServer) ingestWorkers() int {
+	if w.opts.IngestWorkers <= 0 {
+		return DefaultIngestWorkers
+	}
+	return w.opts.IngestWorkers
+}
+
+func (w *wsServer) ingestBatchSize() int {
+	if w.opts.IngestBatchSize <= 0 {
+		return DefaultIngestBatchSize
+	}
+	return w.opts.IngestBatchSize
+}
+
+func (w *wsServer) ingestFlushInterval() time.Duration {
+	if w.opts.IngestFlushInterval <= 0 {
+		return DefaultIngestFlushInterval
+	}
+	return w.opts.IngestFlushInterval
+}
+
+// startIngest creates the queues, the queue size is split between the workers, and starts the workers
+func (w *wsServer) startIngest() {
+	w.ingest = ingestPipeline{
+		queues:   make([]chan ingestItem, w.ingestWorkers()),
+		stopping: make(chan struct{}),
+	}
+	queueSize := max(w.ingestQueueSize()/w.ingestWorkers(), 1)
+	for i := range w.ingest.queues {
+		w.ingest.queues[i] = make(chan ingestItem, queueSize)
+		w.ingest.workers.Add(1)
+		go w.ingestWorker(w.ingest.queues[i])
+	}
+}
+
+// stopIngest lets the workers store the queued messages, until ctx is done
+func (w *wsServer) stopIngest(ctx context.Context) error {
+	close(w.ingest.stopping)
+	done := make(chan struct{})
+	go func() {
+		w.ingest.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("ingest queue not drained, %v messages left: %v", w.ingest.queued(), ctx.Err())
+	}
+}
+
+// enqueueIngest passes the message to the worker of the sensor. When its queue is full it blocks,
+// so the reads of this connection stop and the sensor is slowed down by the TCP flow control,
+// the other connections keep being read while their queue has room.
+// Once the server is stopping the message is dropped, the workers may be gone.
+func (w *wsServer) enqueueIngest(conn *sensorConnection, kind string, msg []byte) {
+	item := ingestItem{kind: kind, conn: conn, msg: msg, receivedAt: time.Now().UTC()}
+	queue := w.ingest.queueOf(conn.SensorId)
+	select {
+	case queue <- item:
+	case <-w.ingest.stopping:
+		w.dropIngestItem(item)
+		return
+	default:
+		ingestQueueFull.Inc()
+		w.serverLogger.WithFields(log.Fields{
+			"connectionId": conn.ConnectionId.String(),
+			"sensorId":     conn.SensorId,
+		}).Warn("Ingest queue full, the reads of the sensor wait for the storage")
+		select {
+		case queue <- item:
+		case <-w.ingest.stopping:
+			w.dropIngestItem(item)
+			return
+		}
+	}
+	ingestQueueLength.Set(float64(w.ingest.queued()))
+	w.resultsQueued(conn, kind, msg)
+}
+
+// dropIngestItem discards a message received while the server stops,
+// the task of a dropped result stays in flight, as if the sensor had not sent it
+func (w *wsServer) dropIngestItem(item ingestItem) {
+	ingestDropped.WithLabelValues(item.kind).Inc()
+	w.serverLogger.WithFields(log.Fields{
+		"connectionId": item.conn.ConnectionId.String(),
+		"sensorId":     item.conn.SensorId,
+		"kind":         item.kind,
+	}).Warn("Server stopping, the sensor message is dropped")
+}
+
+// ingestWorker stores the messages of its queue, the results and telemetry are flushed
+// together once ingestBatchSize are collected or every ingestFlushInterval
+func (w *wsServer) ingestWorker(queue chan ingestItem) {
+	defer w.ingest.workers.Done()
+
+	ticker := time.NewTicker(w.ingestFlushInterval())
+	defer ticker.Stop()
+
+	var pending []ingestItem
+	collect := func(item ingestItem) {
+		ingestQueueLength.Set(float64(w.ingest.queued()))
+		// a batch message carries its own items and gets its reply right away
+		if item.kind == ingestBatch {
+			w.ingestBatchMessage(item)
+			return
+		}
+		pending = append(pending, item)
+		if len(pending) >= w.ingestBatchSize() {
+			w.flushIngest(pending)
+			pending = nil
+		}
+	}
+
+	for {
+		select {
+		case item := <-queue:
+			collect(item)
+		case <-ticker.C:
+			if len(pending) > 0 {
+				w.flushIngest(pending)
+				pending = nil
+			}
+		case <-w.ingest.stopping:
+			for {
+				select {
+				case item := <-queue:
+					collect(item)
+				default:
+					if len(pending) > 0 {
+						w.flushIngest(pending)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// ingestedResult is a result of the flush, with the trace span ending once it is committed
+type ingestedResult struct {
+	item         ingestItem
+	ctx          context.Context
+	span         trace.Span
+	sensorResult sensor.TResult
+	preStored    any
+	liveEvent    LiveEvent
+	err          error
+}
+
+// ingestedTelemetry is a telemetry sample of the flush
+type ingestedTelemetry struct {
+	item      ingestItem
+	telemetry sensor.HostTelemetry
+}
+
+// flushIngest stores the results and the telemetry in a single transaction. The task status of each result
+// is updated behind a savepoint, the rows of all the messages are inserted with one statement per table.
+// The messages that fail, or all of them if the transaction fails, are stored again one by one,
+// with the retries and the dead letter stream of the single messages.
+func (w *wsServer) flushIngest(items []ingestItem) {
+	start := time.Now()
+	defer func() { ingestFlushDuration.Observe(time.Since(start).Seconds()) }()
+	ingestFlushSize.Observe(float64(len(items)))
+
+	var (
+		results   []*ingestedResult
+		telemetry []ingestedTelemetry
+	)
+	for _, item := range items {
+		switch item.kind {
+		case ingestResult:
+			var sensorResult sensor.TResult
+			if err := json.Unmarshal(item.msg, &sensorResult); err != nil {
+				w.logIngestError(item, fmt.Errorf("Unable to unmarshall message: %v", err))
+				continue
+			}
+			// the sensor echoes the trace context of the task, the result joins the dispatch trace
+			ctx, span := tracer.Start(extractTraceContext(context.Background(), item.msg), "flushIngest.result",
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(attribute.String("sensor.id", item.conn.SensorId.String())),
+			)
+			results = append(results, &ingestedResult{item: item, ctx: ctx, span: span, sensorResult: sensorResult})
+		case ingestTelemetry:
+			var hostTelemetry sensor.HostTelemetry
+			if err := json.Unmarshal(item.msg, &hostTelemetry); err != nil {
+				w.logIngestError(item, fmt.Errorf("Unmarshal HostTelemetry err:%v, msg:%v", err, string(item.msg)))
+				continue
+			}
+			telemetry = append(telemetry, ingestedTelemetry{item: item, telemetry: hostTelemetry})
+		}
+	}
+
+	// the blob store I/O is done before the transaction, a result failing here is stored again one by one
+	for _, res := range results {
+		res.preStored, res.err = w.preStoreResult(res.ctx, res.item.conn.SensorId, res.sensorResult, res.item.receivedAt)
+	}
+
+	var rows ingestRows
+	err := w.dbClient.Transaction(func(tx *gorm.DB) error {
+		for i, res := range results {
+			if res.err != nil {
+				continue
+			}
+			res.err = w.storeBatchItem(tx, fmt.Sprintf("ingest_result_%d", i), func() (err error) {
+				itemRows := ingestRows{pending: &rows}
+				res.liveEvent, err = w.processTaskResult(res.ctx, tx, &itemRows, res.item.conn.SensorId, res.sensorResult, res.preStored, res.item.receivedAt)
+				if err != nil {
+					return
+				}
+				rows.merge(&itemRows)
+				return
+			})
+		}
+		for _, tel := range telemetry {
+			rows.addTelemetry(tel.item.conn.SensorId, tel.telemetry, tel.item.receivedAt)
+		}
+		return rows.flush(tx)
+	})
+	if err != nil {
+		ingestFlushes.WithLabelValues("failed").Inc()
+		logger.LogError(err.Error(), "flushIngest, storing the messages one by one", w.serverLogger)
+		for _, res := range results {
+			endSpan(res.span, err)
+			// the rejections and duplicates were audited and counted outside of the transaction, they stay handled
+			if res.err != nil && resultHandled(res.err) {
+				continue
+			}
+			w.storeIngestItem(res.item)
+		}
+		for _, tel := range telemetry {
+			w.storeIngestItem(tel.item)
+		}
+		return
+	}
+	ingestFlushes.WithLabelValues("stored").Inc()
+	rows.committed()
+
+	for _, res := range results {
+		endSpan(res.span, res.err)
+		switch {
+		case res.err == nil:
+			w.publishLiveEvent(res.ctx, res.liveEvent)
+		case resultHandled(res.err):
+			// rejected or duplicate, logged where it was detected
+		default:
+			w.storeIngestItem(res.item)
+		}
+	}
+
+	// the presence and session are refreshed once per connection
+	refreshed := make(map[*sensorConnection]bool)
+	for _, tel := range telemetry {
+		w.publishLiveEvent(context.Background(), newTelemetryLiveEvent(tel.item.conn.SensorId, tel.telemetry, tel.item.receivedAt))
+		if refreshed[tel.item.conn] {
+			continue
+		}
+		refreshed[tel.item.conn] = true
+		if err := w.telemetryStored(context.Background(), tel.item.conn); err != nil {
+			w.logIngestError(tel.item, err)
+		}
+	}
+}
+
+// storeIngestItem stores a single message in its own transaction
+func (w *wsServer) storeIngestItem(item ingestItem) {
+	var err error
+	switch item.kind {
+	case ingestResult:
+		err = w.handleTaskResultMessage(item.conn.SensorId, item.msg, item.receivedAt)
+	case ingestTelemetry:
+		err = w.handleTelemtryMessage(item.conn, item.msg, item.receivedAt)
+	}
+	if err != nil {
+		w.logIngestError(item, err)
+	}
+}
+
+func (w *wsServer) ingestBatchMessage(item ingestItem) {
+	err := w.handleBatchMessage(item.conn, item.msg)
+	if err != nil {
+		w.logIngestError(item, err)
+	}
+}
+
+func (w *wsServer) logIngestError(item ingestItem, err error) {
+	w.serverLogger.WithFields(log.Fields{
+		"connectionId": item.conn.ConnectionId.String(),
+		"sensorId":     item.conn.SensorId,
+		"kind":         item.kind,
+	}).Error(fmt.Sprintf("ingest %v err: %v", item.kind, err))
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/ping-42/42lib/config/consts"
+)
+
+const (
+	// InstanceTaskChannelPrefix + instance id is the channel the tasks of the sensors held by the instance are routed to
+	InstanceTaskChannelPrefix = "SERVER_INSTANCE_TASK_CHANNEL_"
+	// redisInstanceKeyPrefix + instance id holds the serverInstance, it expires if the instance stops its heartbeat
+	redisInstanceKeyPrefix = "server_instance_"
+
+	instanceHeartbeatPeriod = 10 * time.Second
+	instanceHeartbeatTtl    = 3 * instanceHeartbeatPeriod
+)
+
+// Task routing modes
+const (
+	// TaskRoutingBroadcast has every instance receive every task and pass those of other instances
+	TaskRoutingBroadcast = "broadcast"
+	// TaskRoutingTargeted routes each task to the instance holding the sensor
+	TaskRoutingTargeted = "targeted"
+)
+
+// serverInstance is the registry entry of a running server instance
+type serverInstance struct {
+	InstanceId  string
+	StartedAt   time.Time
+	HeartbeatAt time.Time
+	TaskRouting string
+	TaskIntake  string
+	// Connections is the load of the instance
+	Connections int
+	// RouterLeader is set on the instance routing the scheduler tasks
+	RouterLeader bool
+}
+
+func instanceTaskChannel(instanceId string) string {
+	return InstanceTaskChannelPrefix + instanceId
+}
+
+// instanceHeartbeat keeps the registry entry of this instance alive
+func (w *wsServer) instanceHeartbeat() {
+	startedAt := time.Now().UTC()
+	for {
+		err := w.registerInstance(startedAt)
+		if err != nil {
+			w.serverLogger.Error(err.Error())
+		}
+		time.Sleep(instanceHeartbeatPeriod)
+	}
+}
+
+func (w *wsServer) registerInstance(startedAt time.Time) (err error) {
+	w.connLock.Lock()
+	connections := len(w.sensorConnections)
+	w.connLock.Unlock()
+
+	instance, err := json.Marshal(serverInstance{
+		InstanceId:   w.instanceId,
+		StartedAt:    startedAt,
+		HeartbeatAt:  time.Now().UTC(),
+		TaskRouting:  w.taskRouting(),
+		TaskIntake:   w.taskIntake(),
+		Connections:  connections,
+		RouterLeader: w.routerLeader.Load(),
+	})
+	if err != nil {
+		err = fmt.Errorf("marshal serverInstance err:%v", err)
+		return
+	}
+	err = w.redisClient.Set(redisInstanceKeyPrefix+w.instanceId, instance, instanceHeartbeatTtl).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("set_instance").Inc()
+		err = fmt.Errorf("failed to store the instance heartbeat in Redis:%v", err)
+	}
+	return
+}
+
+// deregisterInstance removes this instance from the registry on shutdown,
+// and hands over the router leadership without waiting for it to expire
+func (w *wsServer) deregisterInstance() {
+	err := w.redisClient.Del(redisInstanceKeyPrefix + w.instanceId).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("delete_instance").Inc()
+		w.serverLogger.Error("Error deleting the instance from Redis: ", err)
+	}
+	if w.routerLeader.Load() {
+		err = releaseLeaderScript.Run(w.redisClient, []string{redisRouterLeaderKey}, w.instanceId).Err()
+		if err != nil {
+			redisErrors.WithLabelValues("router_leader").Inc()
+			w.serverLogger.Error("Error releasing the router leadership: ", err)
+		}
+	}
+}
+
+// isInstanceAlive tells if the instance sent a heartbeat recently
+func (w *wsServer) isInstanceAlive(instanceId string) (alive bool, err error) {
+	n, err := w.redisClient.Exists(redisInstanceKeyPrefix + instanceId).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("get_instance").Inc()
+		err = fmt.Errorf("failed to load the instance from Redis:%v", err)
+		return
+	}
+	return n > 0, nil
+}
+
+// listInstances loads the registry entries of the running instances
+func (w *wsServer) listInstances() (instances []serverInstance, err error) {
+	var keys []string
+	iter := w.redisClient.Scan(0, redisInstanceKeyPrefix+"*", 100).Iterator()
+	for iter.Next() {
+		keys = append(keys, iter.Val())
+	}
+	if err = iter.Err(); err != nil {
+		redisErrors.WithLabelValues("scan_instances").Inc()
+		err = fmt.Errorf("failed to scan the instances in Redis:%v", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	vals, err := w.redisClient.MGet(keys...).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("get_instance").Inc()
+		err = fmt.Errorf("failed to load the instances from Redis:%v", err)
+		return
+	}
+	for i, val := range vals {
+		// the key expired between the scan and the get
+		str, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var instance serverInstance
+		if jsonErr := json.Unmarshal([]byte(str), &instance); jsonErr != nil {
+			w.serverLogger.Error(fmt.Sprintf("unmarshal instance %v err:%v", keys[i], jsonErr))
+			continue
+		}
+		instances = append(instances, instance)
+	}
+	return
+}
+
+// taskRouting returns the configured routing mode, broadcast by default
+func (w *wsServer) taskRouting() string {
+	if w.opts.TaskRouting == "" {
+		return TaskRoutingBroadcast
+	}
+	return w.opts.TaskRouting
+}
+
+// subscribeTaskChannel subscribes to the channel this instance receives its tasks on
+func subscribeTaskChannel(redisClient *redis.Client, taskRouting string, instanceId string) *redis.PubSub {
+	if taskRouting == TaskRoutingTargeted {
+		return redisClient.Subscribe(instanceTaskChannel(instanceId))
+	}
+	return redisClient.Subscribe(consts.SchedulerNewTaskChannel)
+}
@@ -0,0 +1,118 @@
+package ipinfo
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ip2asnRange is a line of an ip2asn file
+type ip2asnRange struct {
+	start netip.Addr
+	end   netip.Addr
+	info  Info
+}
+
+// Ip2Asn is an ip2asn dataset (https://iptoasn.com), with a range per line:
+// range_start, range_end, AS number, country code and AS description, tab separated
+type Ip2Asn struct {
+	// ranges are sorted by start, they do not overlap
+	ranges []ip2asnRange
+}
+
+// LoadIp2Asn reads the ip2asn file at path, gzipped if its name ends with .gz
+func LoadIp2Asn(path string) (*Ip2Asn, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return ReadIp2Asn(r)
+}
+
+// ReadIp2Asn parses an ip2asn dataset, the ranges not routed (AS 0) are skipped
+func ReadIp2Asn(r io.Reader) (*Ip2Asn, error) {
+	var (
+		db = &Ip2Asn{}
+		// the AS descriptions repeat on many lines, they are shared
+		orgs = make(map[string]string)
+	)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, "\t", 5)
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %v: expected 5 tab separated fields", line)
+		}
+		start, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		end, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid AS number %q", line, fields[2])
+		}
+		if asn == 0 {
+			continue
+		}
+
+		info := Info{Asn: uint32(asn)}
+		if country := fields[3]; country != "None" && country != "Unknown" {
+			info.Country = country
+		}
+		if len(fields) == 5 {
+			org, ok := orgs[fields[4]]
+			if !ok {
+				org = fields[4]
+				orgs[org] = org
+			}
+			info.AsOrg = org
+		}
+		db.ranges = append(db.ranges, ip2asnRange{start: start.Unmap(), end: end.Unmap(), info: info})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].start.Less(db.ranges[j].start) })
+	return db, nil
+}
+
+// Lookup finds the range of ip, the last one starting at or before it
+func (db *Ip2Asn) Lookup(ip net.IP) (Info, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return Info{}, false
+	}
+	addr = addr.Unmap()
+
+	i := sort.Search(len(db.ranges), func(i int) bool { return addr.Less(db.ranges[i].start) }) - 1
+	if i < 0 || db.ranges[i].end.Less(addr) {
+		return Info{}, false
+	}
+	return db.ranges[i].info, true
+}
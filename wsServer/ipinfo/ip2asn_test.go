@@ -0,0 +1,69 @@
+package ipinfo
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const ip2asnData = "# range_start\trange_end\tAS_number\tcountry_code\tAS_description\n" +
+	"10.0.1.0\t10.0.1.255\t64501\tFR\tExample Target\n" +
+	"10.0.0.0\t10.0.0.255\t64500\tDE\tExample Transit\n" +
+	"10.0.2.0\t10.0.2.255\t0\tNone\tNot routed\n" +
+	"10.0.3.0\t10.0.3.127\t64502\tNone\tExample Anycast\n" +
+	"\n" +
+	"2001:db8::\t2001:db8:ffff:ffff:ffff:ffff:ffff:ffff\t64503\tNL\tExample v6\n"
+
+func TestIp2AsnLookup(t *testing.T) {
+	db, err := ReadIp2Asn(strings.NewReader(ip2asnData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.ranges) != 4 {
+		t.Fatalf("ranges = %+v", db.ranges)
+	}
+
+	transit := Info{Asn: 64500, AsOrg: "Example Transit", Country: "DE"}
+	tests := []struct {
+		ip       string
+		expected Info
+		found    bool
+	}{
+		{"10.0.0.0", transit, true},
+		{"10.0.0.42", transit, true},
+		{"10.0.0.255", transit, true},
+		{"::ffff:10.0.0.42", transit, true},
+		{"10.0.1.1", Info{Asn: 64501, AsOrg: "Example Target", Country: "FR"}, true},
+		// the ranges not routed are skipped
+		{"10.0.2.1", Info{}, false},
+		{"10.0.3.1", Info{Asn: 64502, AsOrg: "Example Anycast"}, true},
+		{"10.0.3.128", Info{}, false},
+		{"9.255.255.255", Info{}, false},
+		{"2001:db8::1", Info{Asn: 64503, AsOrg: "Example v6", Country: "NL"}, true},
+		{"2001:db9::1", Info{}, false},
+	}
+	for _, test := range tests {
+		info, found := db.Lookup(net.ParseIP(test.ip))
+		if info != test.expected || found != test.found {
+			t.Errorf("Lookup(%v) = %+v %v, expected %+v %v", test.ip, info, found, test.expected, test.found)
+		}
+	}
+	if info, found := db.Lookup(nil); found {
+		t.Errorf("Lookup(nil) = %+v", info)
+	}
+}
+
+func TestReadIp2AsnInvalid(t *testing.T) {
+	tests := []string{
+		"10.0.0.0\t10.0.0.255\t64500\n",
+		"10.0.0\t10.0.0.255\t64500\tDE\tExample\n",
+		"10.0.0.0\tend\t64500\tDE\tExample\n",
+		"10.0.0.0\t10.0.0.255\tAS64500\tDE\tExample\n",
+		"10.0.0.0\t10.0.0.255\t4294967296\tDE\tExample\n",
+	}
+	for _, data := range tests {
+		if _, err := ReadIp2Asn(strings.NewReader(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package ipinfo looks up the ASN, AS organization and country of the IP addresses
+// in offline datasets: MaxMind DB files (GeoLite2 ASN and Country, IPinfo) and ip2asn TSV files.
+package ipinfo
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// Info is what the datasets know about an address, the zero values are unknown
+type Info struct {
+	Asn     uint32
+	AsOrg   string
+	Country string
+}
+
+// Source is a dataset
+type Source interface {
+	Lookup(ip net.IP) (Info, bool)
+}
+
+// Chain looks up the sources in order, each field is taken from the first source knowing it,
+// e.g. the ASN from an ASN database and the country from a country database
+type Chain []Source
+
+func (c Chain) Lookup(ip net.IP) (info Info, found bool) {
+	for _, source := range c {
+		sourceInfo, ok := source.Lookup(ip)
+		if !ok {
+			continue
+		}
+		found = true
+		if info.Asn == 0 {
+			info.Asn = sourceInfo.Asn
+			info.AsOrg = sourceInfo.AsOrg
+		}
+		if info.Country == "" {
+			info.Country = sourceInfo.Country
+		}
+		if info.Asn != 0 && info.Country != "" {
+			break
+		}
+	}
+	return
+}
+
+// Open loads the datasets, the .mmdb files as MaxMind DB and the others as ip2asn TSV, optionally gzipped
+func Open(paths []string) (Chain, error) {
+	chain := make(Chain, 0, len(paths))
+	for _, path := range paths {
+		var (
+			source Source
+			err    error
+		)
+		if strings.EqualFold(filepath.Ext(path), ".mmdb") {
+			source, err = OpenMmdb(path)
+		} else {
+			source, err = LoadIp2Asn(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loading the ip dataset %v: %v", path, err)
+		}
+		chain = append(chain, source)
+	}
+	return chain, nil
+}
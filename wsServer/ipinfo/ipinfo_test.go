@@ -0,0 +1,47 @@
+package ipinfo
+
+import (
+	"compress/gzip"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ip2asn-combined.tsv.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("10.0.0.0\t10.0.0.255\t64500\tNone\tExample Transit\n"))
+	gz.Close()
+	f.Close()
+
+	countries := filepath.Join(dir, "countries.tsv")
+	if err := os.WriteFile(countries, []byte("10.0.0.0\t10.0.255.255\t64510\tDE\tOther\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := Open([]string{path, countries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the country comes from the second file, the first one does not know it
+	expected := Info{Asn: 64500, AsOrg: "Example Transit", Country: "DE"}
+	if info, found := chain.Lookup(net.ParseIP("10.0.0.1")); !found || info != expected {
+		t.Errorf("Lookup = %+v %v, expected %+v", info, found, expected)
+	}
+	if info, found := chain.Lookup(net.ParseIP("10.0.1.1")); !found || info.Asn != 64510 {
+		t.Errorf("Lookup = %+v %v", info, found)
+	}
+	if info, found := chain.Lookup(net.ParseIP("10.1.0.1")); found {
+		t.Errorf("Lookup = %+v", info)
+	}
+
+	if _, err := Open([]string{filepath.Join(dir, "missing.tsv")}); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,69 @@
+package ipinfo
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Mmdb is a MaxMind DB file. The ASN is read from autonomous_system_number
+// and autonomous_system_organization (GeoLite2 ASN) or asn and as_name (IPinfo), the country
+// from country.iso_code (GeoLite2 Country and City) or country_code (IPinfo).
+type Mmdb struct {
+	reader *maxminddb.Reader
+}
+
+// mmdbRecord holds the fields of a network read by Mmdb
+type mmdbRecord struct {
+	AutonomousSystemNumber       uint32 `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+	Asn                          string `maxminddb:"asn"`
+	AsName                       string `maxminddb:"as_name"`
+	// Country is a map with iso_code in the MaxMind databases, and the name of the country in the IPinfo ones
+	Country     any    `maxminddb:"country"`
+	CountryCode string `maxminddb:"country_code"`
+}
+
+// OpenMmdb opens the MaxMind DB file at path
+func OpenMmdb(path string) (*Mmdb, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Mmdb{reader: reader}, nil
+}
+
+// NewMmdb reads a MaxMind DB file held in memory
+func NewMmdb(buf []byte) (*Mmdb, error) {
+	reader, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &Mmdb{reader: reader}, nil
+}
+
+func (db *Mmdb) Lookup(ip net.IP) (Info, bool) {
+	var record mmdbRecord
+	_, found, err := db.reader.LookupNetwork(ip, &record)
+	if err != nil || !found {
+		return Info{}, false
+	}
+
+	var info Info
+	if record.AutonomousSystemNumber != 0 {
+		info.Asn = record.AutonomousSystemNumber
+		info.AsOrg = record.AutonomousSystemOrganization
+	} else if record.Asn != "" {
+		number, _ := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(record.Asn), "AS"), 10, 32)
+		info.Asn = uint32(number)
+		info.AsOrg = record.AsName
+	}
+	if country, ok := record.Country.(map[string]any); ok {
+		info.Country, _ = country["iso_code"].(string)
+	} else if record.CountryCode != "" {
+		info.Country = record.CountryCode
+	}
+	return info, info.Asn != 0 || info.Country != ""
+}
@@ -0,0 +1,119 @@
+package ipinfo
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// writeMmdb returns a MaxMind DB file with the networks
+func writeMmdb(t *testing.T, ipVersion int, recordSize int, networks map[string]mmdbtype.Map) []byte {
+	t.Helper()
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType:            "ping42-test",
+		IPVersion:               ipVersion,
+		RecordSize:              recordSize,
+		IncludeReservedNetworks: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cidr, record := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := tree.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMmdbGeoLite(t *testing.T) {
+	for _, recordSize := range []int{24, 28, 32} {
+		buf := writeMmdb(t, 6, recordSize, map[string]mmdbtype.Map{
+			"10.0.0.0/8": {
+				"autonomous_system_number":       mmdbtype.Uint32(64500),
+				"autonomous_system_organization": mmdbtype.String("Example Transit"),
+			},
+			"2001:db8::/32": {
+				"autonomous_system_number": mmdbtype.Uint32(64501),
+				"country":                  mmdbtype.Map{"iso_code": mmdbtype.String("FR"), "geoname_id": mmdbtype.Uint32(3017382)},
+			},
+			"192.0.2.0/24": {
+				"country": mmdbtype.Map{"iso_code": mmdbtype.String("DE")},
+			},
+		})
+		db, err := NewMmdb(buf)
+		if err != nil {
+			t.Fatalf("record size %v: %v", recordSize, err)
+		}
+
+		tests := []struct {
+			ip       string
+			expected Info
+			found    bool
+		}{
+			// the IPv4 addresses are found in an IPv6 tree
+			{"10.1.2.3", Info{Asn: 64500, AsOrg: "Example Transit"}, true},
+			{"::ffff:10.1.2.3", Info{Asn: 64500, AsOrg: "Example Transit"}, true},
+			{"2001:db8::1", Info{Asn: 64501, Country: "FR"}, true},
+			{"192.0.2.1", Info{Country: "DE"}, true},
+			{"11.0.0.1", Info{}, false},
+			{"2001:db9::1", Info{}, false},
+		}
+		for _, test := range tests {
+			info, found := db.Lookup(net.ParseIP(test.ip))
+			if info != test.expected || found != test.found {
+				t.Errorf("record size %v: Lookup(%v) = %+v %v, expected %+v %v", recordSize, test.ip, info, found, test.expected, test.found)
+			}
+		}
+	}
+}
+
+func TestMmdbIpinfo(t *testing.T) {
+	buf := writeMmdb(t, 4, 24, map[string]mmdbtype.Map{
+		"198.51.100.0/24": {
+			"asn":          mmdbtype.String("AS64502"),
+			"as_name":      mmdbtype.String("Example Hosting"),
+			"country":      mmdbtype.String("Germany"),
+			"country_code": mmdbtype.String("DE"),
+		},
+	})
+	path := filepath.Join(t.TempDir(), "country_asn.mmdb")
+	if err := os.WriteFile(path, buf, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenMmdb(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Info{Asn: 64502, AsOrg: "Example Hosting", Country: "DE"}
+	if info, found := db.Lookup(net.ParseIP("198.51.100.7")); !found || info != expected {
+		t.Errorf("Lookup = %+v %v, expected %+v", info, found, expected)
+	}
+	// an IPv4 tree has no IPv6 address
+	if info, found := db.Lookup(net.ParseIP("2001:db8::1")); found {
+		t.Errorf("Lookup of an IPv6 address = %+v", info)
+	}
+}
+
+func TestMmdbInvalid(t *testing.T) {
+	if _, err := NewMmdb([]byte("not a MaxMind DB")); err == nil {
+		t.Error("expected an error")
+	}
+	if _, err := OpenMmdb(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("expected an error")
+	}
+}
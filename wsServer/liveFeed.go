@@ -0,0 +1,412 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	httpTask "github.com/ping-42/42lib/http"
+	"github.com/ping-42/42lib/logger"
+	"github.com/ping-42/42lib/sensor"
+)
+
+// LiveFeedChannel fans out the stored results and telemetry to every instance serving live feed subscribers
+const LiveFeedChannel = "SERVER_LIVE_FEED_CHANNEL"
+
+const (
+	// liveFeedBuffer is the events buffered per subscriber, events are dropped for slower subscribers
+	liveFeedBuffer = 256
+	// liveFeedHeartbeat keeps idle connections open through proxies
+	liveFeedHeartbeat = 15 * time.Second
+	// liveFeedListenersCheck is how long the number of instances with live feed subscribers is cached
+	liveFeedListenersCheck = time.Second
+	// liveFeedMaxPayload is the largest result payload sent to the live feed, a larger one is left out
+	liveFeedMaxPayload = 64 * 1024
+)
+
+// LiveEventKind tells if the event is a task result, a telemetry sample or a task timeout
+type LiveEventKind string
+
+const (
+	LiveEventResult    LiveEventKind = "result"
+	LiveEventTelemetry LiveEventKind = "telemetry"
+	// LiveEventTimeout is emitted when a task sent to a sensor times out
+	LiveEventTimeout LiveEventKind = "timeout"
+)
+
+// LiveEvent is sent to the live feed subscribers once a result or telemetry sample is stored
+type LiveEvent struct {
+	Kind           LiveEventKind
+	Time           time.Time
+	SensorId       uuid.UUID
+	TaskId         uuid.UUID
+	TaskName       sensor.TaskName `json:",omitempty"`
+	SubscriptionId uint64          `json:",omitempty"`
+	Error          string          `json:",omitempty"`
+	Payload        json.RawMessage `json:",omitempty"`
+}
+
+func newResultLiveEvent(sensorId uuid.UUID, subscriptionId uint64, sensorResult sensor.TResult, measuredAt time.Time) LiveEvent {
+	ev := LiveEvent{
+		Kind:           LiveEventResult,
+		Time:           measuredAt,
+		SensorId:       sensorId,
+		TaskId:         sensorResult.TaskId,
+		TaskName:       sensorResult.TaskName,
+		SubscriptionId: subscriptionId,
+		Error:          sensorResult.Error,
+	}
+	if json.Valid(sensorResult.Result) {
+		ev.Payload = liveResultPayload(sensorResult.TaskName, sensorResult.Result)
+	}
+	return ev
+}
+
+// liveResultPayload leaves the http body out of the result, it is kept as the body policy of the subscription says.
+// A payload larger than liveFeedMaxPayload is left out.
+func liveResultPayload(taskName sensor.TaskName, result json.RawMessage) json.RawMessage {
+	if taskName == httpTask.TaskName {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(result, &fields); err != nil {
+			return nil
+		}
+		delete(fields, "ResponseBody")
+		stripped, err := json.Marshal(fields)
+		if err != nil {
+			return nil
+		}
+		result = stripped
+	}
+	if len(result) > liveFeedMaxPayload {
+		return nil
+	}
+	return result
+}
+
+func newTelemetryLiveEvent(sensorId uuid.UUID, hostTelemetry sensor.HostTelemetry, measuredAt time.Time) LiveEvent {
+	ev := LiveEvent{
+		Kind:     LiveEventTelemetry,
+		Time:     measuredAt,
+		SensorId: sensorId,
+	}
+	payload, err := json.Marshal(hostTelemetry)
+	if err == nil {
+		ev.Payload = payload
+	}
+	return ev
+}
+
+// liveFilter selects the events a subscriber is interested in, empty fields match everything
+type liveFilter struct {
+	sensorIds      map[uuid.UUID]bool
+	subscriptionId uint64
+	taskNames      map[sensor.TaskName]bool
+	kind           LiveEventKind
+	// scope are the subscriptions the token of the subscriber may follow, all of them when nil
+	scope map[uint64]bool
+}
+
+func (f liveFilter) match(ev LiveEvent) bool {
+	if f.scope != nil && !f.scope[ev.SubscriptionId] {
+		return false
+	}
+	if len(f.sensorIds) > 0 && !f.sensorIds[ev.SensorId] {
+		return false
+	}
+	if f.kind != "" && f.kind != ev.Kind {
+		return false
+	}
+	if f.subscriptionId != 0 && f.subscriptionId != ev.SubscriptionId {
+		return false
+	}
+	if len(f.taskNames) > 0 && !f.taskNames[ev.TaskName] {
+		return false
+	}
+	return true
+}
+
+// parseLiveFilter reads the filter from the query: sensorId and taskType may repeat,
+// subscriptionId and kind (result, telemetry or timeout) are single values
+func parseLiveFilter(r *http.Request) (f liveFilter, err error) {
+	q := r.URL.Query()
+
+	f.sensorIds = make(map[uuid.UUID]bool)
+	for _, s := range q["sensorId"] {
+		sensorId, parseErr := uuid.Parse(s)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid sensorId: %v", parseErr)
+			return
+		}
+		f.sensorIds[sensorId] = true
+	}
+
+	f.taskNames = make(map[sensor.TaskName]bool)
+	for _, t := range q["taskType"] {
+		f.taskNames[sensor.TaskName(t)] = true
+	}
+
+	if s := q.Get("subscriptionId"); s != "" {
+		f.subscriptionId, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("invalid subscriptionId: %v", err)
+			return
+		}
+	}
+
+	switch kind := LiveEventKind(q.Get("kind")); kind {
+	case "", LiveEventResult, LiveEventTelemetry, LiveEventTimeout:
+		f.kind = kind
+	default:
+		err = fmt.Errorf("invalid kind: %q", kind)
+		return
+	}
+	return
+}
+
+type liveSubscriber struct {
+	filter liveFilter
+	events chan LiveEvent
+}
+
+// liveFeed holds the live feed subscribers connected to this instance. The instance listens to
+// LiveFeedChannel only while it has subscribers, so the events are published only when someone follows them.
+type liveFeed struct {
+	sync.Mutex
+	subscribers map[*liveSubscriber]struct{}
+	// pubsub is the connection of liveFeedListener, subscribed to LiveFeedChannel while there are subscribers
+	pubsub *redis.PubSub
+
+	// listened caches whether any instance has subscribers, checked at listenedAt
+	listenedLock sync.Mutex
+	listened     bool
+	listenedAt   time.Time
+}
+
+func (f *liveFeed) add(filter liveFilter) (*liveSubscriber, error) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.subscribers) == 0 && f.pubsub != nil {
+		if err := f.pubsub.Subscribe(LiveFeedChannel); err != nil {
+			redisErrors.WithLabelValues("subscribe_live_feed").Inc()
+			return nil, fmt.Errorf("failed to subscribe to the live feed:%v", err)
+		}
+	}
+	if f.subscribers == nil {
+		f.subscribers = make(map[*liveSubscriber]struct{})
+	}
+	sub := &liveSubscriber{filter: filter, events: make(chan LiveEvent, liveFeedBuffer)}
+	f.subscribers[sub] = struct{}{}
+	liveFeedSubscribers.Inc()
+	return sub, nil
+}
+
+func (f *liveFeed) remove(sub *liveSubscriber) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.subscribers, sub)
+	liveFeedSubscribers.Dec()
+	if len(f.subscribers) == 0 && f.pubsub != nil {
+		if err := f.pubsub.Unsubscribe(LiveFeedChannel); err != nil {
+			redisErrors.WithLabelValues("unsubscribe_live_feed").Inc()
+		}
+	}
+}
+
+// listen sets the connection of the listener, subscribed right away if there are subscribers already
+func (f *liveFeed) listen(pubsub *redis.PubSub) error {
+	f.Lock()
+	defer f.Unlock()
+	f.pubsub = pubsub
+	if len(f.subscribers) == 0 {
+		return nil
+	}
+	return pubsub.Subscribe(LiveFeedChannel)
+}
+
+// broadcast passes the event to the matching subscribers without blocking
+func (f *liveFeed) broadcast(ev LiveEvent) {
+	f.Lock()
+	defer f.Unlock()
+	for sub := range f.subscribers {
+		if !sub.filter.match(ev) {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+			liveFeedDroppedEvents.Inc()
+		}
+	}
+}
+
+// liveFeedListened tells if an instance has live feed subscribers, the answer is cached for liveFeedListenersCheck.
+// When Redis can not tell, the events are published.
+func (w *wsServer) liveFeedListened() bool {
+	f := &w.liveFeed
+	f.listenedLock.Lock()
+	defer f.listenedLock.Unlock()
+	if time.Since(f.listenedAt) < liveFeedListenersCheck {
+		return f.listened
+	}
+
+	listeners, err := w.redisClient.PubSubNumSub(LiveFeedChannel).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("live_feed_listeners").Inc()
+		return true
+	}
+	f.listened = listeners[LiveFeedChannel] > 0
+	f.listenedAt = time.Now()
+	return f.listened
+}
+
+// publishLiveEvent fans out the event to all instances, failures are logged only,
+// since the event is already stored. Nothing is published when no instance has subscribers.
+func (w *wsServer) publishLiveEvent(ctx context.Context, ev LiveEvent) {
+	if !w.liveFeedListened() {
+		return
+	}
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		logger.LogError(err.Error(), "marshal LiveEvent", w.serverLogger)
+		return
+	}
+	_, span := startRedisSpan(ctx, "publish")
+	err = w.redisClient.Publish(LiveFeedChannel, msg).Err()
+	endSpan(span, err)
+	if err != nil {
+		redisErrors.WithLabelValues("publish_live_event").Inc()
+		logger.LogError(err.Error(), "publish LiveEvent", w.serverLogger)
+	}
+}
+
+// liveFeedListener passes the events published by all instances to the local subscribers
+func (w *wsServer) liveFeedListener() {
+	pubsub := w.redisClient.Subscribe()
+	defer pubsub.Close()
+	if err := w.liveFeed.listen(pubsub); err != nil {
+		redisErrors.WithLabelValues("subscribe_live_feed").Inc()
+		logger.LogError(err.Error(), "liveFeedListener, error subscribing", w.serverLogger)
+	}
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			redisErrors.WithLabelValues("pubsub_receive").Inc()
+			logger.LogError(err.Error(), "liveFeedListener, error receiving message", w.serverLogger)
+			continue
+		}
+
+		var ev LiveEvent
+		err = json.Unmarshal([]byte(msg.Payload), &ev)
+		if err != nil {
+			logger.LogError(err.Error(), "liveFeedListener, error unmarshal message", w.serverLogger)
+			continue
+		}
+		w.liveFeed.broadcast(ev)
+	}
+}
+
+// liveFeedScope checks the bearer token of the request: LiveFeedToken follows every subscription,
+// a subscription token only its subscriptions. ok is false for an unknown token.
+func (w *wsServer) liveFeedScope(r *http.Request) (scope map[uint64]bool, ok bool) {
+	authorization := []byte(r.Header.Get("Authorization"))
+	if w.opts.LiveFeedToken != "" && subtle.ConstantTimeCompare(authorization, []byte("Bearer "+w.opts.LiveFeedToken)) == 1 {
+		return nil, true
+	}
+	for token, subscriptions := range w.liveFeedScopes {
+		if subtle.ConstantTimeCompare(authorization, []byte("Bearer "+token)) == 1 {
+			return subscriptions, true
+		}
+	}
+	return nil, false
+}
+
+// parseLiveFeedTokens reads the subscription tokens, by subscription id, into the subscriptions of each token
+func parseLiveFeedTokens(tokens map[string]string) (map[string]map[uint64]bool, error) {
+	scopes := make(map[string]map[uint64]bool)
+	for s, token := range tokens {
+		subscriptionId, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || subscriptionId == 0 {
+			return nil, fmt.Errorf("invalid subscription id %q of a live feed token", s)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("empty live feed token of subscription %v", subscriptionId)
+		}
+		if scopes[token] == nil {
+			scopes[token] = make(map[uint64]bool)
+		}
+		scopes[token][subscriptionId] = true
+	}
+	return scopes, nil
+}
+
+// handleLiveFeed streams the matching events to the client as server-sent events
+func (w *wsServer) handleLiveFeed(wr http.ResponseWriter, r *http.Request) {
+	scope, ok := w.liveFeedScope(r)
+	if !ok {
+		writeApiError(wr, http.StatusUnauthorized, fmt.Errorf("invalid live feed token"))
+		return
+	}
+
+	filter, err := parseLiveFilter(r)
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, err)
+		return
+	}
+	if scope != nil && filter.subscriptionId != 0 && !scope[filter.subscriptionId] {
+		writeApiError(wr, http.StatusForbidden, fmt.Errorf("subscription %v is not allowed by the live feed token", filter.subscriptionId))
+		return
+	}
+	filter.scope = scope
+
+	flusher, ok := wr.(http.Flusher)
+	if !ok {
+		writeApiError(wr, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	sub, err := w.liveFeed.add(filter)
+	if err != nil {
+		writeApiError(wr, http.StatusBadGateway, err)
+		return
+	}
+	defer w.liveFeed.remove(sub)
+
+	wr.Header().Set("Content-Type", "text/event-stream")
+	wr.Header().Set("Cache-Control", "no-cache")
+	wr.Header().Set("Connection", "keep-alive")
+	wr.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(liveFeedHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(wr, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev := <-sub.events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				logger.LogError(err.Error(), "marshal LiveEvent", w.serverLogger)
+				continue
+			}
+			if _, err := fmt.Fprintf(wr, "event: %s\ndata: %s\n\n", ev.Kind, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
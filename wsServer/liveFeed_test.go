@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	httpTask "github.com/ping-42/42lib/http"
+	"github.com/ping-42/42lib/icmp"
+	"github.com/ping-42/42lib/sensor"
+)
+
+func TestLiveResultPayload(t *testing.T) {
+	result := json.RawMessage(`{"ResponseCode":200,"ResponseBody":"<html>secret</html>","DNSLookup":3}`)
+	payload := liveResultPayload(httpTask.TaskName, result)
+	if strings.Contains(string(payload), "secret") || !strings.Contains(string(payload), `"ResponseCode":200`) {
+		t.Errorf("http payload = %s", payload)
+	}
+
+	icmpResult := json.RawMessage(`{"PacketsSent":4}`)
+	if payload := liveResultPayload(icmp.TaskName, icmpResult); string(payload) != string(icmpResult) {
+		t.Errorf("icmp payload = %s", payload)
+	}
+
+	large := json.RawMessage(`{"Data":"` + strings.Repeat("x", liveFeedMaxPayload) + `"}`)
+	if payload := liveResultPayload(icmp.TaskName, large); payload != nil {
+		t.Errorf("large payload of %v bytes kept", len(payload))
+	}
+}
+
+func TestLiveFeedScope(t *testing.T) {
+	scopes, err := parseLiveFeedTokens(map[string]string{"7": "customer-a", "8": "customer-a", "9": "customer-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &wsServer{opts: Options{LiveFeedToken: "operator"}, liveFeedScopes: scopes}
+	request := func(token string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "/live", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	if scope, ok := w.liveFeedScope(request("operator")); !ok || scope != nil {
+		t.Errorf("operator scope = %v %v", scope, ok)
+	}
+	if _, ok := w.liveFeedScope(request("unknown")); ok {
+		t.Error("unknown token accepted")
+	}
+	scope, ok := w.liveFeedScope(request("customer-a"))
+	if !ok || len(scope) != 2 || !scope[7] || !scope[8] {
+		t.Fatalf("customer-a scope = %v %v", scope, ok)
+	}
+
+	filter := liveFilter{scope: scope}
+	tests := []struct {
+		ev       LiveEvent
+		expected bool
+	}{
+		{LiveEvent{Kind: LiveEventResult, SubscriptionId: 7, TaskName: sensor.TaskName("ICMP_TASK")}, true},
+		{LiveEvent{Kind: LiveEventTimeout, SubscriptionId: 8}, true},
+		{LiveEvent{Kind: LiveEventResult, SubscriptionId: 9}, false},
+		// the telemetry belongs to no subscription
+		{LiveEvent{Kind: LiveEventTelemetry, SensorId: uuid.New()}, false},
+	}
+	for _, test := range tests {
+		if filter.match(test.ev) != test.expected {
+			t.Errorf("match(%+v) = %v", test.ev, !test.expected)
+		}
+	}
+
+	for _, tokens := range []map[string]string{{"abc": "token"}, {"0": "token"}, {"7": ""}} {
+		if _, err := parseLiveFeedTokens(tokens); err == nil {
+			t.Errorf("%v: expected an error", tokens)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ping-42/42lib/sensor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "ping42_server"
+
+// Prometheus metrics exposed on /metrics
+var (
+	connectedSensors = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connected_sensors",
+		Help:      "Sensors currently connected to this instance, by sensor version (other past the first known versions).",
+	}, []string{"version"})
+
+	sensorConnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sensor_connects_total",
+		Help:      "Sensor connections accepted.",
+	})
+
+	sensorDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sensor_disconnects_total",
+		Help:      "Sensor disconnections, by reason.",
+	}, []string{"reason"})
+
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Rejected sensor connections, by reason.",
+	}, []string{"reason"})
+
+	inboundMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "inbound_messages_total",
+		Help:      "Messages received from sensors, by message type.",
+	}, []string{"type"})
+
+	dispatchedTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dispatched_tasks_total",
+		Help:      "Tasks sent to sensors, by task type.",
+	}, []string{"task_type"})
+
+	taskStateTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_state_transitions_total",
+		Help:      "Task status changes made by the server, by the new status.",
+	}, []string{"status"})
+
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "store_duration_seconds",
+		Help:      "Time spent storing a result or telemetry sample, by task type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"task_type"})
+
+	dbErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_errors_total",
+		Help:      "Postgres errors, by operation.",
+	}, []string{"operation"})
+
+	redisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_errors_total",
+		Help:      "Redis errors, by operation.",
+	}, []string{"operation"})
+
+	liveFeedSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "live_feed_subscribers",
+		Help:      "Live feed subscribers connected to this instance.",
+	})
+
+	liveFeedDroppedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "live_feed_dropped_events_total",
+		Help:      "Live feed events dropped because the subscriber was too slow.",
+	})
+
+	pubsubReceiveLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "pubsub_receive_lag_seconds",
+		Help:      "Time from the task creation by the scheduler until the server received it.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	credentialCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "credential_cache_lookups_total",
+		Help:      "Sensor credential lookups, by result (hit or miss).",
+	}, []string{"result"})
+
+	routedTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "routed_tasks_total",
+		Help:      "Scheduler tasks handled by the task router, by outcome.",
+	}, []string{"outcome"})
+
+	streamTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_tasks_total",
+		Help:      "Task stream entries handled in streams intake, by outcome.",
+	}, []string{"outcome"})
+
+	pendingTasks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_tasks_total",
+		Help:      "Tasks queued for offline sensors, by outcome (queued, delivered or expired).",
+	}, []string{"outcome"})
+
+	pendingTaskWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_task_wait_seconds",
+		Help:      "Time the delivered tasks waited for their sensor to reconnect.",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	})
+
+	taskTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_timeouts_total",
+		Help:      "Tasks timed out by the watchdog, by task type and reason (deadline or sensor_disconnected).",
+	}, []string{"task_type", "reason"})
+
+	taskAnswerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_answer_duration_seconds",
+		Help:      "Time from sending the task to the sensor until its result was received, by task type.",
+		Buckets:   []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"task_type"})
+
+	taskTransitionsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_transitions_rejected_total",
+		Help:      "Task state transitions rejected because of the current state, by target state.",
+	}, []string{"state"})
+
+	resultStoreRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "result_store_retries_total",
+		Help:      "Result transactions retried after a failure.",
+	})
+
+	resultDeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "result_dead_letters_total",
+		Help:      "Results moved to the dead letter stream, by reason.",
+	}, []string{"reason"})
+
+	ingestQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ingest_queue_length",
+		Help:      "Sensor messages waiting in the ingest queue.",
+	})
+
+	ingestQueueFull = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ingest_queue_full_total",
+		Help:      "Sensor messages that waited for room in the full ingest queue.",
+	})
+
+	ingestDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ingest_dropped_total",
+		Help:      "Sensor messages dropped because the server was stopping, by kind.",
+	}, []string{"kind"})
+
+	ingestFlushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ingest_flushes_total",
+		Help:      "Ingest flushes, by outcome.",
+	}, []string{"outcome"})
+
+	ingestFlushSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ingest_flush_size",
+		Help:      "Sensor messages stored by an ingest flush.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	ingestFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ingest_flush_duration_seconds",
+		Help:      "Time spent by an ingest flush.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	auditEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_events_total",
+		Help:      "Audit events recorded, by event.",
+	}, []string{"event"})
+)
+
+// telemetryMetricLabel is the task_type label of the telemetry store metrics
+const telemetryMetricLabel = "TELEMETRY"
+
+// Sensor disconnect reasons
+const (
+	disconnectEOF       = "eof"
+	disconnectReadError = "read_error"
+	disconnectByServer  = "closed_by_server"
+)
+
+// Task router outcomes
+const (
+	routeRouted        = "routed"
+	routeSensorOffline = "sensor_offline"
+	routeInstanceDown  = "instance_down"
+)
+
+// Task stream outcomes
+const (
+	streamTaskAcked        = "acked"
+	streamTaskRetry        = "retry"
+	streamTaskReclaimed    = "reclaimed"
+	streamTaskDeadLettered = "dead_lettered"
+)
+
+// Pending task outcomes
+const (
+	pendingQueued    = "queued"
+	pendingDelivered = "delivered"
+	pendingExpired   = "expired"
+)
+
+// Values of the version label of connected_sensors, for the versions not tracked
+const (
+	sensorVersionUnknown = "unknown"
+	sensorVersionOther   = "other"
+)
+
+// maxSensorVersions bounds the versions with their own label value in connected_sensors
+const maxSensorVersions = 20
+
+var (
+	sensorVersionPattern = regexp.MustCompile(`^v?[0-9]{1,4}\.[0-9]{1,4}\.[0-9]{1,4}$`)
+
+	sensorVersionsLock sync.Mutex
+	// sensorVersions are the versions with their own label value, the first seen
+	sensorVersions = make(map[string]struct{}, maxSensorVersions)
+)
+
+// Auth failure reasons
+const (
+	authMissingToken  = "missing_token"
+	authInvalidToken  = "invalid_token"
+	authReplayedToken = "replayed_token"
+	authPolicyDenied  = "policy_denied"
+)
+
+// sensorVersionLabel maps the version sent by a sensor to a bounded set of label values:
+// the first maxSensorVersions release versions (e.g. v1.2.3) seen, other for the rest
+func sensorVersionLabel(version string) string {
+	if version == "" {
+		return sensorVersionUnknown
+	}
+	if !sensorVersionPattern.MatchString(version) {
+		return sensorVersionOther
+	}
+
+	sensorVersionsLock.Lock()
+	defer sensorVersionsLock.Unlock()
+	if _, ok := sensorVersions[version]; ok {
+		return version
+	}
+	if len(sensorVersions) >= maxSensorVersions {
+		return sensorVersionOther
+	}
+	sensorVersions[version] = struct{}{}
+	return version
+}
+
+func observeTaskStatus(state TaskState) {
+	taskStateTransitions.WithLabelValues(state.String()).Inc()
+}
+
+// observeStoreDuration is deferred by the store handlers with the time they started
+func observeStoreDuration(taskType string, start time.Time) {
+	storeDuration.WithLabelValues(taskType).Observe(time.Since(start).Seconds())
+}
+
+// resultTaskTypeLabel is the task name of a result if a handler is registered for it, otherwise "unknown",
+// the name comes from the sensor and must not create new series
+func (w *wsServer) resultTaskTypeLabel(taskName sensor.TaskName) string {
+	if _, ok := w.resultHandlers.Lookup(taskName); !ok {
+		return "unknown"
+	}
+	return string(taskName)
+}
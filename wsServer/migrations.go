@@ -0,0 +1,301 @@
+package server
+
+import (
+	"github.com/go-gormigrate/gormigrate/v2"
+	"github.com/ping-42/server/wsServer/results"
+	"gorm.io/gorm"
+)
+
+// Migrate creates the tables owned by the server, on top of the 42lib schema.
+// They are tracked in their own table, so the ids never clash with the 42lib ones.
+func Migrate(db *gorm.DB) error {
+	migrations := []*gormigrate.Migration{
+		{
+			ID: "sensor-sessions",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(&SensorSession{})
+				if err != nil {
+					return err
+				}
+
+				// indices
+				return tx.Exec(`
+                    CREATE INDEX idx_sensor_sessions_sensor_connected ON sensor_sessions (sensor_id, connected_at DESC);
+                    CREATE INDEX idx_sensor_sessions_open_instance   ON sensor_sessions (instance_id) WHERE disconnected_at IS NULL;
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&SensorSession{})
+			},
+		},
+
+		{
+			ID: "sensor-public-keys",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(&SensorPublicKey{})
+				if err != nil {
+					return err
+				}
+
+				// indices
+				return tx.Exec(`
+                    CREATE INDEX idx_sensor_public_keys_sensor_id ON sensor_public_keys (sensor_id);
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&SensorPublicKey{})
+			},
+		},
+
+		{
+			ID: "sensor-policies-and-audit-events",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(
+					&SensorPolicy{},
+					&AuditEvent{},
+				)
+				if err != nil {
+					return err
+				}
+
+				// indices
+				return tx.Exec(`
+                    CREATE INDEX idx_audit_events_sensor_time ON audit_events (sensor_id, time DESC);
+                    CREATE INDEX idx_audit_events_time        ON audit_events (time DESC);
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&AuditEvent{}, &SensorPolicy{})
+			},
+		},
+
+		{
+			ID: "task-status-expired",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.Exec(`
+                    INSERT INTO lv_task_statuses(id, status) VALUES (10, 'EXPIRED');
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Exec(`DELETE FROM lv_task_statuses WHERE id = 10;`).Error
+			},
+		},
+
+		{
+			ID: "task-status-timed-out",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.Exec(`
+                    INSERT INTO lv_task_statuses(id, status) VALUES (11, 'TIMED_OUT');
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Exec(`DELETE FROM lv_task_statuses WHERE id = 11;`).Error
+			},
+		},
+
+		{
+			ID: "task-transitions",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(&TaskTransition{})
+				if err != nil {
+					return err
+				}
+
+				// indices
+				return tx.Exec(`
+                    CREATE INDEX idx_task_transitions_task_time ON task_transitions (task_id, time);
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&TaskTransition{})
+			},
+		},
+
+		{
+			ID: "sensor-reputations",
+			Migrate: func(tx *gorm.DB) error {
+				return tx.Migrator().CreateTable(&SensorReputation{})
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&SensorReputation{})
+			},
+		},
+
+		{
+			ID: "tls-results",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(
+					&results.TsTlsResult{},
+					&results.TsTlsCertificate{},
+				)
+				if err != nil {
+					return err
+				}
+
+				// hypertables for timeseries data
+				err = tx.Exec(`
+                    SELECT create_hypertable('ts_tls_results', by_range('time'));
+                    SELECT create_hypertable('ts_tls_certificates', by_range('time'));`).Error
+				if err != nil {
+					return err
+				}
+
+				// indices
+				err = tx.Exec(`
+                    CREATE INDEX idx_tls_results_sensor_time      ON ts_tls_results (sensor_id, time DESC);
+                    CREATE INDEX idx_tls_results_target_time      ON ts_tls_results (host, port, time DESC);
+                    CREATE INDEX idx_tls_certificates_task        ON ts_tls_certificates (task_id);
+                    CREATE INDEX idx_tls_certificates_leaf_expiry ON ts_tls_certificates (not_after, host, port) WHERE position = 0;
+					`).Error
+				if err != nil {
+					return err
+				}
+
+				// lookup values
+				return tx.Exec(`
+                    INSERT INTO lv_task_types(id, type) VALUES (5, 'TLS_TASK');
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				err := tx.Exec(`DELETE FROM lv_task_types WHERE id = 5;`).Error
+				if err != nil {
+					return err
+				}
+				return tx.Migrator().DropTable(&results.TsTlsCertificate{}, &results.TsTlsResult{})
+			},
+		},
+
+		{
+			ID: "tcp-results",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(&results.TsTcpResult{})
+				if err != nil {
+					return err
+				}
+
+				// hypertables for timeseries data
+				err = tx.Exec(`
+                    SELECT create_hypertable('ts_tcp_results', by_range('time'));`).Error
+				if err != nil {
+					return err
+				}
+
+				// indices
+				err = tx.Exec(`
+                    CREATE INDEX idx_tcp_results_sensor_time ON ts_tcp_results (sensor_id, time DESC);
+                    CREATE INDEX idx_tcp_results_sensor_id   ON ts_tcp_results (sensor_id);
+                    CREATE INDEX idx_tcp_results_target_time ON ts_tcp_results (host, port, time DESC);
+                    CREATE INDEX idx_tcp_results_task        ON ts_tcp_results (task_id);
+					`).Error
+				if err != nil {
+					return err
+				}
+
+				// lookup values
+				return tx.Exec(`
+                    INSERT INTO lv_task_types(id, type) VALUES (6, 'TCP_TASK');
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				err := tx.Exec(`DELETE FROM lv_task_types WHERE id = 6;`).Error
+				if err != nil {
+					return err
+				}
+				return tx.Migrator().DropTable(&results.TsTcpResult{})
+			},
+		},
+
+		{
+			ID: "dns-records",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(&results.TsDnsResponse{}, &results.TsDnsRecord{})
+				if err != nil {
+					return err
+				}
+
+				// hypertables for timeseries data
+				err = tx.Exec(`
+                    SELECT create_hypertable('ts_dns_responses', by_range('time'));
+                    SELECT create_hypertable('ts_dns_records', by_range('time'));`).Error
+				if err != nil {
+					return err
+				}
+
+				// indices
+				return tx.Exec(`
+                    CREATE INDEX idx_dns_responses_sensor_time ON ts_dns_responses (sensor_id, time DESC);
+                    CREATE INDEX idx_dns_responses_task        ON ts_dns_responses (task_id);
+                    CREATE INDEX idx_dns_records_sensor_time   ON ts_dns_records (sensor_id, time DESC);
+                    CREATE INDEX idx_dns_records_task          ON ts_dns_records (task_id);
+                    CREATE INDEX idx_dns_records_name_type     ON ts_dns_records (name, type, time DESC);
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&results.TsDnsRecord{}, &results.TsDnsResponse{})
+			},
+		},
+
+		{
+			ID: "http-bodies",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(&results.HttpBodyPolicy{}, &results.TsHttpBody{})
+				if err != nil {
+					return err
+				}
+
+				// hypertables for timeseries data
+				err = tx.Exec(`
+                    SELECT create_hypertable('ts_http_bodies', by_range('time'));`).Error
+				if err != nil {
+					return err
+				}
+
+				// indices, the previous check of a target by a sensor is looked up for each result
+				return tx.Exec(`
+                    CREATE INDEX idx_http_bodies_target_sensor_time ON ts_http_bodies (url, sensor_id, time DESC);
+                    CREATE INDEX idx_http_bodies_sensor_time        ON ts_http_bodies (sensor_id, time DESC);
+                    CREATE INDEX idx_http_bodies_task               ON ts_http_bodies (task_id);
+                    CREATE INDEX idx_http_bodies_changed            ON ts_http_bodies (subscription_id, time DESC) WHERE content_changed;
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&results.TsHttpBody{}, &results.HttpBodyPolicy{})
+			},
+		},
+
+		{
+			ID: "traceroute-paths",
+			Migrate: func(tx *gorm.DB) error {
+				err := tx.Migrator().CreateTable(&results.TsTracerouteHopInfo{}, &results.TsTraceroutePath{}, &results.TsTraceroutePathChange{})
+				if err != nil {
+					return err
+				}
+
+				// hypertables for timeseries data
+				err = tx.Exec(`
+                    SELECT create_hypertable('ts_traceroute_hop_infos', by_range('time'));
+                    SELECT create_hypertable('ts_traceroute_paths', by_range('time'));
+                    SELECT create_hypertable('ts_traceroute_path_changes', by_range('time'));`).Error
+				if err != nil {
+					return err
+				}
+
+				// indices, the previous path of a sensor to a target is looked up for each result
+				return tx.Exec(`
+                    CREATE INDEX idx_traceroute_hop_infos_task          ON ts_traceroute_hop_infos (task_id);
+                    CREATE INDEX idx_traceroute_hop_infos_asn_time      ON ts_traceroute_hop_infos (asn, time DESC);
+                    CREATE INDEX idx_traceroute_paths_sensor_target     ON ts_traceroute_paths (sensor_id, target, time DESC);
+                    CREATE INDEX idx_traceroute_path_changes_sensor     ON ts_traceroute_path_changes (sensor_id, time DESC);
+                    CREATE INDEX idx_traceroute_path_changes_target     ON ts_traceroute_path_changes (target, time DESC);
+					`).Error
+			},
+			Rollback: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&results.TsTraceroutePathChange{}, &results.TsTraceroutePath{}, &results.TsTracerouteHopInfo{})
+			},
+		},
+	}
+
+	options := *gormigrate.DefaultOptions
+	options.TableName = "server_migrations"
+	return gormigrate.New(db, &options, migrations).Migrate()
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/logger"
+	"github.com/ping-42/42lib/sensor"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// redisPendingQueueKeyPrefix + sensor id orders the queued task ids by queue time
+	redisPendingQueueKeyPrefix = "server_pending_queue_"
+	// redisPendingTasksKeyPrefix + sensor id holds the queued pendingTask by task id
+	redisPendingTasksKeyPrefix = "server_pending_tasks_"
+	// redisPendingDeadlinesKey orders all the queued tasks, as sensor id:task id, by deadline
+	redisPendingDeadlinesKey = "server_pending_deadlines"
+
+	pendingExpiryPeriod = 30 * time.Second
+	pendingExpiryBatch  = 100
+	// pendingKeysSlack keeps the queue keys a while after the last deadline, the expiry removes the entries before
+	pendingKeysSlack = time.Hour
+)
+
+// pendingTask is a task queued until its sensor reconnects
+type pendingTask struct {
+	TaskId   uuid.UUID
+	SensorId uuid.UUID
+	Payload  string
+	QueuedAt time.Time
+	Deadline time.Time
+}
+
+// taskDeadline is the optional deadline the scheduler may set in the task json
+type taskDeadline struct {
+	Deadline *time.Time
+}
+
+// enqueuePendingScript stores the task once, and only extends the ttl of the queue keys
+var enqueuePendingScript = redis.NewScript(`
+if redis.call("hsetnx", KEYS[2], ARGV[1], ARGV[3]) == 0 then
+	return 0
+end
+redis.call("zadd", KEYS[1], ARGV[2], ARGV[1])
+redis.call("zadd", KEYS[3], ARGV[5], ARGV[4])
+for i = 1, 2 do
+	if redis.call("pttl", KEYS[i]) < tonumber(ARGV[6]) then
+		redis.call("pexpire", KEYS[i], ARGV[6])
+	end
+end
+return 1`)
+
+// dequeuePendingScript pops the oldest task of the sensor the expiry did not claim yet
+var dequeuePendingScript = redis.NewScript(`
+while true do
+	local ids = redis.call("zrange", KEYS[1], 0, 0)
+	if #ids == 0 then
+		return false
+	end
+	local id = ids[1]
+	redis.call("zrem", KEYS[1], id)
+	local entry = redis.call("hget", KEYS[2], id)
+	redis.call("hdel", KEYS[2], id)
+	if redis.call("zrem", KEYS[3], ARGV[1] .. ":" .. id) == 1 and entry then
+		return entry
+	end
+end`)
+
+func pendingDeadlineMember(sensorId, taskId uuid.UUID) string {
+	return sensorId.String() + ":" + taskId.String()
+}
+
+// queueIfOffline queues the task when its sensor is not connected to any instance,
+// the instances passing a task of a sensor held by another instance leave it alone
+func (w *wsServer) queueIfOffline(task sensor.Task, payload string) (queued bool, err error) {
+	if w.opts.PendingTaskTtl <= 0 {
+		return
+	}
+	_, exists, err := w.getSensorPresence(task.SensorId)
+	if err != nil || exists {
+		return
+	}
+	err = w.queuePendingTask(task, payload)
+	return err == nil, err
+}
+
+// queuePendingTask queues the task of an offline sensor until its deadline, queuing the same task twice is a no-op
+func (w *wsServer) queuePendingTask(task sensor.Task, payload string) (err error) {
+	if w.opts.PendingTaskTtl <= 0 {
+		w.serverLogger.WithFields(log.Fields{
+			"sensorId": task.SensorId,
+			"taskId":   task.Id,
+		}).Info("The sensor is offline, dropping task")
+		return
+	}
+
+	now := time.Now().UTC()
+	entry := pendingTask{
+		TaskId:   task.Id,
+		SensorId: task.SensorId,
+		Payload:  payload,
+		QueuedAt: now,
+		Deadline: now.Add(w.opts.PendingTaskTtl),
+	}
+	var deadline taskDeadline
+	if jsonErr := json.Unmarshal([]byte(payload), &deadline); jsonErr == nil && deadline.Deadline != nil {
+		entry.Deadline = deadline.Deadline.UTC()
+	}
+
+	var serverLogger = w.serverLogger.WithFields(log.Fields{
+		"sensorId": task.SensorId,
+		"taskId":   task.Id,
+	})
+
+	if !entry.Deadline.After(now) {
+		serverLogger.Info("The sensor is offline and the task deadline passed, expiring task")
+		pendingTasks.WithLabelValues(pendingExpired).Inc()
+		return w.expireTask(task.Id)
+	}
+
+	added, err := w.storePendingTask(entry)
+	// the other instances passing the same task in broadcast routing queued it already
+	if err != nil || !added {
+		return
+	}
+	serverLogger.Info(fmt.Sprintf("The sensor is offline, task queued until %v", entry.Deadline.Format(time.RFC3339)))
+
+	// the sensor may have reconnected while the task was queued, after its queue was delivered
+	_, exists, err := w.getSensorPresence(entry.SensorId)
+	if err != nil || !exists {
+		return
+	}
+	cmd := adminCommand{Command: adminCommandDeliverPending, SensorId: entry.SensorId}
+	if _, applyErr := w.applyAdminCommand(cmd); applyErr != nil {
+		serverLogger.Error(fmt.Sprintf("applyAdminCommand err: %v", applyErr))
+	}
+	return w.publishAdminCommand(cmd)
+}
+
+// storePendingTask adds the task to the queue of its sensor, added is false if it was already queued
+func (w *wsServer) storePendingTask(entry pendingTask) (added bool, err error) {
+	val, err := json.Marshal(entry)
+	if err != nil {
+		err = fmt.Errorf("marshal pendingTask err:%v", err)
+		return
+	}
+
+	n, err := enqueuePendingScript.Run(w.redisClient,
+		[]string{
+			redisPendingQueueKeyPrefix + entry.SensorId.String(),
+			redisPendingTasksKeyPrefix + entry.SensorId.String(),
+			redisPendingDeadlinesKey,
+		},
+		entry.TaskId.String(),
+		entry.QueuedAt.UnixMilli(),
+		val,
+		pendingDeadlineMember(entry.SensorId, entry.TaskId),
+		entry.Deadline.UnixMilli(),
+		(time.Until(entry.Deadline) + pendingKeysSlack).Milliseconds(),
+	).Int64()
+	if err != nil {
+		redisErrors.WithLabelValues("queue_pending_task").Inc()
+		err = fmt.Errorf("failed to queue the pending task %v:%v", entry.TaskId, err)
+		return
+	}
+	if n == 0 {
+		return
+	}
+	pendingTasks.WithLabelValues(pendingQueued).Inc()
+	return true, nil
+}
+
+// deliverPendingTasks sends the queued tasks of the sensor, oldest first
+func (w *wsServer) deliverPendingTasks(wsConn *sensorConnection) {
+	// a single delivery at a time keeps the order
+	wsConn.pendingLock.Lock()
+	defer wsConn.pendingLock.Unlock()
+
+	var serverLogger = w.serverLogger.WithFields(log.Fields{
+		"connectionId": wsConn.ConnectionId.String(),
+		"sensorId":     wsConn.SensorId,
+	})
+
+	for !wsConn.draining.Load() {
+		if _, closed := wsConn.closedByServer(); closed {
+			return
+		}
+
+		val, err := dequeuePendingScript.Run(w.redisClient,
+			[]string{
+				redisPendingQueueKeyPrefix + wsConn.SensorId.String(),
+				redisPendingTasksKeyPrefix + wsConn.SensorId.String(),
+				redisPendingDeadlinesKey,
+			},
+			wsConn.SensorId.String(),
+		).String()
+		if err == redis.Nil {
+			return
+		}
+		if err != nil {
+			redisErrors.WithLabelValues("dequeue_pending_task").Inc()
+			logger.LogError(err.Error(), "deliverPendingTasks, error dequeuing the pending task", serverLogger)
+			return
+		}
+
+		var entry pendingTask
+		err = json.Unmarshal([]byte(val), &entry)
+		if err != nil {
+			logger.LogError(err.Error(), fmt.Sprintf("deliverPendingTasks, error unmarshal pending task:%v", val), serverLogger)
+			continue
+		}
+
+		if !time.Now().Before(entry.Deadline) {
+			pendingTasks.WithLabelValues(pendingExpired).Inc()
+			err = w.expireTask(entry.TaskId)
+			if err != nil {
+				logger.LogError(err.Error(), "deliverPendingTasks", serverLogger)
+			}
+			continue
+		}
+
+		err = w.dispatchTask(entry.Payload)
+		if err != nil {
+			// queued back in its place, it is retried on the next delivery
+			logger.LogError(err.Error(), "deliverPendingTasks, error dispatching the pending task, queuing it back", serverLogger)
+			if _, queueErr := w.storePendingTask(entry); queueErr != nil {
+				logger.LogError(queueErr.Error(), "deliverPendingTasks", serverLogger)
+			}
+			return
+		}
+		pendingTasks.WithLabelValues(pendingDelivered).Inc()
+		pendingTaskWait.Observe(time.Since(entry.QueuedAt).Seconds())
+	}
+}
+
+// pendingTasksExpiry expires the queued tasks past their deadline, the sensors of which did not reconnect
+func (w *wsServer) pendingTasksExpiry() {
+	for {
+		time.Sleep(pendingExpiryPeriod)
+
+		err := w.expirePendingTasks()
+		if err != nil {
+			logger.LogError(err.Error(), "pendingTasksExpiry", w.serverLogger)
+		}
+	}
+}
+
+func (w *wsServer) expirePendingTasks() (err error) {
+	members, err := w.redisClient.ZRangeByScore(redisPendingDeadlinesKey, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Count: pendingExpiryBatch,
+	}).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("expire_pending_task").Inc()
+		return fmt.Errorf("failed to load the expired pending tasks:%v", err)
+	}
+
+	for _, member := range members {
+		// the instance removing the member owns the task, the others or the delivery skip it
+		removed, remErr := w.redisClient.ZRem(redisPendingDeadlinesKey, member).Result()
+		if remErr != nil {
+			redisErrors.WithLabelValues("expire_pending_task").Inc()
+			return fmt.Errorf("failed to claim the expired pending task %v:%v", member, remErr)
+		}
+		if removed == 0 {
+			continue
+		}
+
+		sensorId, taskId, found := strings.Cut(member, ":")
+		if !found {
+			continue
+		}
+		_, remErr = w.redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.ZRem(redisPendingQueueKeyPrefix+sensorId, taskId)
+			pipe.HDel(redisPendingTasksKeyPrefix+sensorId, taskId)
+			return nil
+		})
+		if remErr != nil {
+			redisErrors.WithLabelValues("expire_pending_task").Inc()
+			logger.LogError(remErr.Error(), fmt.Sprintf("expirePendingTasks, error removing the task %v", member), w.serverLogger)
+		}
+
+		id, parseErr := uuid.Parse(taskId)
+		if parseErr != nil {
+			continue
+		}
+		w.serverLogger.WithFields(log.Fields{
+			"sensorId": sensorId,
+			"taskId":   taskId,
+		}).Info("The sensor did not reconnect before the task deadline, expiring task")
+		pendingTasks.WithLabelValues(pendingExpired).Inc()
+		err = w.expireTask(id)
+		if err != nil {
+			logger.LogError(err.Error(), "expirePendingTasks", w.serverLogger)
+		}
+	}
+	return nil
+}
+
+// expireTask sets the EXPIRED status on the task
+func (w *wsServer) expireTask(taskId uuid.UUID) (err error) {
+	_, err = w.transitionTask(w.dbClient, taskId, TaskExpired, "sensor offline until the task deadline")
+	return
+}
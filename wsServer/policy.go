@@ -0,0 +1,173 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/sensor"
+	"github.com/ping-42/server/wsServer/results"
+	"gorm.io/gorm"
+)
+
+// SensorPolicy restricts what a sensor may do once authenticated, the empty fields allow everything
+type SensorPolicy struct {
+	SensorID uuid.UUID     `gorm:"type:uuid;primaryKey"`
+	Sensor   models.Sensor `gorm:"foreignKey:SensorID"`
+	// AllowedCidrs the sensor may connect from
+	AllowedCidrs []string `gorm:"type:jsonb;serializer:json"`
+	// AllowedTaskTypes the sensor may receive, e.g. ICMP_TASK
+	AllowedTaskTypes []string `gorm:"type:jsonb;serializer:json"`
+	// ValidFrom and ValidUntil bound the period the sensor may connect and receive tasks
+	ValidFrom  *time.Time `gorm:"type:TIMESTAMPTZ;"`
+	ValidUntil *time.Time `gorm:"type:TIMESTAMPTZ;"`
+	UpdatedAt  time.Time
+
+	prefixes []netip.Prefix `gorm:"-"`
+}
+
+// knownTaskType tells if the task type has a result handler registered, the only types a policy may allow
+func knownTaskType(taskName sensor.TaskName) bool {
+	_, ok := results.Default.Lookup(taskName)
+	return ok
+}
+
+// NewSensorPolicy validates the policy of the sensor
+func NewSensorPolicy(sensorId uuid.UUID, allowedCidrs []string, allowedTaskTypes []string, validFrom, validUntil *time.Time) (policy SensorPolicy, err error) {
+	policy = SensorPolicy{
+		SensorID:         sensorId,
+		AllowedCidrs:     allowedCidrs,
+		AllowedTaskTypes: allowedTaskTypes,
+		ValidFrom:        validFrom,
+		ValidUntil:       validUntil,
+	}
+	err = policy.init()
+	if err != nil {
+		err = fmt.Errorf("invalid allowed CIDR %v", err)
+		return
+	}
+	for _, taskType := range allowedTaskTypes {
+		if !knownTaskType(sensor.TaskName(taskType)) {
+			err = fmt.Errorf("unknown task type %q", taskType)
+			return
+		}
+	}
+	if validFrom != nil && validUntil != nil && !validUntil.After(*validFrom) {
+		err = fmt.Errorf("valid until %v is not after valid from %v", validUntil, validFrom)
+		return
+	}
+	return
+}
+
+// init parses the allowed CIDRs
+func (p *SensorPolicy) init() (err error) {
+	p.prefixes, err = parsePrefixes(p.AllowedCidrs)
+	return
+}
+
+// allowsAddr tells if the sensor may connect from addr
+func (p *SensorPolicy) allowsAddr(addr string) bool {
+	if p == nil || len(p.prefixes) == 0 {
+		return true
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsTaskType tells if the sensor may receive the task type
+func (p *SensorPolicy) allowsTaskType(taskName sensor.TaskName) bool {
+	if p == nil || len(p.AllowedTaskTypes) == 0 {
+		return true
+	}
+	for _, taskType := range p.AllowedTaskTypes {
+		if sensor.TaskName(taskType) == taskName {
+			return true
+		}
+	}
+	return false
+}
+
+// validAt tells if the policy allows the sensor at t
+func (p *SensorPolicy) validAt(t time.Time) bool {
+	if p == nil {
+		return true
+	}
+	if p.ValidFrom != nil && t.Before(*p.ValidFrom) {
+		return false
+	}
+	if p.ValidUntil != nil && !t.Before(*p.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// getSensorPolicy returns the policy of the sensor, nil if it has none
+func getSensorPolicy(db *gorm.DB, sensorId uuid.UUID) (policy *SensorPolicy, err error) {
+	var p SensorPolicy
+	err = db.First(&p, "sensor_id = ?", sensorId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	err = p.init()
+	if err != nil {
+		err = fmt.Errorf("invalid policy of sensor %v: %v", sensorId, err)
+		return
+	}
+	return &p, nil
+}
+
+// authorizeConnection checks the policy of the authenticated sensor connecting from remoteAddr,
+// the denials are audited. A policy that can not be loaded denies the connection.
+func (w *wsServer) authorizeConnection(sensorId uuid.UUID, remoteAddr string) (err error) {
+	creds, err := w.getSensorCredentials(sensorId)
+	if err != nil {
+		return fmt.Errorf("unable to load the sensor policy: %v", err)
+	}
+
+	if !creds.policy.validAt(time.Now()) {
+		err = fmt.Errorf("policy not valid now, valid from:%v until:%v", creds.policy.ValidFrom, creds.policy.ValidUntil)
+		w.recordAuditEvent(AuditEvent{SensorID: sensorId, Event: AuditPolicyExpired, RemoteAddr: remoteAddr, Detail: err.Error()})
+		return
+	}
+	if !creds.policy.allowsAddr(remoteAddr) {
+		err = fmt.Errorf("address %v not in the allowed CIDRs %v", remoteAddr, creds.policy.AllowedCidrs)
+		w.recordAuditEvent(AuditEvent{SensorID: sensorId, Event: AuditPolicyAddrDenied, RemoteAddr: remoteAddr, Detail: err.Error()})
+		return
+	}
+	return nil
+}
+
+// authorizeTask checks the policy of the sensor allows the task, the denials are audited
+func (w *wsServer) authorizeTask(wsConn *sensorConnection, task sensor.Task) (err error) {
+	creds, err := w.getSensorCredentials(task.SensorId)
+	if err != nil {
+		return fmt.Errorf("unable to load the sensor policy: %v", err)
+	}
+
+	taskId := task.Id
+	if !creds.policy.validAt(time.Now()) {
+		err = fmt.Errorf("policy not valid now, valid from:%v until:%v", creds.policy.ValidFrom, creds.policy.ValidUntil)
+		w.recordAuditEvent(AuditEvent{SensorID: task.SensorId, Event: AuditPolicyExpired, TaskID: &taskId, RemoteAddr: wsConn.remoteAddr, Detail: err.Error()})
+		return
+	}
+	if !creds.policy.allowsTaskType(task.Name) {
+		err = fmt.Errorf("task type %v not in the allowed task types %v", task.Name, creds.policy.AllowedTaskTypes)
+		w.recordAuditEvent(AuditEvent{SensorID: task.SensorId, Event: AuditPolicyTaskTypeDenied, TaskID: &taskId, RemoteAddr: wsConn.remoteAddr, Detail: err.Error()})
+		return
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/constants"
+)
+
+// redisSensorDrainKeyPrefix marks a sensor as draining, it survives reconnects until undrained
+const redisSensorDrainKeyPrefix = "server_sensor_drain_"
+
+// refreshActiveSensor stores the active connection data in Redis with ttl
+func (w *wsServer) refreshActiveSensor(conn *sensorConnection) (err error) {
+	activeSensor, err := json.Marshal(conn.presence(w.instanceId))
+	if err != nil {
+		w.serverLogger.Error("marshal RedisDataActiveSensor err:", err.Error())
+		return
+	}
+	err = w.redisClient.Set(
+		constants.RedisActiveSensorsKeyPrefix+conn.SensorId.String(),
+		activeSensor,
+		constants.TelemetryMonitorPeriod+constants.TelemetryMonitorPeriodThreshold).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("set_active_sensor").Inc()
+		err = fmt.Errorf("failed to store active connection data in Redis:%v", err)
+		return
+	}
+
+	return
+}
+
+// getSensorPresence loads the presence of a sensor connected to any instance
+func (w *wsServer) getSensorPresence(sensorId uuid.UUID) (presence sensorPresence, exists bool, err error) {
+	val, err := w.redisClient.Get(constants.RedisActiveSensorsKeyPrefix + sensorId.String()).Bytes()
+	if err == redis.Nil {
+		err = nil
+		return
+	}
+	if err != nil {
+		redisErrors.WithLabelValues("get_active_sensor").Inc()
+		err = fmt.Errorf("failed to load active sensor from Redis:%v", err)
+		return
+	}
+
+	err = json.Unmarshal(val, &presence)
+	if err != nil {
+		err = fmt.Errorf("unmarshal active sensor err:%v", err)
+		return
+	}
+	exists = true
+	return
+}
+
+// listSensorPresence loads the presence of the sensors connected to all instances
+func (w *wsServer) listSensorPresence() (presences []sensorPresence, err error) {
+	var keys []string
+	iter := w.redisClient.Scan(0, constants.RedisActiveSensorsKeyPrefix+"*", 500).Iterator()
+	for iter.Next() {
+		// the rank keys share the active sensors prefix
+		if strings.HasPrefix(iter.Val(), constants.RedisActiveSensorsRankKey) {
+			continue
+		}
+		keys = append(keys, iter.Val())
+	}
+	if err = iter.Err(); err != nil {
+		redisErrors.WithLabelValues("scan_active_sensors").Inc()
+		err = fmt.Errorf("failed to scan active sensors in Redis:%v", err)
+		return
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	vals, err := w.redisClient.MGet(keys...).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("get_active_sensor").Inc()
+		err = fmt.Errorf("failed to load active sensors from Redis:%v", err)
+		return
+	}
+	for i, val := range vals {
+		// the key expired between the scan and the get
+		str, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var presence sensorPresence
+		if jsonErr := json.Unmarshal([]byte(str), &presence); jsonErr != nil {
+			w.serverLogger.Error(fmt.Sprintf("unmarshal active sensor %v err:%v", keys[i], jsonErr))
+			continue
+		}
+		presences = append(presences, presence)
+	}
+	return
+}
+
+// setSensorDrain persists the drain flag of the sensor
+func (w *wsServer) setSensorDrain(sensorId uuid.UUID, drain bool) (err error) {
+	if drain {
+		err = w.redisClient.Set(redisSensorDrainKeyPrefix+sensorId.String(), "1", 0).Err()
+	} else {
+		err = w.redisClient.Del(redisSensorDrainKeyPrefix + sensorId.String()).Err()
+	}
+	if err != nil {
+		redisErrors.WithLabelValues("set_sensor_drain").Inc()
+		err = fmt.Errorf("failed to store sensor drain flag in Redis:%v", err)
+	}
+	return
+}
+
+// isSensorDrained loads the drain flag of the sensor
+func (w *wsServer) isSensorDrained(sensorId uuid.UUID) (drained bool, err error) {
+	n, err := w.redisClient.Exists(redisSensorDrainKeyPrefix + sensorId.String()).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("get_sensor_drain").Inc()
+		err = fmt.Errorf("failed to load sensor drain flag from Redis:%v", err)
+		return
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/sensor"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// recentSecurityEvents is the number of audit events returned with the reputation
+const recentSecurityEvents = 20
+
+// maxClockSkew is how far the clock of a sensor may be from the server one,
+// a result measured more than that in the future, or before its task was created, is rejected
+const maxClockSkew = 5 * time.Minute
+
+// errResultRejected is returned for a result the sensor is not allowed to submit, nothing is stored
+var errResultRejected = errors.New("result rejected")
+
+// SensorReputation counts the results a sensor submitted for tasks that were not dispatched to it
+type SensorReputation struct {
+	SensorID       uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	Mismatches     int64      `gorm:"not null;default:0"`
+	LastMismatchAt *time.Time `gorm:"type:TIMESTAMPTZ;"`
+	LastEvent      AuditEventType
+	UpdatedAt      time.Time
+}
+
+// resultTask is the part of the task the submitted result is checked against
+type resultTask struct {
+	SensorID     uuid.UUID
+	TaskStatusID TaskState
+	Type         string
+	CreatedAt    time.Time
+}
+
+// verifyResultOwner checks the task of the result exists, was dispatched to the submitting sensor,
+// is of the result type, and was measured at a time the task could run. The mismatches are audited
+// and lower the reputation of the sensor.
+// A result in any other unexpected state, e.g. a duplicate, is left to the task state machine.
+func (w *wsServer) verifyResultOwner(tx *gorm.DB, sensorId uuid.UUID, sensorResult sensor.TResult, measuredAt time.Time) (err error) {
+	var tasks []resultTask
+	err = tx.Raw(`
+		SELECT t.sensor_id, t.task_status_id, tt.type, t.created_at
+		FROM tasks t JOIN lv_task_types tt ON tt.id = t.task_type_id
+		WHERE t.id = ?`, sensorResult.TaskId,
+	).Scan(&tasks).Error
+	if err != nil {
+		dbErrors.WithLabelValues("load_task").Inc()
+		return fmt.Errorf("failed to load the task %v of the result: %v", sensorResult.TaskId, err)
+	}
+
+	switch {
+	case len(tasks) == 0:
+		return w.rejectResult(sensorId, sensorResult, AuditResultUnknownTask,
+			fmt.Sprintf("result for unknown task %v", sensorResult.TaskId))
+	case tasks[0].SensorID != sensorId:
+		return w.rejectResult(sensorId, sensorResult, AuditResultForeignTask,
+			fmt.Sprintf("result for task %v of sensor %v", sensorResult.TaskId, tasks[0].SensorID))
+	case tasks[0].Type != string(sensorResult.TaskName):
+		return w.rejectResult(sensorId, sensorResult, AuditResultTaskTypeMismatch,
+			fmt.Sprintf("%v result for %v task %v", sensorResult.TaskName, tasks[0].Type, sensorResult.TaskId))
+	case tasks[0].TaskStatusID == TaskInitiated || tasks[0].TaskStatusID == TaskPublished:
+		return w.rejectResult(sensorId, sensorResult, AuditResultNotDispatched,
+			fmt.Sprintf("result for task %v not dispatched yet, state %v", sensorResult.TaskId, tasks[0].TaskStatusID))
+	case measuredAt.After(time.Now().Add(maxClockSkew)):
+		return w.rejectResult(sensorId, sensorResult, AuditResultInvalidTime,
+			fmt.Sprintf("result for task %v measured in the future, at %v", sensorResult.TaskId, measuredAt.Format(time.RFC3339)))
+	case measuredAt.Before(tasks[0].CreatedAt.Add(-maxClockSkew)):
+		return w.rejectResult(sensorId, sensorResult, AuditResultInvalidTime,
+			fmt.Sprintf("result for task %v measured at %v, before the task was created at %v",
+				sensorResult.TaskId, measuredAt.Format(time.RFC3339), tasks[0].CreatedAt.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// rejectResult audits the mismatch and counts it in the sensor reputation, outside of the result transaction
+func (w *wsServer) rejectResult(sensorId uuid.UUID, sensorResult sensor.TResult, event AuditEventType, detail string) error {
+	var remoteAddr string
+	if wsConn, exists := w.getSensorWsConnection(sensorId); exists {
+		remoteAddr = wsConn.remoteAddr
+	}
+	taskId := sensorResult.TaskId
+	w.recordAuditEvent(AuditEvent{SensorID: sensorId, Event: event, TaskID: &taskId, RemoteAddr: remoteAddr, Detail: detail})
+
+	err := w.incrementMismatches(sensorId, event)
+	if err != nil {
+		w.serverLogger.Error(err.Error())
+	}
+	return fmt.Errorf("%w: %v", errResultRejected, detail)
+}
+
+func (w *wsServer) incrementMismatches(sensorId uuid.UUID, event AuditEventType) error {
+	now := time.Now().UTC()
+	err := w.dbClient.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "sensor_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"mismatches":       gorm.Expr("sensor_reputations.mismatches + 1"),
+			"last_mismatch_at": now,
+			"last_event":       event,
+			"updated_at":       now,
+		}),
+	}).Create(&SensorReputation{
+		SensorID:       sensorId,
+		Mismatches:     1,
+		LastMismatchAt: &now,
+		LastEvent:      event,
+	}).Error
+	if err != nil {
+		dbErrors.WithLabelValues("update_reputation").Inc()
+		return fmt.Errorf("failed to update the reputation of sensor %v: %v", sensorId, err)
+	}
+	return nil
+}
+
+// GetSensorReputation returns the reputation of the sensor, a sensor without mismatches has none stored
+func GetSensorReputation(db *gorm.DB, sensorId uuid.UUID) (reputation SensorReputation, err error) {
+	err = db.First(&reputation, "sensor_id = ?", sensorId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return SensorReputation{SensorID: sensorId}, nil
+	}
+	return
+}
+
+// sensorReputationResponse is the admin api view of the reputation
+type sensorReputationResponse struct {
+	SensorReputation
+	RecentEvents []AuditEvent
+}
+
+// handleAdminSensorReputation returns the reputation of a sensor with its latest audit events
+func (w *wsServer) handleAdminSensorReputation(wr http.ResponseWriter, r *http.Request) {
+	sensorId, err := uuid.Parse(r.PathValue("sensorId"))
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, fmt.Errorf("invalid sensorId: %v", err))
+		return
+	}
+
+	db := w.dbClient.WithContext(r.Context())
+	var res sensorReputationResponse
+	res.SensorReputation, err = GetSensorReputation(db, sensorId)
+	if err != nil {
+		dbErrors.WithLabelValues("load_reputation").Inc()
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	err = db.Where("sensor_id = ?", sensorId).Order("time DESC").Limit(recentSecurityEvents).Find(&res.RecentEvents).Error
+	if err != nil {
+		dbErrors.WithLabelValues("load_audit_events").Inc()
+		writeApiError(wr, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(wr, http.StatusOK, res)
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/logger"
+	"github.com/ping-42/42lib/sensor"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ResultDeadLetterStream receives the results that could not be stored after resultStoreAttempts,
+// they can be replayed with the admin api once the cause is fixed
+const ResultDeadLetterStream = "SERVER_RESULT_DEAD_LETTER_STREAM"
+
+const (
+	resultStoreAttempts = 4
+	resultRetryBase     = 100 * time.Millisecond
+	resultRetryMax      = 2 * time.Second
+
+	resultDeadLetterMaxLen    = 100000
+	defaultDeadLettersCount   = 100
+	maxDeadLettersCount       = 1000
+	resultDeadLetterMalformed = "malformed"
+	resultDeadLetterExhausted = "attempts_exhausted"
+)
+
+// errMalformedResult is returned for a result that can not be parsed, storing it again will not help
+var errMalformedResult = errors.New("malformed result")
+
+// resultHandled tells if the result needs no retry nor dead letter: it is stored, a duplicate or rejected
+func resultHandled(err error) bool {
+	return err == nil || errors.Is(err, errInvalidTransition) || errors.Is(err, errResultRejected)
+}
+
+// storeTaskResult stores the result, its task status and the subscription count in a single transaction,
+// retried with backoff while it fails for another reason than the result itself
+func (w *wsServer) storeTaskResult(ctx context.Context, sensorId uuid.UUID, sensorResult sensor.TResult, measuredAt time.Time) (liveEvent LiveEvent, attempts int, err error) {
+	for attempts = 1; ; attempts++ {
+		var (
+			rows      ingestRows
+			preStored any
+		)
+		preStored, err = w.preStoreResult(ctx, sensorId, sensorResult, measuredAt)
+		if err == nil {
+			err = w.dbClient.WithContext(ctx).Transaction(func(tx *gorm.DB) (txErr error) {
+				liveEvent, txErr = w.processTaskResult(ctx, tx, &rows, sensorId, sensorResult, preStored, measuredAt)
+				if txErr != nil {
+					return txErr
+				}
+				return rows.flush(tx)
+			})
+		}
+		if err == nil {
+			rows.committed()
+		}
+		if resultHandled(err) || errors.Is(err, errMalformedResult) || attempts >= resultStoreAttempts {
+			return
+		}
+
+		resultStoreRetries.Inc()
+		w.serverLogger.WithFields(log.Fields{
+			"sensorId": sensorId,
+			"taskId":   sensorResult.TaskId,
+		}).Warn(fmt.Sprintf("Storing the result failed, attempt %v of %v: %v", attempts, resultStoreAttempts, err))
+		time.Sleep(resultRetryBackoff(attempts))
+	}
+}
+
+// resultRetryBackoff doubles the wait after each attempt, with jitter so the retries of many sensors spread
+func resultRetryBackoff(attempt int) time.Duration {
+	backoff := resultRetryBase << (attempt - 1)
+	if backoff > resultRetryMax {
+		backoff = resultRetryMax
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// deadLetterResult keeps the result that could not be stored in Redis, which does not share the failures of Postgres
+func (w *wsServer) deadLetterResult(sensorId uuid.UUID, sensorResult sensor.TResult, measuredAt time.Time, attempts int, storeErr error) (err error) {
+	result, err := json.Marshal(sensorResult)
+	if err != nil {
+		return fmt.Errorf("marshal dead lettered result err:%v", err)
+	}
+
+	reason := resultDeadLetterExhausted
+	if errors.Is(storeErr, errMalformedResult) {
+		reason = resultDeadLetterMalformed
+	}
+
+	err = w.redisClient.XAdd(&redis.XAddArgs{
+		Stream:       ResultDeadLetterStream,
+		MaxLenApprox: resultDeadLetterMaxLen,
+		Values: map[string]interface{}{
+			"result":     result,
+			"sensorId":   sensorId.String(),
+			"measuredAt": measuredAt.Format(time.RFC3339Nano),
+			"attempts":   attempts,
+			"reason":     reason,
+			"error":      storeErr.Error(),
+			"instance":   w.instanceId,
+		},
+	}).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_add").Inc()
+		return fmt.Errorf("failed to dead letter the result of task %v:%v", sensorResult.TaskId, err)
+	}
+	resultDeadLetters.WithLabelValues(reason).Inc()
+	w.serverLogger.WithFields(log.Fields{
+		"sensorId": sensorId,
+		"taskId":   sensorResult.TaskId,
+	}).Error(fmt.Sprintf("Result dead lettered after %v attempts: %v", attempts, storeErr))
+	return
+}
+
+// resultDeadLetter is the admin api view of a dead lettered result
+type resultDeadLetter struct {
+	Id         string
+	SensorId   uuid.UUID
+	MeasuredAt time.Time
+	Attempts   int
+	Reason     string
+	Error      string
+	Instance   string
+	Result     json.RawMessage
+}
+
+func parseResultDeadLetter(msg redis.XMessage) (dl resultDeadLetter, err error) {
+	field := func(name string) string {
+		s, _ := msg.Values[name].(string)
+		return s
+	}
+	dl = resultDeadLetter{
+		Id:       msg.ID,
+		Reason:   field("reason"),
+		Error:    field("error"),
+		Instance: field("instance"),
+		Result:   json.RawMessage(field("result")),
+	}
+	dl.Attempts, _ = strconv.Atoi(field("attempts"))
+	dl.SensorId, err = uuid.Parse(field("sensorId"))
+	if err != nil {
+		return dl, fmt.Errorf("invalid sensorId of dead letter %v: %v", msg.ID, err)
+	}
+	dl.MeasuredAt, err = time.Parse(time.RFC3339Nano, field("measuredAt"))
+	if err != nil {
+		return dl, fmt.Errorf("invalid measuredAt of dead letter %v: %v", msg.ID, err)
+	}
+	return
+}
+
+// deadLettersCount reads ?count=, defaultDeadLettersCount by default
+func deadLettersCount(r *http.Request) (count int64, err error) {
+	count = defaultDeadLettersCount
+	if s := r.URL.Query().Get("count"); s != "" {
+		count, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || count <= 0 || count > maxDeadLettersCount {
+			return 0, fmt.Errorf("invalid count, expected 1 to %v", maxDeadLettersCount)
+		}
+	}
+	return
+}
+
+// handleAdminListResultDeadLetters lists the oldest dead lettered results
+func (w *wsServer) handleAdminListResultDeadLetters(wr http.ResponseWriter, r *http.Request) {
+	count, err := deadLettersCount(r)
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, err)
+		return
+	}
+
+	msgs, err := w.redisClient.XRangeN(ResultDeadLetterStream, "-", "+", count).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_read").Inc()
+		writeApiError(wr, http.StatusBadGateway, err)
+		return
+	}
+
+	deadLetters := make([]resultDeadLetter, 0, len(msgs))
+	for _, msg := range msgs {
+		dl, parseErr := parseResultDeadLetter(msg)
+		if parseErr != nil {
+			dl.Error = parseErr.Error()
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	writeJson(wr, http.StatusOK, deadLetters)
+}
+
+// replayApiResponse reports the outcome of a replay of the dead lettered results
+type replayApiResponse struct {
+	Replayed int
+	Failed   int
+	Errors   []string `json:",omitempty"`
+}
+
+// handleAdminReplayResultDeadLetters stores again the oldest dead lettered results,
+// the ones stored, or no longer needed, are removed from the stream
+func (w *wsServer) handleAdminReplayResultDeadLetters(wr http.ResponseWriter, r *http.Request) {
+	count, err := deadLettersCount(r)
+	if err != nil {
+		writeApiError(wr, http.StatusBadRequest, err)
+		return
+	}
+
+	msgs, err := w.redisClient.XRangeN(ResultDeadLetterStream, "-", "+", count).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_read").Inc()
+		writeApiError(wr, http.StatusBadGateway, err)
+		return
+	}
+
+	var res replayApiResponse
+	for _, msg := range msgs {
+		err = w.replayResultDeadLetter(r.Context(), msg)
+		if err != nil {
+			res.Failed++
+			res.Errors = append(res.Errors, fmt.Sprintf("%v: %v", msg.ID, err))
+			continue
+		}
+		res.Replayed++
+	}
+	writeJson(wr, http.StatusOK, res)
+}
+
+func (w *wsServer) replayResultDeadLetter(ctx context.Context, msg redis.XMessage) (err error) {
+	dl, err := parseResultDeadLetter(msg)
+	if err != nil {
+		return
+	}
+	var sensorResult sensor.TResult
+	err = json.Unmarshal(dl.Result, &sensorResult)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedResult, err)
+	}
+
+	liveEvent, _, err := w.storeTaskResult(ctx, dl.SensorId, sensorResult, dl.MeasuredAt)
+	if !resultHandled(err) {
+		return
+	}
+	if err == nil {
+		w.publishLiveEvent(ctx, liveEvent)
+	} else {
+		logger.LogError(err.Error(), fmt.Sprintf("replayResultDeadLetter, dropping dead letter %v", msg.ID), w.serverLogger)
+	}
+
+	err = w.redisClient.XDel(ResultDeadLetterStream, msg.ID).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_ack").Inc()
+		err = fmt.Errorf("failed to delete the replayed dead letter:%v", err)
+	}
+	return
+}
@@ -0,0 +1,285 @@
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/dns"
+	"github.com/ping-42/42lib/sensor"
+)
+
+// Sections of a DNS response
+const (
+	DnsSectionAnswer     = "answer"
+	DnsSectionAuthority  = "authority"
+	DnsSectionAdditional = "additional"
+)
+
+// DnsResult is the dns result sent by the sensor. The sensors only sending AnswerA are still accepted,
+// the others send the full response, either in wire format or as the rcode, flags and records.
+type DnsResult struct {
+	dns.Result
+	// Resolver is the address of the resolver queried, e.g. 1.1.1.1:53
+	Resolver string
+	// Response is the DNS response in wire format, the fields below are read from it when set
+	Response []byte
+	// Rcode and flags of the response
+	Rcode              *int
+	Authoritative      bool
+	Truncated          bool
+	RecursionAvailable bool
+	AuthenticatedData  bool
+	// Records of the sections in presentation format, e.g. "example.com. 300 IN MX 10 mail.example.com."
+	Answer     []string
+	Authority  []string
+	Additional []string
+
+	// records are the parsed records of all the sections
+	records []dnsRecord
+}
+
+type dnsRecord struct {
+	section string
+	rr      mdns.RR
+}
+
+// TsDnsResponse is the header of a DNS response: rcode, flags and resolver
+type TsDnsResponse struct {
+	models.TsSensorTaskBase
+	Resolver           string
+	Rcode              int
+	RcodeName          string
+	Authoritative      bool
+	Truncated          bool
+	RecursionAvailable bool
+	AuthenticatedData  bool
+}
+
+// TsDnsRecord is a resource record of a DNS response. Rdata is the record data in presentation format,
+// the typed columns are set for the common types: Address for A and AAAA, Target for CNAME, NS, PTR, MX
+// and the primary name server of SOA, Preference for MX, Txt for TXT and the Soa columns for SOA.
+type TsDnsRecord struct {
+	models.TsSensorTaskBase
+	Section    string
+	Name       string
+	Type       string
+	Rrtype     uint16
+	Class      uint16
+	Ttl        uint32
+	Rdlength   uint16
+	Rdata      string
+	Address    net.IP `gorm:"type:inet"`
+	Target     string
+	Preference *uint16
+	Txt        []string `gorm:"type:jsonb;serializer:json"`
+	SoaMbox    string
+	SoaSerial  *uint32
+	SoaMinttl  *uint32
+}
+
+func init() {
+	Register(DnsHandler{})
+}
+
+// DnsHandler stores the dns results, their response header and all their records
+type DnsHandler struct{}
+
+func (DnsHandler) TaskName() sensor.TaskName { return dns.TaskName }
+
+// Decode parses the result, and the response or records it carries
+func (DnsHandler) Decode(raw json.RawMessage) (any, error) {
+	var res DnsResult
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("unmarshal %T err:%v", res, err)
+	}
+	if err := res.parseRecords(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (DnsHandler) Validate(res any) error {
+	dnsRes, err := decoded[DnsResult](res)
+	if err != nil {
+		return err
+	}
+	if dnsRes.Rcode != nil {
+		if _, known := mdns.RcodeToString[*dnsRes.Rcode]; !known {
+			return fmt.Errorf("unknown rcode %v", *dnsRes.Rcode)
+		}
+	}
+	return nil
+}
+
+func (DnsHandler) Store(ctx context.Context, store Store, meta Meta, res any) error {
+	dnsRes, err := decoded[DnsResult](res)
+	if err != nil {
+		return err
+	}
+	storeDnsResult(store, meta, dnsRes)
+	return nil
+}
+
+// parseRecords reads the rcode, flags and records from the wire format response,
+// or parses the records sent in presentation format. Without either, the A answers are the records.
+func (r *DnsResult) parseRecords() error {
+	if len(r.Response) > 0 {
+		var msg mdns.Msg
+		if err := msg.Unpack(r.Response); err != nil {
+			return fmt.Errorf("unpack the dns response: %v", err)
+		}
+		rcode := msg.Rcode
+		r.Rcode = &rcode
+		r.Authoritative = msg.Authoritative
+		r.Truncated = msg.Truncated
+		r.RecursionAvailable = msg.RecursionAvailable
+		r.AuthenticatedData = msg.AuthenticatedData
+		r.addRecords(DnsSectionAnswer, msg.Answer)
+		r.addRecords(DnsSectionAuthority, msg.Ns)
+		r.addRecords(DnsSectionAdditional, msg.Extra)
+		return nil
+	}
+
+	if len(r.Answer) == 0 && len(r.Authority) == 0 && len(r.Additional) == 0 {
+		for _, answer := range r.AnswerA {
+			if answer == nil {
+				continue
+			}
+			r.records = append(r.records, dnsRecord{section: DnsSectionAnswer, rr: answer})
+		}
+		return nil
+	}
+
+	sections := []struct {
+		name    string
+		records []string
+	}{
+		{DnsSectionAnswer, r.Answer},
+		{DnsSectionAuthority, r.Authority},
+		{DnsSectionAdditional, r.Additional},
+	}
+	for _, section := range sections {
+		for i, record := range section.records {
+			rr, err := mdns.NewRR(record)
+			if err != nil {
+				return fmt.Errorf("%v record %v: %v", section.name, i, err)
+			}
+			if rr == nil {
+				return fmt.Errorf("%v record %v is empty", section.name, i)
+			}
+			r.records = append(r.records, dnsRecord{section: section.name, rr: rr})
+		}
+	}
+	return nil
+}
+
+func (r *DnsResult) addRecords(section string, rrs []mdns.RR) {
+	for _, rr := range rrs {
+		// the EDNS0 pseudo record is not data of the response
+		if _, ok := rr.(*mdns.OPT); ok {
+			continue
+		}
+		r.records = append(r.records, dnsRecord{section: section, rr: rr})
+	}
+}
+
+// storeDnsResult is shared with the icmp results, which may carry the resolution of their target
+func storeDnsResult(store Store, meta Meta, dnsRes DnsResult) {
+	base := taskBase(meta)
+
+	store.Insert(models.TsDnsResult{
+		TsSensorTaskBase: base,
+		QueryRtt:         dnsRes.QueryRtt.Milliseconds(),
+		SocketRtt:        dnsRes.SockRtt.Milliseconds(),
+		RespSize:         dnsRes.RespSize,
+		Proto:            dnsRes.Proto,
+	})
+
+	// the rcode is only known from the sensors sending the full response
+	if dnsRes.Rcode != nil {
+		store.Insert(TsDnsResponse{
+			TsSensorTaskBase:   base,
+			Resolver:           dnsRes.Resolver,
+			Rcode:              *dnsRes.Rcode,
+			RcodeName:          mdns.RcodeToString[*dnsRes.Rcode],
+			Authoritative:      dnsRes.Authoritative,
+			Truncated:          dnsRes.Truncated,
+			RecursionAvailable: dnsRes.RecursionAvailable,
+			AuthenticatedData:  dnsRes.AuthenticatedData,
+		})
+	}
+
+	// the A answers are still stored in ts_dns_results_answer for its existing readers
+	answers := make([]models.TsDnsResultAnswer, 0, len(dnsRes.records))
+	records := make([]TsDnsRecord, 0, len(dnsRes.records))
+	for _, record := range dnsRes.records {
+		hdr := record.rr.Header()
+		length := rdlength(record.rr)
+		if a, ok := record.rr.(*mdns.A); ok && record.section == DnsSectionAnswer {
+			answers = append(answers, models.TsDnsResultAnswer{
+				TsSensorTaskBase: base,
+				HdrName:          hdr.Name,
+				HdrRrtype:        hdr.Rrtype,
+				HdrClass:         hdr.Class,
+				HdrTtl:           hdr.Ttl,
+				HdrRdlength:      length,
+				A:                a.A,
+			})
+		}
+
+		row := TsDnsRecord{
+			TsSensorTaskBase: base,
+			Section:          record.section,
+			Name:             hdr.Name,
+			Type:             mdns.Type(hdr.Rrtype).String(),
+			Rrtype:           hdr.Rrtype,
+			Class:            hdr.Class,
+			Ttl:              hdr.Ttl,
+			Rdlength:         length,
+			Rdata:            strings.TrimPrefix(record.rr.String(), hdr.String()),
+		}
+		switch rr := record.rr.(type) {
+		case *mdns.A:
+			row.Address = rr.A
+		case *mdns.AAAA:
+			row.Address = rr.AAAA
+		case *mdns.CNAME:
+			row.Target = rr.Target
+		case *mdns.NS:
+			row.Target = rr.Ns
+		case *mdns.PTR:
+			row.Target = rr.Ptr
+		case *mdns.MX:
+			row.Target = rr.Mx
+			row.Preference = &rr.Preference
+		case *mdns.TXT:
+			row.Txt = rr.Txt
+		case *mdns.SOA:
+			row.Target = rr.Ns
+			row.SoaMbox = rr.Mbox
+			row.SoaSerial = &rr.Serial
+			row.SoaMinttl = &rr.Minttl
+		}
+		records = append(records, row)
+	}
+	store.Insert(answers)
+	store.Insert(records)
+}
+
+// rdlength is the length of the record data on the wire. The records unpacked by the sensor carry it,
+// the others are packed to compute it.
+func rdlength(rr mdns.RR) uint16 {
+	if rr.Header().Rdlength > 0 {
+		return rr.Header().Rdlength
+	}
+	buf := make([]byte, mdns.Len(rr))
+	if _, err := mdns.PackRR(rr, buf, 0, nil, false); err != nil {
+		return 0
+	}
+	return rr.Header().Rdlength
+}
@@ -0,0 +1,131 @@
+package results
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/ping-42/42lib/db/models"
+)
+
+func TestDnsHandlerRecords(t *testing.T) {
+	store := &fakeStore{}
+	meta := testMeta()
+	err := handle(t, DnsHandler{}, store, meta, `{
+		"QueryRtt": 12000000, "Proto": 17, "RespSize": 120,
+		"Resolver": "1.1.1.1:53", "Rcode": 0, "RecursionAvailable": true,
+		"Answer": ["example.com. 300 IN A 93.184.216.34", "example.com. 300 IN MX 10 mail.example.com."],
+		"Authority": ["example.com. 3600 IN NS a.iana-servers.net."]
+	}`)
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+
+	results := inserted[models.TsDnsResult](store)
+	if len(results) != 1 || results[0].QueryRtt != 12 || results[0].Proto != 17 || results[0].TaskID != meta.TaskID {
+		t.Errorf("TsDnsResult = %+v", results)
+	}
+	responses := inserted[TsDnsResponse](store)
+	if len(responses) != 1 || responses[0].RcodeName != "NOERROR" || !responses[0].RecursionAvailable || responses[0].Resolver != "1.1.1.1:53" {
+		t.Errorf("TsDnsResponse = %+v", responses)
+	}
+	answers := inserted[models.TsDnsResultAnswer](store)
+	if len(answers) != 1 || !answers[0].A.Equal(net.ParseIP("93.184.216.34")) || answers[0].HdrRdlength != 4 {
+		t.Errorf("TsDnsResultAnswer = %+v", answers)
+	}
+
+	records := inserted[TsDnsRecord](store)
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %+v", records)
+	}
+	if r := records[0]; r.Section != DnsSectionAnswer || r.Type != "A" || !r.Address.Equal(net.ParseIP("93.184.216.34")) {
+		t.Errorf("A record = %+v", r)
+	}
+	if r := records[1]; r.Type != "MX" || r.Target != "mail.example.com." || r.Preference == nil || *r.Preference != 10 || r.Rdata != "10 mail.example.com." {
+		t.Errorf("MX record = %+v", r)
+	}
+	if r := records[2]; r.Section != DnsSectionAuthority || r.Type != "NS" || r.Target != "a.iana-servers.net." || r.Ttl != 3600 {
+		t.Errorf("NS record = %+v", r)
+	}
+}
+
+func TestDnsHandlerWireResponse(t *testing.T) {
+	msg := new(mdns.Msg)
+	msg.SetQuestion("example.com.", mdns.TypeTXT)
+	msg.Response = true
+	msg.Authoritative = true
+	msg.Rcode = mdns.RcodeSuccess
+	txt, err := mdns.NewRR(`example.com. 60 IN TXT "v=spf1 -all"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Answer = append(msg.Answer, txt)
+	msg.SetEdns0(1232, false)
+	wire, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(map[string]any{"Proto": 17, "Response": wire})
+
+	store := &fakeStore{}
+	if err := handle(t, DnsHandler{}, store, testMeta(), string(raw)); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	responses := inserted[TsDnsResponse](store)
+	if len(responses) != 1 || !responses[0].Authoritative || responses[0].RcodeName != "NOERROR" {
+		t.Errorf("TsDnsResponse = %+v", responses)
+	}
+	// the EDNS0 pseudo record is skipped
+	records := inserted[TsDnsRecord](store)
+	if len(records) != 1 || records[0].Type != "TXT" || len(records[0].Txt) != 1 || records[0].Txt[0] != "v=spf1 -all" {
+		t.Errorf("records = %+v", records)
+	}
+}
+
+func TestDnsHandlerAnswerA(t *testing.T) {
+	// the sensors only sending AnswerA have no rcode
+	store := &fakeStore{}
+	err := handle(t, DnsHandler{}, store, testMeta(), `{
+		"Proto": 17,
+		"AnswerA": [{"Hdr": {"Name": "example.com.", "Rrtype": 1, "Class": 1, "Ttl": 60, "Rdlength": 4}, "A": "10.0.0.1"}]
+	}`)
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if responses := inserted[TsDnsResponse](store); len(responses) != 0 {
+		t.Errorf("TsDnsResponse without rcode = %+v", responses)
+	}
+	records := inserted[TsDnsRecord](store)
+	if len(records) != 1 || !records[0].Address.Equal(net.ParseIP("10.0.0.1")) || records[0].Rdlength != 4 {
+		t.Errorf("records = %+v", records)
+	}
+}
+
+func TestDnsHandlerInvalid(t *testing.T) {
+	tests := []string{
+		`{"Rcode": 4242}`,
+		`{"Answer": ["example.com. 300 IN A not-an-ip"]}`,
+		`{"Response": "AAEC"}`,
+		`not json`,
+	}
+	for _, raw := range tests {
+		if err := handle(t, DnsHandler{}, &fakeStore{}, testMeta(), raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
+
+func TestDnsHandlerRcodeOnly(t *testing.T) {
+	store := &fakeStore{}
+	if err := handle(t, DnsHandler{}, store, testMeta(), `{"Rcode": 3}`); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	responses := inserted[TsDnsResponse](store)
+	if len(responses) != 1 || responses[0].Rcode != 3 || responses[0].RcodeName != "NXDOMAIN" {
+		t.Errorf("TsDnsResponse = %+v", responses)
+	}
+	if records := inserted[TsDnsRecord](store); len(records) != 0 {
+		t.Errorf("records = %+v", records)
+	}
+}
@@ -0,0 +1,203 @@
+// Package results decodes and stores the task results sent by the sensors.
+// Each task type is a ResultHandler registered by its task name, the server
+// dispatches the results to the handler of their task name.
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/sensor"
+	"gorm.io/gorm"
+)
+
+// Meta identifies the result being stored
+type Meta struct {
+	SensorID uuid.UUID
+	TaskID   uuid.UUID
+	// MeasuredAt is the time the result was produced by the sensor
+	MeasuredAt time.Time
+}
+
+// Reader reads what the handlers compare the result to, ok is false when there is nothing
+type Reader interface {
+	// HttpTarget returns the url checked by the http task and the body policy of its subscription
+	HttpTarget(taskId uuid.UUID) (HttpTarget, error)
+	// PreviousHttpBody returns the latest body with a hash of the url checked by the sensor before the time
+	PreviousHttpBody(sensorId uuid.UUID, url string, before time.Time) (body TsHttpBody, ok bool, err error)
+	// HttpResponseBody returns the response_body of ts_http_results stored for the check
+	HttpResponseBody(taskId uuid.UUID, sensorId uuid.UUID, at time.Time) (body string, ok bool, err error)
+	// PreviousTraceroutePath returns the latest path of the sensor to the target before the time
+	PreviousTraceroutePath(sensorId uuid.UUID, target net.IP, before time.Time) (path TsTraceroutePath, ok bool, err error)
+}
+
+// Store receives the rows of a result, they are inserted in the transaction of the result
+// together with the task status, with one statement per table.
+// Its reads see the rows of the transaction.
+type Store interface {
+	Reader
+	// Insert adds rows, a model or a slice of models
+	Insert(rows any)
+}
+
+// DBReader implements the Reader with the database, e.g. the transaction of the result
+type DBReader struct {
+	DB *gorm.DB
+}
+
+// ResultHandler handles the results of a task type
+type ResultHandler interface {
+	// TaskName is the task type handled, e.g. DNS_TASK
+	TaskName() sensor.TaskName
+	// Decode parses the result payload sent by the sensor
+	Decode(raw json.RawMessage) (any, error)
+	// Validate checks the decoded result before it is stored
+	Validate(res any) error
+	// Store passes the rows of the decoded result to the store
+	Store(ctx context.Context, store Store, meta Meta, res any) error
+}
+
+// PreStorer is implemented by the handlers with I/O to do before the transaction of the result opens,
+// e.g. writing to the blob store, so the rows locked by the transaction are not held meanwhile.
+// The reader sees the committed rows only. The result returned is passed to Store and PostProcess in place of res.
+type PreStorer interface {
+	PreStore(ctx context.Context, reader Reader, meta Meta, res any) (any, error)
+}
+
+// PostProcessor is implemented by the handlers acting on a result once it is committed
+type PostProcessor interface {
+	PostProcess(ctx context.Context, meta Meta, res any) error
+}
+
+// Registry maps the task names to their handler
+type Registry struct {
+	lock     sync.RWMutex
+	handlers map[sensor.TaskName]ResultHandler
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[sensor.TaskName]ResultHandler)}
+}
+
+// Register adds the handler, a task name can only be registered once
+func (r *Registry) Register(h ResultHandler) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.handlers[h.TaskName()]; exists {
+		return fmt.Errorf("result handler of %v already registered", h.TaskName())
+	}
+	r.handlers[h.TaskName()] = h
+	return nil
+}
+
+// MustRegister adds the handler and panics if its task name is already registered
+func (r *Registry) MustRegister(h ResultHandler) {
+	if err := r.Register(h); err != nil {
+		panic(err)
+	}
+}
+
+// Replace registers the handler in place of the one of its task name, e.g. a handler configured by the server
+func (r *Registry) Replace(h ResultHandler) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handlers[h.TaskName()] = h
+}
+
+// Clone returns a registry with the same handlers, to be changed without affecting r
+func (r *Registry) Clone() *Registry {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	clone := NewRegistry()
+	for name, h := range r.handlers {
+		clone.handlers[name] = h
+	}
+	return clone
+}
+
+// Lookup returns the handler of the task name
+func (r *Registry) Lookup(taskName sensor.TaskName) (h ResultHandler, ok bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	h, ok = r.handlers[taskName]
+	return
+}
+
+// TaskNames returns the registered task names, sorted
+func (r *Registry) TaskNames() (names []sensor.TaskName) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for name := range r.handlers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return
+}
+
+// Default is the registry used by the server, the built-in task types register into it
+var Default = NewRegistry()
+
+// Register adds the handler to the Default registry, it panics if its task name is already registered
+func Register(h ResultHandler) {
+	Default.MustRegister(h)
+}
+
+// decodeJson is the Decode of the handlers whose result is a plain json document
+func decodeJson[T any](raw json.RawMessage) (any, error) {
+	var res T
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("unmarshal %T err:%v", res, err)
+	}
+	return res, nil
+}
+
+// decoded asserts the type of the result returned by Decode
+func decoded[T any](res any) (T, error) {
+	typed, ok := res.(T)
+	if !ok {
+		return typed, fmt.Errorf("unexpected result type %T, expected %T", res, typed)
+	}
+	return typed, nil
+}
+
+// sanitizeText keeps the first maxLength bytes of valid text, Postgres rejects the NUL bytes
+func sanitizeText(text string, maxLength int) string {
+	text = strings.ReplaceAll(strings.ToValidUTF8(text, ""), "\x00", "")
+	if len(text) > maxLength {
+		text = strings.ToValidUTF8(text[:maxLength], "")
+	}
+	return text
+}
+
+// sanitizeTexts keeps the first maxCount texts, each sanitized as by sanitizeText
+func sanitizeTexts(texts []string, maxCount int, maxLength int) []string {
+	if texts == nil {
+		return nil
+	}
+	if len(texts) > maxCount {
+		texts = texts[:maxCount]
+	}
+	sanitized := make([]string, 0, len(texts))
+	for _, text := range texts {
+		sanitized = append(sanitized, sanitizeText(text, maxLength))
+	}
+	return sanitized
+}
+
+// taskBase is the common part of the result rows
+func taskBase(meta Meta) models.TsSensorTaskBase {
+	return models.TsSensorTaskBase{
+		Time:     meta.MeasuredAt,
+		SensorID: meta.SensorID,
+		TaskID:   meta.TaskID,
+	}
+}
@@ -0,0 +1,201 @@
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/sensor"
+)
+
+// fakeStore collects the rows in memory, the previous results are set by the tests
+type fakeStore struct {
+	rows   []any
+	target HttpTarget
+	// bodies and paths are the previous results
+	bodies []TsHttpBody
+	// responseBodies are the response_body of ts_http_results, by task id
+	responseBodies map[uuid.UUID]string
+	paths          []TsTraceroutePath
+}
+
+func (s *fakeStore) Insert(rows any) { s.rows = append(s.rows, rows) }
+
+func (s *fakeStore) HttpTarget(taskId uuid.UUID) (HttpTarget, error) { return s.target, nil }
+
+func (s *fakeStore) PreviousHttpBody(sensorId uuid.UUID, url string, before time.Time) (body TsHttpBody, ok bool, err error) {
+	for _, b := range s.bodies {
+		if b.SensorID == sensorId && b.Url == url && b.Time.Before(before) && b.BodySha256 != "" && (!ok || b.Time.After(body.Time)) {
+			body, ok = b, true
+		}
+	}
+	return
+}
+
+func (s *fakeStore) HttpResponseBody(taskId uuid.UUID, sensorId uuid.UUID, at time.Time) (body string, ok bool, err error) {
+	body, ok = s.responseBodies[taskId]
+	return
+}
+
+func (s *fakeStore) PreviousTraceroutePath(sensorId uuid.UUID, target net.IP, before time.Time) (path TsTraceroutePath, ok bool, err error) {
+	for _, p := range s.paths {
+		if p.SensorID == sensorId && p.Target.Equal(target) && p.Time.Before(before) && (!ok || p.Time.After(path.Time)) {
+			path, ok = p, true
+		}
+	}
+	return
+}
+
+// inserted returns the rows of type T passed to the store, alone or in slices
+func inserted[T any](s *fakeStore) (rows []T) {
+	for _, r := range s.rows {
+		switch typed := r.(type) {
+		case T:
+			rows = append(rows, typed)
+		case []T:
+			rows = append(rows, typed...)
+		}
+	}
+	return
+}
+
+// handle runs the handler on the json result like the server does: Decode, Validate then Store
+func handle(t *testing.T, h ResultHandler, store Store, meta Meta, raw string) error {
+	t.Helper()
+	res, err := h.Decode(json.RawMessage(raw))
+	if err != nil {
+		return err
+	}
+	if err := h.Validate(res); err != nil {
+		return err
+	}
+	if preStorer, ok := h.(PreStorer); ok {
+		if res, err = preStorer.PreStore(context.Background(), store, meta, res); err != nil {
+			return err
+		}
+	}
+	return h.Store(context.Background(), store, meta, res)
+}
+
+func testMeta() Meta {
+	return Meta{
+		SensorID:   uuid.New(),
+		TaskID:     uuid.New(),
+		MeasuredAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+// nopHandler is a handler of any task name, storing nothing
+type nopHandler struct {
+	name sensor.TaskName
+	id   int
+}
+
+func (h nopHandler) TaskName() sensor.TaskName                   { return h.name }
+func (nopHandler) Decode(raw json.RawMessage) (any, error)       { return raw, nil }
+func (nopHandler) Validate(res any) error                        { return nil }
+func (nopHandler) Store(context.Context, Store, Meta, any) error { return nil }
+
+func TestRegistryRegister(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(nopHandler{name: "PORT_TASK", id: 1}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := r.Register(nopHandler{name: "PORT_TASK", id: 2}); err == nil {
+		t.Fatal("Register of a task name already registered: expected an error")
+	}
+	h, _ := r.Lookup("PORT_TASK")
+	if h.(nopHandler).id != 1 {
+		t.Errorf("the duplicate replaced the handler: %+v", h)
+	}
+}
+
+func TestRegistryMustRegisterPanics(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(nopHandler{name: "PORT_TASK"})
+	defer func() {
+		if recover() == nil {
+			t.Error("MustRegister of a task name already registered: expected a panic")
+		}
+	}()
+	r.MustRegister(nopHandler{name: "PORT_TASK"})
+}
+
+func TestRegistryLookup(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(nopHandler{name: "PORT_TASK"})
+
+	if h, ok := r.Lookup("PORT_TASK"); !ok || h.TaskName() != "PORT_TASK" {
+		t.Errorf("Lookup(PORT_TASK) = %v, %v", h, ok)
+	}
+	if h, ok := r.Lookup("UNKNOWN_TASK"); ok {
+		t.Errorf("Lookup(UNKNOWN_TASK) = %v, expected no handler", h)
+	}
+}
+
+func TestRegistryReplaceAndClone(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(nopHandler{name: "PORT_TASK", id: 1})
+
+	clone := r.Clone()
+	clone.Replace(nopHandler{name: "PORT_TASK", id: 2})
+	clone.MustRegister(nopHandler{name: "OTHER_TASK"})
+
+	if h, _ := r.Lookup("PORT_TASK"); h.(nopHandler).id != 1 {
+		t.Errorf("Replace on the clone changed the original: %+v", h)
+	}
+	if h, _ := clone.Lookup("PORT_TASK"); h.(nopHandler).id != 2 {
+		t.Errorf("Replace: got %+v", h)
+	}
+	if names := r.TaskNames(); !reflect.DeepEqual(names, []sensor.TaskName{"PORT_TASK"}) {
+		t.Errorf("TaskNames of the original = %v", names)
+	}
+	if names := clone.TaskNames(); !reflect.DeepEqual(names, []sensor.TaskName{"OTHER_TASK", "PORT_TASK"}) {
+		t.Errorf("TaskNames of the clone = %v", names)
+	}
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	names := Default.TaskNames()
+	for _, name := range []sensor.TaskName{"DNS_TASK", "ICMP_TASK", "HTTP_TASK", "TRACEROUTE_TASK", TlsTaskName, TcpTaskName} {
+		if !slices.Contains(names, name) {
+			t.Errorf("%v is not registered in Default: %v", name, names)
+		}
+	}
+}
+
+func TestDecodedType(t *testing.T) {
+	for _, h := range []ResultHandler{DnsHandler{}, IcmpHandler{}, HttpHandler{}, TracerouteHandler{}, TlsHandler{}, TcpHandler{}} {
+		if err := h.Validate("not a result"); err == nil {
+			t.Errorf("%v: Validate of another type: expected an error", h.TaskName())
+		}
+		if err := h.Store(context.Background(), &fakeStore{}, testMeta(), 42); err == nil {
+			t.Errorf("%v: Store of another type: expected an error", h.TaskName())
+		}
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		text      string
+		maxLength int
+		expected  string
+	}{
+		{"220 smtp ready", 256, "220 smtp ready"},
+		{"a\x00b", 256, "ab"},
+		{"a\xffb", 256, "ab"},
+		{"abcdef", 3, "abc"},
+		// a multi-byte character is not cut
+		{"aé", 2, "a"},
+	}
+	for _, test := range tests {
+		if got := sanitizeText(test.text, test.maxLength); got != test.expected {
+			t.Errorf("sanitizeText(%q, %v) = %q, expected %q", test.text, test.maxLength, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package results
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/http"
+	"github.com/ping-42/42lib/sensor"
+	"github.com/ping-42/server/wsServer/blobstore"
+)
+
+// Storage policies of the http bodies
+const (
+	// HttpBodyNone keeps only the size of the body
+	HttpBodyNone = "none"
+	// HttpBodyHash keeps the size and the SHA-256 of the body
+	HttpBodyHash = "hash"
+	// HttpBodyTruncated keeps the start of the body in ts_http_results, with its size and hash
+	HttpBodyTruncated = "truncated"
+	// HttpBodyFull keeps the body in the blob store, referenced by its hash
+	HttpBodyFull = "full"
+)
+
+// DefaultHttpBodyMaxBytes is the length of the body kept by the truncated policy
+const DefaultHttpBodyMaxBytes = 64 << 10
+
+// maxDiffBytes bounds the bodies compared line by line for the diff summary
+const maxDiffBytes = 1 << 20
+
+// ValidHttpBodyPolicy tells if policy is one of the storage policies
+func ValidHttpBodyPolicy(policy string) bool {
+	switch policy {
+	case HttpBodyNone, HttpBodyHash, HttpBodyTruncated, HttpBodyFull:
+		return true
+	}
+	return false
+}
+
+// HttpBodyPolicy is the body storage policy of the http checks of a subscription
+type HttpBodyPolicy struct {
+	SubscriptionID uint64              `gorm:"primaryKey"`
+	Subscription   models.Subscription `gorm:"foreignKey:SubscriptionID"`
+	Policy         string
+	// MaxBytes is the length kept by the truncated policy, the default of the server when zero
+	MaxBytes  int
+	UpdatedAt time.Time
+}
+
+// TsHttpBody is the body of an http check, and its change since the previous check of the target by the sensor
+type TsHttpBody struct {
+	models.TsSensorTaskBase
+	SubscriptionID uint64
+	Url            string
+	Policy         string
+	BodySize       int
+	BodySha256     string
+	// BodyTruncated is set when the response_body of ts_http_results is not the whole body
+	BodyTruncated bool
+	// BlobStored is set when the body is in the blob store, under BlobKey(BodySha256)
+	BlobStored bool
+	// ContentChanged is set when the hash differs from PreviousSha256, the hash of the previous check
+	ContentChanged bool
+	PreviousSha256 string
+	// DiffSummary describes the change, e.g. "+3 -1 lines, 5120 -> 5168 bytes"
+	DiffSummary string
+}
+
+// BlobKey is the key of a body in the blob store, by its SHA-256
+func BlobKey(sha256Hex string) string {
+	return "sha256/" + sha256Hex[:2] + "/" + sha256Hex
+}
+
+func init() {
+	Register(HttpHandler{})
+}
+
+// HttpHandler stores the http results with their timings and headers, and their body by the policy of their subscription
+type HttpHandler struct {
+	// DefaultPolicy applies to the subscriptions without a body policy, HttpBodyTruncated when empty
+	DefaultPolicy string
+	// MaxBodyBytes is the length kept by the truncated policy, DefaultHttpBodyMaxBytes when zero
+	MaxBodyBytes int
+	// Blobs keeps the full bodies, without it the full policy is stored truncated
+	Blobs blobstore.Store
+}
+
+func (HttpHandler) TaskName() sensor.TaskName { return http.TaskName }
+
+func (HttpHandler) Decode(raw json.RawMessage) (any, error) { return decodeJson[http.Result](raw) }
+
+func (HttpHandler) Validate(res any) error {
+	_, err := decoded[http.Result](res)
+	return err
+}
+
+// preStoredHttpResult is an http result whose blob store I/O was done by PreStore
+type preStoredHttpResult struct {
+	http.Result
+	// blobSha256 is the hash of the body written to the blob store, empty when it was not written
+	blobSha256 string
+	// previousSha256 is the hash of the previous body read from the blob store, previousBody its content
+	previousSha256 string
+	previousBody   string
+}
+
+// PreStore writes the body kept by the full policy to the blob store, and reads the previous body to compare it to,
+// before the transaction of the result. The blob of a result rolled back is left unreferenced, which is harmless.
+func (h HttpHandler) PreStore(ctx context.Context, reader Reader, meta Meta, res any) (any, error) {
+	httpRes, err := decoded[http.Result](res)
+	if err != nil {
+		return nil, err
+	}
+	pre := preStoredHttpResult{Result: httpRes}
+	if h.Blobs == nil {
+		return pre, nil
+	}
+
+	target, err := reader.HttpTarget(meta.TaskID)
+	if err != nil {
+		return nil, err
+	}
+	policy, _ := h.policy(target)
+	if policy == HttpBodyNone {
+		return pre, nil
+	}
+
+	body := httpRes.ResponseBody
+	sha256Hex := bodySha256(body)
+	if policy == HttpBodyFull {
+		err = h.Blobs.Put(ctx, BlobKey(sha256Hex), []byte(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store the body %v: %v", sha256Hex, err)
+		}
+		pre.blobSha256 = sha256Hex
+	}
+
+	if target.Url == "" || len(body) > maxDiffBytes {
+		return pre, nil
+	}
+	prev, ok, err := reader.PreviousHttpBody(meta.SensorID, target.Url, meta.MeasuredAt)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !prev.BlobStored || prev.BodySha256 == sha256Hex || prev.BodySize > maxDiffBytes {
+		return pre, nil
+	}
+	// without the previous body the change is summarized by the sizes only
+	if data, err := h.Blobs.Get(ctx, BlobKey(prev.BodySha256)); err == nil {
+		pre.previousSha256 = prev.BodySha256
+		pre.previousBody = string(data)
+	}
+	return pre, nil
+}
+
+func (h HttpHandler) Store(ctx context.Context, store Store, meta Meta, res any) error {
+	pre, ok := res.(preStoredHttpResult)
+	if !ok {
+		httpRes, err := decoded[http.Result](res)
+		if err != nil {
+			return err
+		}
+		pre = preStoredHttpResult{Result: httpRes}
+	}
+	httpRes := pre.Result
+
+	headersJson, err := json.Marshal(httpRes.ResponseHeaders)
+	if err != nil {
+		return fmt.Errorf("Marshal httpRes.ResponseHeaders err:%v", err)
+	}
+
+	target, err := store.HttpTarget(meta.TaskID)
+	if err != nil {
+		return err
+	}
+	body, responseBody, err := h.storeBody(store, meta, target, pre)
+	if err != nil {
+		return err
+	}
+
+	store.Insert(models.TsHttpResult{
+		TsSensorTaskBase: taskBase(meta),
+		ResponseCode:     httpRes.ResponseCode,
+		DNSLookup:        httpRes.DNSLookup,
+		TCPConnection:    httpRes.TCPConnection,
+		TLSHandshake:     httpRes.TLSHandshake,
+		ServerProcessing: httpRes.ServerProcessing,
+		NameLookup:       httpRes.NameLookup,
+		Connect:          httpRes.Connect,
+		Pretransfer:      httpRes.Pretransfer,
+		StartTransfer:    httpRes.StartTransfer,
+		//
+		ResponseBody:    responseBody,
+		ResponseHeaders: headersJson,
+	})
+	store.Insert(body)
+	return nil
+}
+
+// HttpTarget is the checked url of a task, and the body policy of its subscription if any
+type HttpTarget struct {
+	SubscriptionID uint64
+	Url            string
+	Policy         *string
+	MaxBytes       *int
+}
+
+func (r DBReader) HttpTarget(taskId uuid.UUID) (target HttpTarget, err error) {
+	err = r.DB.Raw(`
+		SELECT t.subscription_id, t.opts->>'URL' AS url, p.policy, p.max_bytes
+		FROM tasks t
+		LEFT JOIN http_body_policies p ON p.subscription_id = t.subscription_id
+		WHERE t.id = ?`, taskId,
+	).Scan(&target).Error
+	if err != nil {
+		err = fmt.Errorf("failed to load the http target of task %v: %v", taskId, err)
+	}
+	return
+}
+
+// policy returns the body policy of the target and the length kept when truncated
+func (h HttpHandler) policy(target HttpTarget) (policy string, maxBytes int) {
+	policy = h.DefaultPolicy
+	if target.Policy != nil {
+		policy = *target.Policy
+	}
+	if !ValidHttpBodyPolicy(policy) {
+		policy = HttpBodyTruncated
+	}
+	if policy == HttpBodyFull && h.Blobs == nil {
+		policy = HttpBodyTruncated
+	}
+
+	maxBytes = h.MaxBodyBytes
+	if target.MaxBytes != nil && *target.MaxBytes > 0 {
+		maxBytes = *target.MaxBytes
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultHttpBodyMaxBytes
+	}
+	return
+}
+
+// storeBody applies the policy of the target to the body, it returns the body row and the text kept in ts_http_results.
+// The full bodies were written to the blob store by PreStore, a body that was not, e.g. as the policy changed
+// meanwhile, is stored truncated.
+func (h HttpHandler) storeBody(store Store, meta Meta, target HttpTarget, pre preStoredHttpResult) (row TsHttpBody, responseBody string, err error) {
+	body := pre.ResponseBody
+	policy, maxBytes := h.policy(target)
+	row = TsHttpBody{
+		TsSensorTaskBase: taskBase(meta),
+		SubscriptionID:   target.SubscriptionID,
+		Url:              target.Url,
+		Policy:           policy,
+		BodySize:         len(body),
+	}
+	if policy == HttpBodyNone {
+		return
+	}
+
+	row.BodySha256 = bodySha256(body)
+	if policy == HttpBodyFull && pre.blobSha256 != row.BodySha256 {
+		policy = HttpBodyTruncated
+		row.Policy = policy
+	}
+
+	switch policy {
+	case HttpBodyTruncated:
+		responseBody = sanitizeText(body, maxBytes)
+		row.BodyTruncated = responseBody != body
+	case HttpBodyFull:
+		row.BlobStored = true
+	}
+
+	err = h.detectChange(store, &row, body, pre)
+	return
+}
+
+// bodySha256 is the hex SHA-256 of the body, its key in the blob store
+func bodySha256(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// detectChange compares the body to the previous check of the same url by the same sensor,
+// the pages served to the sensors of different regions may differ
+func (h HttpHandler) detectChange(store Store, row *TsHttpBody, body string, pre preStoredHttpResult) error {
+	if row.Url == "" {
+		return nil
+	}
+	prev, ok, err := store.PreviousHttpBody(row.SensorID, row.Url, row.Time)
+	if err != nil || !ok {
+		return err
+	}
+
+	row.PreviousSha256 = prev.BodySha256
+	if prev.BodySha256 == row.BodySha256 {
+		return nil
+	}
+	row.ContentChanged = true
+	row.DiffSummary = fmt.Sprintf("%v -> %v bytes", prev.BodySize, row.BodySize)
+
+	// the lines are only compared when the previous body was kept
+	prevBody, ok := previousBody(store, prev, pre)
+	if !ok || len(prevBody) > maxDiffBytes || len(body) > maxDiffBytes {
+		return nil
+	}
+	if prev.BodyTruncated {
+		body = sanitizeText(body, len(prevBody))
+	}
+	added, removed := diffLines(prevBody, body)
+	row.DiffSummary = fmt.Sprintf("+%v -%v lines, %v", added, removed, row.DiffSummary)
+	return nil
+}
+
+// previousBody returns the body kept by the previous check, read from the blob store by PreStore, or from ts_http_results.
+// The blob of a previous check not committed yet when PreStore ran, e.g. earlier in the same flush, was not read.
+func previousBody(store Store, prev TsHttpBody, pre preStoredHttpResult) (body string, ok bool) {
+	switch {
+	case prev.BlobStored:
+		if pre.previousSha256 == "" || pre.previousSha256 != prev.BodySha256 {
+			return "", false
+		}
+		return pre.previousBody, true
+	case prev.Policy == HttpBodyTruncated:
+		body, ok, err := store.HttpResponseBody(prev.TaskID, prev.SensorID, prev.Time)
+		if err != nil {
+			return "", false
+		}
+		return body, ok
+	}
+	return "", false
+}
+
+func (r DBReader) PreviousHttpBody(sensorId uuid.UUID, url string, before time.Time) (body TsHttpBody, ok bool, err error) {
+	res := r.DB.Where("sensor_id = ? AND url = ? AND time < ? AND body_sha256 <> ''", sensorId, url, before).
+		Order("time DESC").
+		Limit(1).
+		Find(&body)
+	if res.Error != nil {
+		return body, false, fmt.Errorf("failed to load the previous body of %v: %v", url, res.Error)
+	}
+	return body, res.RowsAffected > 0, nil
+}
+
+func (r DBReader) HttpResponseBody(taskId uuid.UUID, sensorId uuid.UUID, at time.Time) (body string, ok bool, err error) {
+	var bodies []string
+	err = r.DB.Model(&models.TsHttpResult{}).
+		Where("task_id = ? AND sensor_id = ? AND time = ?", taskId, sensorId, at).
+		Limit(1).
+		Pluck("response_body", &bodies).Error
+	if err != nil {
+		return "", false, fmt.Errorf("failed to load the response body of task %v: %v", taskId, err)
+	}
+	if len(bodies) == 0 {
+		return "", false, nil
+	}
+	return bodies[0], true, nil
+}
+
+// diffLines counts the lines of cur missing from prev, and of prev missing from cur, regardless of their order
+func diffLines(prev, cur string) (added, removed int) {
+	counts := make(map[string]int)
+	for _, line := range strings.Split(prev, "\n") {
+		counts[line]++
+	}
+	for _, line := range strings.Split(cur, "\n") {
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		added++
+	}
+	for _, n := range counts {
+		removed += n
+	}
+	return
+}
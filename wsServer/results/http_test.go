@@ -0,0 +1,227 @@
+package results
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/server/wsServer/blobstore"
+)
+
+// memBlobs is a blobstore.Store in memory
+type memBlobs map[string][]byte
+
+func (b memBlobs) Put(ctx context.Context, key string, data []byte) error {
+	b[key] = data
+	return nil
+}
+
+func (b memBlobs) Get(ctx context.Context, key string) ([]byte, error) {
+	data, ok := b[key]
+	if !ok {
+		return nil, blobstore.ErrNotFound
+	}
+	return data, nil
+}
+
+func sha256Of(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func httpResult(t *testing.T, body string) string {
+	t.Helper()
+	raw, err := json.Marshal(map[string]any{
+		"ResponseCode":    200,
+		"ResponseBody":    body,
+		"ResponseHeaders": map[string][]string{"Content-Type": {"text/html"}},
+		"DNSLookup":       int64(3 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func policyOf(policy string) *string { return &policy }
+
+func TestHttpHandlerTruncated(t *testing.T) {
+	maxBytes := 8
+	store := &fakeStore{target: HttpTarget{SubscriptionID: 7, Url: "https://example.com/", MaxBytes: &maxBytes}}
+	meta := testMeta()
+	body := "0123456789\x00abc"
+	if err := handle(t, HttpHandler{}, store, meta, httpResult(t, body)); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+
+	results := inserted[models.TsHttpResult](store)
+	if len(results) != 1 || results[0].ResponseCode != 200 || results[0].ResponseBody != "01234567" || results[0].DNSLookup != 3*time.Millisecond {
+		t.Fatalf("TsHttpResult = %+v", results)
+	}
+	if !strings.Contains(string(results[0].ResponseHeaders), "text/html") {
+		t.Errorf("ResponseHeaders = %s", results[0].ResponseHeaders)
+	}
+	bodies := inserted[TsHttpBody](store)
+	if len(bodies) != 1 {
+		t.Fatalf("TsHttpBody = %+v", bodies)
+	}
+	row := bodies[0]
+	if row.Policy != HttpBodyTruncated || !row.BodyTruncated || row.BodySize != len(body) || row.BodySha256 != sha256Of(body) {
+		t.Errorf("body row = %+v", row)
+	}
+	if row.SubscriptionID != 7 || row.Url != "https://example.com/" || row.ContentChanged {
+		t.Errorf("body row = %+v", row)
+	}
+}
+
+func TestHttpHandlerPolicies(t *testing.T) {
+	body := "<html>hello</html>"
+	tests := []struct {
+		policy        *string
+		handler       HttpHandler
+		expected      string
+		responseBody  string
+		hashed        bool
+		expectedBlobs int
+	}{
+		// the default of the server applies without a policy of the subscription
+		{nil, HttpHandler{DefaultPolicy: HttpBodyHash}, HttpBodyHash, "", true, 0},
+		{policyOf(HttpBodyNone), HttpHandler{}, HttpBodyNone, "", false, 0},
+		{policyOf(HttpBodyHash), HttpHandler{}, HttpBodyHash, "", true, 0},
+		{policyOf("unknown"), HttpHandler{}, HttpBodyTruncated, body, true, 0},
+		// the full policy is stored truncated without a blob store
+		{policyOf(HttpBodyFull), HttpHandler{}, HttpBodyTruncated, body, true, 0},
+		{policyOf(HttpBodyFull), HttpHandler{Blobs: memBlobs{}}, HttpBodyFull, "", true, 1},
+	}
+	for _, test := range tests {
+		store := &fakeStore{target: HttpTarget{Url: "https://example.com/", Policy: test.policy}}
+		if err := handle(t, test.handler, store, testMeta(), httpResult(t, body)); err != nil {
+			t.Fatalf("%v: handle: %v", test.expected, err)
+		}
+		row := inserted[TsHttpBody](store)[0]
+		if row.Policy != test.expected || (row.BodySha256 != "") != test.hashed || row.BodySize != len(body) {
+			t.Errorf("policy %v: body row = %+v", test.expected, row)
+		}
+		if got := inserted[models.TsHttpResult](store)[0].ResponseBody; got != test.responseBody {
+			t.Errorf("policy %v: response body = %q", test.expected, got)
+		}
+		if blobs, ok := test.handler.Blobs.(memBlobs); ok {
+			if len(blobs) != test.expectedBlobs || string(blobs[BlobKey(sha256Of(body))]) != body || !row.BlobStored {
+				t.Errorf("policy %v: blobs = %v, row = %+v", test.expected, blobs, row)
+			}
+		}
+	}
+}
+
+func TestHttpHandlerContentChange(t *testing.T) {
+	meta := testMeta()
+	url := "https://example.com/"
+	prevBody := "line 1\nline 2\nline 3"
+	prev := TsHttpBody{
+		TsSensorTaskBase: taskBase(Meta{SensorID: meta.SensorID, TaskID: meta.TaskID, MeasuredAt: meta.MeasuredAt.Add(-time.Minute)}),
+		Url:              url,
+		Policy:           HttpBodyTruncated,
+		BodySize:         len(prevBody),
+		BodySha256:       sha256Of(prevBody),
+	}
+
+	store := &fakeStore{
+		target:         HttpTarget{Url: url},
+		bodies:         []TsHttpBody{prev},
+		responseBodies: map[uuid.UUID]string{},
+	}
+	store.responseBodies[prev.TaskID] = prevBody
+
+	body := "line 1\nline 2 changed\nline 3\nline 4"
+	if err := handle(t, HttpHandler{}, store, meta, httpResult(t, body)); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	row := inserted[TsHttpBody](store)[0]
+	if !row.ContentChanged || row.PreviousSha256 != prev.BodySha256 {
+		t.Errorf("body row = %+v", row)
+	}
+	if expected := "+2 -1 lines, 20 -> 35 bytes"; row.DiffSummary != expected {
+		t.Errorf("DiffSummary = %q, expected %q", row.DiffSummary, expected)
+	}
+
+	// the same body again is not a change
+	store = &fakeStore{target: HttpTarget{Url: url}, bodies: []TsHttpBody{prev}}
+	if err := handle(t, HttpHandler{}, store, meta, httpResult(t, prevBody)); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if row := inserted[TsHttpBody](store)[0]; row.ContentChanged || row.PreviousSha256 != prev.BodySha256 || row.DiffSummary != "" {
+		t.Errorf("unchanged body row = %+v", row)
+	}
+}
+
+func TestHttpHandlerContentChangeFromBlob(t *testing.T) {
+	meta := testMeta()
+	url := "https://example.com/"
+	prevBody := "a\nb"
+	blobs := memBlobs{BlobKey(sha256Of(prevBody)): []byte(prevBody)}
+	prev := TsHttpBody{
+		TsSensorTaskBase: taskBase(Meta{SensorID: meta.SensorID, MeasuredAt: meta.MeasuredAt.Add(-time.Hour)}),
+		Url:              url,
+		Policy:           HttpBodyFull,
+		BodySize:         len(prevBody),
+		BodySha256:       sha256Of(prevBody),
+		BlobStored:       true,
+	}
+	// the checks of another sensor are not compared
+	other := prev
+	other.SensorID = uuid.New()
+	other.Time = meta.MeasuredAt.Add(-time.Second)
+	other.BodySha256 = sha256Of("other")
+
+	store := &fakeStore{target: HttpTarget{Url: url, Policy: policyOf(HttpBodyFull)}, bodies: []TsHttpBody{prev, other}}
+	if err := handle(t, HttpHandler{Blobs: blobs}, store, meta, httpResult(t, "a\nc")); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	row := inserted[TsHttpBody](store)[0]
+	if !row.ContentChanged || row.PreviousSha256 != prev.BodySha256 || row.DiffSummary != "+1 -1 lines, 3 -> 3 bytes" {
+		t.Errorf("body row = %+v", row)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		prev, cur      string
+		added, removed int
+	}{
+		{"a\nb", "a\nb", 0, 0},
+		{"a\nb", "b\na", 0, 0},
+		{"a", "a\nb\nc", 2, 0},
+		{"a\na\nb", "a\nb", 0, 1},
+	}
+	for _, test := range tests {
+		added, removed := diffLines(test.prev, test.cur)
+		if added != test.added || removed != test.removed {
+			t.Errorf("diffLines(%q, %q) = +%v -%v, expected +%v -%v", test.prev, test.cur, added, removed, test.added, test.removed)
+		}
+	}
+}
+
+func TestHttpHandlerStoreWithoutPreStore(t *testing.T) {
+	// Store does no blob store I/O, a full body not written by PreStore is stored truncated
+	blobs := memBlobs{}
+	store := &fakeStore{target: HttpTarget{Url: "https://example.com/", Policy: policyOf(HttpBodyFull)}}
+	res, err := HttpHandler{}.Decode(json.RawMessage(httpResult(t, "<html>hello</html>")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (HttpHandler{Blobs: blobs}).Store(context.Background(), store, testMeta(), res); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if row := inserted[TsHttpBody](store)[0]; row.Policy != HttpBodyTruncated || row.BlobStored || len(blobs) != 0 {
+		t.Errorf("body row = %+v, blobs = %v", row, blobs)
+	}
+	if got := inserted[models.TsHttpResult](store)[0].ResponseBody; got != "<html>hello</html>" {
+		t.Errorf("response body = %q", got)
+	}
+}
@@ -0,0 +1,63 @@
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/icmp"
+	"github.com/ping-42/42lib/sensor"
+)
+
+func init() {
+	Register(IcmpHandler{})
+}
+
+// IcmpHandler stores the ping results per target IP, and the resolution of the target if any
+type IcmpHandler struct{}
+
+func (IcmpHandler) TaskName() sensor.TaskName { return icmp.TaskName }
+
+func (IcmpHandler) Decode(raw json.RawMessage) (any, error) { return decodeJson[icmp.Result](raw) }
+
+func (IcmpHandler) Validate(res any) error {
+	_, err := decoded[icmp.Result](res)
+	return err
+}
+
+func (IcmpHandler) Store(ctx context.Context, store Store, meta Meta, res any) error {
+	icmpRes, err := decoded[icmp.Result](res)
+	if err != nil {
+		return err
+	}
+
+	// store DNS task result in case we have domain in the opts
+	if icmpRes.DnsResult.Proto != 0 { // todo implement check for empty
+		dnsRes := DnsResult{Result: icmpRes.DnsResult}
+		if err := dnsRes.parseRecords(); err != nil {
+			return err
+		}
+		storeDnsResult(store, meta, dnsRes)
+	}
+
+	rows := make([]models.TsIcmpResult, 0, len(icmpRes.ResultPerIp))
+	for _, res := range icmpRes.ResultPerIp {
+		rows = append(rows, models.TsIcmpResult{
+			TsSensorTaskBase: taskBase(meta),
+			IPAddr:           res.IPAddr,
+			PacketsSent:      res.PacketsSent,
+			PacketsReceived:  res.PacketsReceived,
+			BytesWritten:     res.BytesWritten,
+			BytesRead:        res.BytesRead,
+			TotalRTT:         res.TotalRTT,
+			MinRTT:           res.MinRTT,
+			MaxRTT:           res.MaxRTT,
+			AverageRTT:       res.AverageRTT,
+			Loss:             res.Loss,
+			FailureMessages:  strings.Join(res.FailureMessages, ";"),
+		})
+	}
+	store.Insert(rows)
+	return nil
+}
@@ -0,0 +1,58 @@
+package results
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ping-42/42lib/db/models"
+)
+
+func TestIcmpHandler(t *testing.T) {
+	store := &fakeStore{}
+	meta := testMeta()
+	err := handle(t, IcmpHandler{}, store, meta, `{
+		"ResultPerIp": {
+			"10.0.0.1": {"IPAddr": "10.0.0.1", "PacketsSent": 4, "PacketsReceived": 3, "AverageRTT": 2000000, "Loss": 25,
+				"FailureMessages": ["timeout", "timeout"]}
+		}
+	}`)
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+
+	rows := inserted[models.TsIcmpResult](store)
+	if len(rows) != 1 {
+		t.Fatalf("expected 1 row, got %+v", rows)
+	}
+	row := rows[0]
+	if !row.IPAddr.Equal(net.ParseIP("10.0.0.1")) || row.PacketsSent != 4 || row.PacketsReceived != 3 || row.Loss != 25 {
+		t.Errorf("row = %+v", row)
+	}
+	if row.FailureMessages != "timeout;timeout" {
+		t.Errorf("FailureMessages = %q", row.FailureMessages)
+	}
+	if row.SensorID != meta.SensorID || !row.Time.Equal(meta.MeasuredAt) {
+		t.Errorf("task base = %+v", row.TsSensorTaskBase)
+	}
+	// no resolution without a domain target
+	if dns := inserted[models.TsDnsResult](store); len(dns) != 0 {
+		t.Errorf("TsDnsResult = %+v", dns)
+	}
+}
+
+func TestIcmpHandlerResolution(t *testing.T) {
+	store := &fakeStore{}
+	err := handle(t, IcmpHandler{}, store, testMeta(), `{
+		"ResultPerIp": {},
+		"DnsResult": {"Proto": 17, "AnswerA": [{"Hdr": {"Name": "example.com.", "Rrtype": 1, "Class": 1, "Ttl": 60}, "A": "10.0.0.1"}]}
+	}`)
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if dns := inserted[models.TsDnsResult](store); len(dns) != 1 || dns[0].Proto != 17 {
+		t.Errorf("TsDnsResult = %+v", dns)
+	}
+	if records := inserted[TsDnsRecord](store); len(records) != 1 || !records[0].Address.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("TsDnsRecord = %+v", records)
+	}
+}
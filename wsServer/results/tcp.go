@@ -0,0 +1,166 @@
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/sensor"
+	"gorm.io/gorm"
+)
+
+// TcpTaskName is the task type of the TCP connect checks
+const TcpTaskName sensor.TaskName = "TCP_TASK"
+
+// maxBannerLength is the part of the banner kept, the first bytes identify the service
+const maxBannerLength = 256
+
+// maxTcpErrorLength bounds the error of the sensor kept
+const maxTcpErrorLength = 1024
+
+// Error classes of a failed TCP connect
+const (
+	TcpErrorRefused     = "refused"
+	TcpErrorTimeout     = "timeout"
+	TcpErrorUnreachable = "unreachable"
+	TcpErrorDns         = "dns"
+	TcpErrorOther       = "other"
+)
+
+var tcpErrorClasses = map[string]bool{
+	TcpErrorRefused:     true,
+	TcpErrorTimeout:     true,
+	TcpErrorUnreachable: true,
+	TcpErrorDns:         true,
+	TcpErrorOther:       true,
+}
+
+// TcpResult is a TCP connect to a target, sent by the sensor
+type TcpResult struct {
+	Host string
+	Port int
+	// Address is the resolved IP the sensor connected to
+	Address     net.IP
+	ConnectTime time.Duration
+	Success     bool
+	// ErrorClass is set when the connect failed, Error is the error of the sensor
+	ErrorClass string
+	Error      string
+	// Banner is the optional start of what the service sent first, e.g. the SMTP greeting
+	Banner string
+}
+
+// TsTcpResult is a TCP connect check
+type TsTcpResult struct {
+	models.TsSensorTaskBase
+	Host        string
+	Port        int
+	Address     net.IP `gorm:"type:inet"`
+	ConnectTime time.Duration
+	Success     bool
+	ErrorClass  string
+	Error       string
+	Banner      string
+}
+
+func init() {
+	Register(TcpHandler{})
+}
+
+// TcpHandler stores the TCP connect checks
+type TcpHandler struct{}
+
+func (TcpHandler) TaskName() sensor.TaskName { return TcpTaskName }
+
+func (TcpHandler) Decode(raw json.RawMessage) (any, error) { return decodeJson[TcpResult](raw) }
+
+func (TcpHandler) Validate(res any) error {
+	tcpRes, err := decoded[TcpResult](res)
+	if err != nil {
+		return err
+	}
+	if tcpRes.Host == "" {
+		return errors.New("missing host")
+	}
+	if tcpRes.Port <= 0 || tcpRes.Port > 65535 {
+		return fmt.Errorf("invalid port %v", tcpRes.Port)
+	}
+	if tcpRes.ConnectTime < 0 {
+		return fmt.Errorf("negative connect time %v", tcpRes.ConnectTime)
+	}
+	if tcpRes.Success && tcpRes.ErrorClass != "" {
+		return fmt.Errorf("successful connect with error class %q", tcpRes.ErrorClass)
+	}
+	if !tcpRes.Success && !tcpErrorClasses[tcpRes.ErrorClass] {
+		return fmt.Errorf("failed connect with unknown error class %q", tcpRes.ErrorClass)
+	}
+	return nil
+}
+
+func (TcpHandler) Store(ctx context.Context, store Store, meta Meta, res any) error {
+	tcpRes, err := decoded[TcpResult](res)
+	if err != nil {
+		return err
+	}
+
+	store.Insert(TsTcpResult{
+		TsSensorTaskBase: taskBase(meta),
+		Host:             tcpRes.Host,
+		Port:             tcpRes.Port,
+		Address:          tcpRes.Address,
+		ConnectTime:      tcpRes.ConnectTime,
+		Success:          tcpRes.Success,
+		ErrorClass:       tcpRes.ErrorClass,
+		Error:            sanitizeText(tcpRes.Error, maxTcpErrorLength),
+		Banner:           sanitizeBanner(tcpRes.Banner),
+	})
+	return nil
+}
+
+// sanitizeBanner keeps the first maxBannerLength bytes of valid text
+func sanitizeBanner(banner string) string {
+	return sanitizeText(banner, maxBannerLength)
+}
+
+// TcpReachability summarizes the checks of a target by a sensor
+type TcpReachability struct {
+	SensorID        uuid.UUID
+	Checks          int
+	Successes       int
+	AvgConnectTime  time.Duration
+	LastCheck       time.Time
+	LastSuccess     *time.Time
+	LastErrorClass  string
+	LastBanner      string
+	SuccessRatioPct float64
+}
+
+// GetTcpReachability returns the checks of host:port since since, by sensor
+func GetTcpReachability(db *gorm.DB, host string, port int, since time.Time) (reachability []TcpReachability, err error) {
+	err = db.Raw(`
+		SELECT sensor_id,
+			COUNT(*) AS checks,
+			COUNT(*) FILTER (WHERE success) AS successes,
+			COALESCE(AVG(connect_time) FILTER (WHERE success), 0)::bigint AS avg_connect_time,
+			MAX(time) AS last_check,
+			MAX(time) FILTER (WHERE success) AS last_success,
+			COALESCE((ARRAY_AGG(error_class ORDER BY time DESC) FILTER (WHERE NOT success))[1], '') AS last_error_class,
+			COALESCE((ARRAY_AGG(banner ORDER BY time DESC) FILTER (WHERE banner <> ''))[1], '') AS last_banner
+		FROM ts_tcp_results
+		WHERE host = ? AND port = ? AND time >= ?
+		GROUP BY sensor_id
+		ORDER BY sensor_id`, host, port, since,
+	).Scan(&reachability).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the reachability of %v: %v", net.JoinHostPort(host, fmt.Sprint(port)), err)
+	}
+	for i := range reachability {
+		reachability[i].SuccessRatioPct = 100 * float64(reachability[i].Successes) / float64(reachability[i].Checks)
+	}
+	return
+}
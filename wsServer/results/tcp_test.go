@@ -0,0 +1,61 @@
+package results
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTcpHandler(t *testing.T) {
+	store := &fakeStore{}
+	meta := testMeta()
+	banner := "220 mail.example.com ESMTP\x00" + strings.Repeat("x", 300)
+	raw := `{"Host": "mail.example.com", "Port": 25, "Address": "10.0.0.1", "ConnectTime": 5000000, "Success": true, "Banner": "` +
+		strings.ReplaceAll(banner, "\x00", `\u0000`) + `"}`
+	if err := handle(t, TcpHandler{}, store, meta, raw); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+
+	rows := inserted[TsTcpResult](store)
+	if len(rows) != 1 {
+		t.Fatalf("TsTcpResult = %+v", rows)
+	}
+	row := rows[0]
+	if row.Host != "mail.example.com" || row.Port != 25 || !row.Address.Equal(net.ParseIP("10.0.0.1")) || row.ConnectTime != 5*time.Millisecond || !row.Success {
+		t.Errorf("TsTcpResult = %+v", row)
+	}
+	if len(row.Banner) != maxBannerLength || !strings.HasPrefix(row.Banner, "220 mail.example.com ESMTPxx") {
+		t.Errorf("Banner = %q", row.Banner)
+	}
+	if row.TaskID != meta.TaskID {
+		t.Errorf("task base = %+v", row.TsSensorTaskBase)
+	}
+}
+
+func TestTcpHandlerFailed(t *testing.T) {
+	store := &fakeStore{}
+	if err := handle(t, TcpHandler{}, store, testMeta(), `{"Host": "example.com", "Port": 22, "ErrorClass": "refused", "Error": "connection\u0000 refused"}`); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if row := inserted[TsTcpResult](store)[0]; row.Success || row.ErrorClass != TcpErrorRefused || row.Error != "connection refused" {
+		t.Errorf("TsTcpResult = %+v", row)
+	}
+}
+
+func TestTcpHandlerInvalid(t *testing.T) {
+	tests := []string{
+		`{"Port": 22, "Success": true}`,
+		`{"Host": "example.com", "Port": 0, "Success": true}`,
+		`{"Host": "example.com", "Port": 65536, "Success": true}`,
+		`{"Host": "example.com", "Port": 22, "Success": true, "ConnectTime": -1}`,
+		`{"Host": "example.com", "Port": 22, "Success": true, "ErrorClass": "refused"}`,
+		`{"Host": "example.com", "Port": 22, "ErrorClass": "firewall"}`,
+		`{"Host": "example.com", "Port": 22}`,
+	}
+	for _, raw := range tests {
+		if err := handle(t, TcpHandler{}, &fakeStore{}, testMeta(), raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
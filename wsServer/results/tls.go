@@ -0,0 +1,268 @@
+package results
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/sensor"
+	"gorm.io/gorm"
+)
+
+// TlsTaskName is the task type of the TLS inspections
+const TlsTaskName sensor.TaskName = "TLS_TASK"
+
+// Bounds of the texts sent by the sensor that are kept, they are also cleared of NUL bytes and invalid UTF-8
+const (
+	// maxTlsNameLength bounds the host, the negotiated names, the serial number and the fingerprints
+	maxTlsNameLength = 256
+	// maxTlsTextLength bounds the subject, the issuer and the errors
+	maxTlsTextLength = 1024
+	// maxTlsListLength bounds the verification errors and the SANs of a certificate
+	maxTlsListLength = 100
+)
+
+// TlsResult is the TLS inspection of a target, sent by the sensor
+type TlsResult struct {
+	// Host is the target host name, sent as SNI
+	Host    string
+	Port    int
+	Address net.IP
+	// Version and CipherSuite negotiated, e.g. "TLS 1.3" and "TLS_AES_128_GCM_SHA256"
+	Version     string
+	CipherSuite string
+	// OcspStapled is set when the server stapled an OCSP response, OcspStatus is its status: good, revoked or unknown
+	OcspStapled bool
+	OcspStatus  string
+	// Certificates sent by the server, the leaf first
+	Certificates []TlsCertificate
+	// VerificationErrors of the chain against the system roots and the host name, empty when valid
+	VerificationErrors []string
+	// Error of the connection or handshake, the other fields are empty then
+	Error string
+}
+
+// TlsCertificate is a certificate of the chain. When Der is sent,
+// the other fields are read from it and the fingerprints are computed by the server.
+type TlsCertificate struct {
+	Der                []byte
+	Subject            string
+	Issuer             string
+	SerialNumber       string
+	DnsNames           []string
+	IpAddresses        []string
+	NotBefore          time.Time
+	NotAfter           time.Time
+	SignatureAlgorithm string
+	IsCA               bool
+	FingerprintSha256  string
+	FingerprintSha1    string
+}
+
+// TsTlsResult is a TLS inspection, the leaf expiry is kept for the expiry queries
+type TsTlsResult struct {
+	models.TsSensorTaskBase
+	Host               string
+	Port               int
+	Address            net.IP `gorm:"type:inet"`
+	Version            string
+	CipherSuite        string
+	OcspStapled        bool
+	OcspStatus         string
+	Verified           bool
+	VerificationErrors []string   `gorm:"type:jsonb;serializer:json"`
+	LeafNotAfter       *time.Time `gorm:"type:TIMESTAMPTZ;"`
+	Error              string
+}
+
+// TsTlsCertificate is a certificate of an inspected chain, Position 0 is the leaf
+type TsTlsCertificate struct {
+	models.TsSensorTaskBase
+	Host               string
+	Port               int
+	Position           int
+	Subject            string
+	Issuer             string
+	SerialNumber       string
+	DnsNames           []string  `gorm:"type:jsonb;serializer:json"`
+	IpAddresses        []string  `gorm:"type:jsonb;serializer:json"`
+	NotBefore          time.Time `gorm:"type:TIMESTAMPTZ;"`
+	NotAfter           time.Time `gorm:"type:TIMESTAMPTZ;"`
+	SignatureAlgorithm string
+	IsCA               bool
+	FingerprintSha256  string
+	FingerprintSha1    string
+}
+
+func init() {
+	Register(TlsHandler{})
+}
+
+// TlsHandler stores the TLS inspections and their certificates
+type TlsHandler struct{}
+
+func (TlsHandler) TaskName() sensor.TaskName { return TlsTaskName }
+
+// Decode parses the result, and the certificates sent as DER
+func (TlsHandler) Decode(raw json.RawMessage) (any, error) {
+	var res TlsResult
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("unmarshal %T err:%v", res, err)
+	}
+	for i := range res.Certificates {
+		if len(res.Certificates[i].Der) == 0 {
+			continue
+		}
+		if err := res.Certificates[i].parseDer(); err != nil {
+			return nil, fmt.Errorf("certificate %v: %v", i, err)
+		}
+	}
+	return res, nil
+}
+
+func (TlsHandler) Validate(res any) error {
+	tlsRes, err := decoded[TlsResult](res)
+	if err != nil {
+		return err
+	}
+	if tlsRes.Host == "" {
+		return errors.New("missing host")
+	}
+	if tlsRes.Port <= 0 || tlsRes.Port > 65535 {
+		return fmt.Errorf("invalid port %v", tlsRes.Port)
+	}
+	for i, cert := range tlsRes.Certificates {
+		if cert.NotAfter.IsZero() || cert.NotBefore.IsZero() {
+			return fmt.Errorf("certificate %v without validity dates", i)
+		}
+	}
+	return nil
+}
+
+func (TlsHandler) Store(ctx context.Context, store Store, meta Meta, res any) error {
+	tlsRes, err := decoded[TlsResult](res)
+	if err != nil {
+		return err
+	}
+
+	host := sanitizeText(tlsRes.Host, maxTlsNameLength)
+	row := TsTlsResult{
+		TsSensorTaskBase:   taskBase(meta),
+		Host:               host,
+		Port:               tlsRes.Port,
+		Address:            tlsRes.Address,
+		Version:            sanitizeText(tlsRes.Version, maxTlsNameLength),
+		CipherSuite:        sanitizeText(tlsRes.CipherSuite, maxTlsNameLength),
+		OcspStapled:        tlsRes.OcspStapled,
+		OcspStatus:         sanitizeText(tlsRes.OcspStatus, maxTlsNameLength),
+		Verified:           tlsRes.Error == "" && len(tlsRes.Certificates) > 0 && len(tlsRes.VerificationErrors) == 0,
+		VerificationErrors: sanitizeTexts(tlsRes.VerificationErrors, maxTlsListLength, maxTlsTextLength),
+		Error:              sanitizeText(tlsRes.Error, maxTlsTextLength),
+	}
+	if len(tlsRes.Certificates) > 0 {
+		leafNotAfter := tlsRes.Certificates[0].NotAfter.UTC()
+		row.LeafNotAfter = &leafNotAfter
+	}
+	store.Insert(row)
+
+	// the fields of the certificates sent without DER are as sent by the sensor
+	certs := make([]TsTlsCertificate, 0, len(tlsRes.Certificates))
+	for i, cert := range tlsRes.Certificates {
+		certs = append(certs, TsTlsCertificate{
+			TsSensorTaskBase:   taskBase(meta),
+			Host:               host,
+			Port:               tlsRes.Port,
+			Position:           i,
+			Subject:            sanitizeText(cert.Subject, maxTlsTextLength),
+			Issuer:             sanitizeText(cert.Issuer, maxTlsTextLength),
+			SerialNumber:       sanitizeText(cert.SerialNumber, maxTlsNameLength),
+			DnsNames:           sanitizeTexts(cert.DnsNames, maxTlsListLength, maxTlsNameLength),
+			IpAddresses:        sanitizeTexts(cert.IpAddresses, maxTlsListLength, maxTlsNameLength),
+			NotBefore:          cert.NotBefore.UTC(),
+			NotAfter:           cert.NotAfter.UTC(),
+			SignatureAlgorithm: sanitizeText(cert.SignatureAlgorithm, maxTlsNameLength),
+			IsCA:               cert.IsCA,
+			FingerprintSha256:  sanitizeText(cert.FingerprintSha256, maxTlsNameLength),
+			FingerprintSha1:    sanitizeText(cert.FingerprintSha1, maxTlsNameLength),
+		})
+	}
+	store.Insert(certs)
+	return nil
+}
+
+// parseDer fills the certificate fields from its DER encoding
+func (c *TlsCertificate) parseDer() error {
+	cert, err := x509.ParseCertificate(c.Der)
+	if err != nil {
+		return err
+	}
+	sha256Sum := sha256.Sum256(c.Der)
+	sha1Sum := sha1.Sum(c.Der)
+
+	c.Subject = cert.Subject.String()
+	c.Issuer = cert.Issuer.String()
+	c.SerialNumber = cert.SerialNumber.Text(16)
+	c.DnsNames = cert.DNSNames
+	c.IpAddresses = nil
+	for _, ip := range cert.IPAddresses {
+		c.IpAddresses = append(c.IpAddresses, ip.String())
+	}
+	c.NotBefore = cert.NotBefore
+	c.NotAfter = cert.NotAfter
+	c.SignatureAlgorithm = cert.SignatureAlgorithm.String()
+	c.IsCA = cert.IsCA
+	c.FingerprintSha256 = hex.EncodeToString(sha256Sum[:])
+	c.FingerprintSha1 = hex.EncodeToString(sha1Sum[:])
+	return nil
+}
+
+// ExpiringCertificate is a leaf certificate seen on a target, expiring soon
+type ExpiringCertificate struct {
+	Host              string
+	Port              int
+	Subject           string
+	Issuer            string
+	FingerprintSha256 string
+	NotAfter          time.Time
+	DaysLeft          int
+	// LastSeen is the latest inspection serving it, Sensors the number of sensors whose latest inspection served it
+	LastSeen time.Time
+	Sensors  int
+}
+
+// ExpiringCertificates returns the leaf certificates served by each target, expiring before now + within,
+// the soonest first. Only the latest inspection of each target by each sensor since seenSince counts,
+// a certificate already renewed is not listed. A target served by several certificates, e.g. behind a CDN,
+// has a row per certificate. host filters a single target when not empty.
+func ExpiringCertificates(db *gorm.DB, now time.Time, within time.Duration, seenSince time.Time, host string) (certs []ExpiringCertificate, err error) {
+	err = db.Raw(`
+		WITH latest AS (
+			SELECT DISTINCT ON (host, port, sensor_id) host, port, sensor_id, time, subject, issuer, fingerprint_sha256, not_after
+			FROM ts_tls_certificates
+			WHERE position = 0 AND time >= @seenSince AND (@host = '' OR host = @host)
+			ORDER BY host, port, sensor_id, time DESC
+		)
+		SELECT host, port, subject, issuer, fingerprint_sha256, not_after,
+			MAX(time) AS last_seen, COUNT(*) AS sensors
+		FROM latest
+		WHERE not_after < @expiresBefore
+		GROUP BY host, port, subject, issuer, fingerprint_sha256, not_after
+		ORDER BY not_after, host, port`,
+		map[string]interface{}{"seenSince": seenSince, "host": host, "expiresBefore": now.Add(within)},
+	).Scan(&certs).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the expiring certificates: %v", err)
+	}
+	for i := range certs {
+		certs[i].DaysLeft = int(certs[i].NotAfter.Sub(now).Hours() / 24)
+	}
+	return
+}
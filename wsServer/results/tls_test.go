@@ -0,0 +1,154 @@
+package results
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// selfSignedDer returns a certificate of example.com valid until notAfter
+func selfSignedDer(t *testing.T, notAfter time.Time) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0x2a),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com", "www.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("10.0.0.1")},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestTlsHandlerDer(t *testing.T) {
+	notAfter := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	der := selfSignedDer(t, notAfter)
+	raw, _ := json.Marshal(map[string]any{
+		"Host":         "example.com",
+		"Port":         443,
+		"Address":      "10.0.0.1",
+		"Version":      "TLS 1.3",
+		"CipherSuite":  "TLS_AES_128_GCM_SHA256",
+		"Certificates": []map[string]any{{"Der": der}},
+	})
+
+	store := &fakeStore{}
+	meta := testMeta()
+	if err := handle(t, TlsHandler{}, store, meta, string(raw)); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+
+	results := inserted[TsTlsResult](store)
+	if len(results) != 1 {
+		t.Fatalf("TsTlsResult = %+v", results)
+	}
+	row := results[0]
+	if !row.Verified || row.Version != "TLS 1.3" || row.LeafNotAfter == nil || !row.LeafNotAfter.Equal(notAfter) {
+		t.Errorf("TsTlsResult = %+v", row)
+	}
+
+	certs := inserted[TsTlsCertificate](store)
+	if len(certs) != 1 {
+		t.Fatalf("TsTlsCertificate = %+v", certs)
+	}
+	cert := certs[0]
+	sum := sha256.Sum256(der)
+	if cert.FingerprintSha256 != hex.EncodeToString(sum[:]) || len(cert.FingerprintSha1) != 40 {
+		t.Errorf("fingerprints %v %v", cert.FingerprintSha256, cert.FingerprintSha1)
+	}
+	if cert.Subject != "CN=example.com" || cert.SerialNumber != "2a" || cert.Position != 0 || cert.Host != "example.com" || cert.Port != 443 {
+		t.Errorf("certificate = %+v", cert)
+	}
+	if !reflect.DeepEqual(cert.DnsNames, []string{"example.com", "www.example.com"}) || !reflect.DeepEqual(cert.IpAddresses, []string{"10.0.0.1"}) {
+		t.Errorf("SANs %v %v", cert.DnsNames, cert.IpAddresses)
+	}
+	if !cert.NotAfter.Equal(notAfter) || cert.SignatureAlgorithm != "ECDSA-SHA256" {
+		t.Errorf("certificate = %+v", cert)
+	}
+}
+
+func TestTlsHandlerVerificationErrors(t *testing.T) {
+	store := &fakeStore{}
+	err := handle(t, TlsHandler{}, store, testMeta(), `{
+		"Host": "example.com", "Port": 443,
+		"Certificates": [{"Subject": "CN=example.com", "NotBefore": "2024-01-01T00:00:00Z", "NotAfter": "2024-04-01T00:00:00Z"}],
+		"VerificationErrors": ["x509: certificate has expired"]
+	}`)
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if row := inserted[TsTlsResult](store)[0]; row.Verified || len(row.VerificationErrors) != 1 {
+		t.Errorf("TsTlsResult = %+v", row)
+	}
+}
+
+func TestTlsHandlerConnectionError(t *testing.T) {
+	store := &fakeStore{}
+	if err := handle(t, TlsHandler{}, store, testMeta(), `{"Host": "example.com", "Port": 443, "Error": "connection refused"}`); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if row := inserted[TsTlsResult](store)[0]; row.Verified || row.LeafNotAfter != nil || row.Error != "connection refused" {
+		t.Errorf("TsTlsResult = %+v", row)
+	}
+	if certs := inserted[TsTlsCertificate](store); len(certs) != 0 {
+		t.Errorf("TsTlsCertificate = %+v", certs)
+	}
+}
+
+func TestTlsHandlerSanitized(t *testing.T) {
+	store := &fakeStore{}
+	err := handle(t, TlsHandler{}, store, testMeta(), `{
+		"Host": "example.com\u0000", "Port": 443, "Version": "TLS\u0000 1.3", "OcspStatus": "good\u0000",
+		"Certificates": [{"Subject": "CN=example.com\u0000", "Issuer": "CN=\u0000CA", "DnsNames": ["example.com\u0000"],
+			"NotBefore": "2024-01-01T00:00:00Z", "NotAfter": "2024-04-01T00:00:00Z"}],
+		"VerificationErrors": ["x509: \u0000certificate has expired"],
+		"Error": "handshake\u0000 failed"
+	}`)
+	if err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	row := inserted[TsTlsResult](store)[0]
+	if row.Host != "example.com" || row.Version != "TLS 1.3" || row.OcspStatus != "good" || row.Error != "handshake failed" {
+		t.Errorf("TsTlsResult = %+v", row)
+	}
+	if !reflect.DeepEqual(row.VerificationErrors, []string{"x509: certificate has expired"}) {
+		t.Errorf("VerificationErrors = %q", row.VerificationErrors)
+	}
+	cert := inserted[TsTlsCertificate](store)[0]
+	if cert.Host != "example.com" || cert.Subject != "CN=example.com" || cert.Issuer != "CN=CA" || !reflect.DeepEqual(cert.DnsNames, []string{"example.com"}) {
+		t.Errorf("TsTlsCertificate = %+v", cert)
+	}
+}
+
+func TestTlsHandlerInvalid(t *testing.T) {
+	tests := []string{
+		`{"Port": 443}`,
+		`{"Host": "example.com", "Port": 0}`,
+		`{"Host": "example.com", "Port": 70000}`,
+		`{"Host": "example.com", "Port": 443, "Certificates": [{"Subject": "CN=example.com"}]}`,
+		`{"Host": "example.com", "Port": 443, "Certificates": [{"Der": "AAEC"}]}`,
+	}
+	for _, raw := range tests {
+		if err := handle(t, TlsHandler{}, &fakeStore{}, testMeta(), raw); err == nil {
+			t.Errorf("%v: expected an error", raw)
+		}
+	}
+}
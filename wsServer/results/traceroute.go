@@ -0,0 +1,225 @@
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/42lib/sensor"
+	"github.com/ping-42/42lib/traceroute"
+	"github.com/ping-42/server/wsServer/ipinfo"
+	"gorm.io/gorm"
+)
+
+// silentHop is the address of a hop that did not answer, in the stored paths
+const silentHop = "*"
+
+// maxPathChanges bounds the path changes returned by a query
+const maxPathChanges = 500
+
+// TsTracerouteHopInfo enriches a hop of ts_traceroute_results_hop, by its TTL
+type TsTracerouteHopInfo struct {
+	models.TsSensorTaskBase
+	TTL     int
+	Address net.IP `gorm:"type:inet"`
+	// Asn, AsOrg and Country are looked up in the ip datasets, empty when unknown
+	Asn     uint32
+	AsOrg   string
+	Country string
+	// Rdns is the reverse DNS name resolved by the sensor
+	Rdns string
+}
+
+// TsTraceroutePath is the path of a traceroute to a target
+type TsTraceroutePath struct {
+	models.TsSensorTaskBase
+	Target net.IP `gorm:"type:inet"`
+	// Hops are the addresses by TTL, silentHop for the hops that did not answer
+	Hops []string `gorm:"type:jsonb;serializer:json"`
+	// AsPath are the ASNs crossed, the unknown ones and the repetitions skipped
+	AsPath  []uint32 `gorm:"type:jsonb;serializer:json"`
+	Reached bool
+}
+
+// TsTraceroutePathChange is a change of the path of a sensor to a target since its previous traceroute
+type TsTraceroutePathChange struct {
+	models.TsSensorTaskBase
+	Target         net.IP    `gorm:"type:inet"`
+	PreviousTaskID uuid.UUID `gorm:"type:uuid"`
+	PreviousTime   time.Time `gorm:"type:TIMESTAMPTZ;"`
+	// HopsAdded and HopsRemoved are the answering addresses new to the path, and gone from it
+	HopsAdded   []string `gorm:"type:jsonb;serializer:json"`
+	HopsRemoved []string `gorm:"type:jsonb;serializer:json"`
+	// AsPathChanged is set when the traffic crosses other networks
+	AsPathChanged  bool
+	PreviousAsPath []uint32 `gorm:"type:jsonb;serializer:json"`
+	AsPath         []uint32 `gorm:"type:jsonb;serializer:json"`
+}
+
+func init() {
+	Register(TracerouteHandler{})
+}
+
+// TracerouteHandler stores the traceroute results and their hops, enriched with the ip datasets,
+// and the changes of the path of each sensor to each target
+type TracerouteHandler struct {
+	// IpInfo looks up the ASN, organization and country of the hops, none are set without it
+	IpInfo ipinfo.Source
+}
+
+func (TracerouteHandler) TaskName() sensor.TaskName { return traceroute.TaskName }
+
+func (TracerouteHandler) Decode(raw json.RawMessage) (any, error) {
+	return decodeJson[traceroute.Result](raw)
+}
+
+func (TracerouteHandler) Validate(res any) error {
+	_, err := decoded[traceroute.Result](res)
+	return err
+}
+
+func (h TracerouteHandler) Store(ctx context.Context, store Store, meta Meta, res any) error {
+	tracerouteRes, err := decoded[traceroute.Result](res)
+	if err != nil {
+		return err
+	}
+
+	// high level traceroute result
+	store.Insert(models.TsTracerouteResult{
+		TsSensorTaskBase:  taskBase(meta),
+		DestinationAdress: tracerouteRes.DestinationAdress,
+	})
+
+	hops := make([]models.TsTracerouteResultHop, 0, len(tracerouteRes.Hops))
+	infos := make([]TsTracerouteHopInfo, 0, len(tracerouteRes.Hops))
+	path := TsTraceroutePath{
+		TsSensorTaskBase: taskBase(meta),
+		Target:           tracerouteRes.DestinationAdress,
+		Hops:             make([]string, 0, len(tracerouteRes.Hops)),
+	}
+	for _, hop := range tracerouteRes.Hops {
+		hops = append(hops, models.TsTracerouteResultHop{
+			TsSensorTaskBase: taskBase(meta),
+			Success:          hop.Success,
+			Address:          hop.Address,
+			Host:             hop.Host,
+			BytesReceived:    hop.BytesReceived,
+			ElapsedTime:      hop.ElapsedTime,
+			TTL:              hop.TTL,
+			Error:            fmt.Sprint(hop.Error),
+		})
+
+		if !hop.Success || hop.Address == nil {
+			path.Hops = append(path.Hops, silentHop)
+			continue
+		}
+		info := h.hopInfo(meta, hop)
+		infos = append(infos, info)
+		path.Hops = append(path.Hops, hop.Address.String())
+		if info.Asn != 0 && (len(path.AsPath) == 0 || path.AsPath[len(path.AsPath)-1] != info.Asn) {
+			path.AsPath = append(path.AsPath, info.Asn)
+		}
+		path.Reached = hop.Address.Equal(tracerouteRes.DestinationAdress)
+	}
+	store.Insert(hops)
+	store.Insert(infos)
+
+	if path.Target == nil {
+		return nil
+	}
+	store.Insert(path)
+
+	change, changed, err := pathChange(store, path)
+	if err != nil {
+		return err
+	}
+	if changed {
+		store.Insert(change)
+	}
+	return nil
+}
+
+// hopInfo looks up the answering hop in the ip datasets
+func (h TracerouteHandler) hopInfo(meta Meta, hop traceroute.Hop) TsTracerouteHopInfo {
+	info := TsTracerouteHopInfo{
+		TsSensorTaskBase: taskBase(meta),
+		TTL:              hop.TTL,
+		Address:          hop.Address,
+		Rdns:             strings.TrimSuffix(hop.Host, "."),
+	}
+	if h.IpInfo != nil {
+		if ipInfo, ok := h.IpInfo.Lookup(hop.Address); ok {
+			info.Asn = ipInfo.Asn
+			info.AsOrg = ipInfo.AsOrg
+			info.Country = ipInfo.Country
+		}
+	}
+	return info
+}
+
+// pathChange compares the path to the previous traceroute of the sensor to the target.
+// The silent hops are ignored, they do not tell the path changed.
+func pathChange(store Store, path TsTraceroutePath) (change TsTraceroutePathChange, changed bool, err error) {
+	prev, ok, err := store.PreviousTraceroutePath(path.SensorID, path.Target, path.Time)
+	if err != nil || !ok {
+		return
+	}
+
+	change = TsTraceroutePathChange{
+		TsSensorTaskBase: path.TsSensorTaskBase,
+		Target:           path.Target,
+		PreviousTaskID:   prev.TaskID,
+		PreviousTime:     prev.Time,
+		HopsAdded:        missingHops(path.Hops, prev.Hops),
+		HopsRemoved:      missingHops(prev.Hops, path.Hops),
+		AsPathChanged:    !slices.Equal(prev.AsPath, path.AsPath),
+		PreviousAsPath:   prev.AsPath,
+		AsPath:           path.AsPath,
+	}
+	changed = len(change.HopsAdded) > 0 || len(change.HopsRemoved) > 0 || change.AsPathChanged
+	return
+}
+
+func (r DBReader) PreviousTraceroutePath(sensorId uuid.UUID, target net.IP, before time.Time) (path TsTraceroutePath, ok bool, err error) {
+	res := r.DB.Where("sensor_id = ? AND target = ? AND time < ?", sensorId, target.String(), before).
+		Order("time DESC").
+		Limit(1).
+		Find(&path)
+	if res.Error != nil {
+		return path, false, fmt.Errorf("failed to load the previous path to %v: %v", target, res.Error)
+	}
+	return path, res.RowsAffected > 0, nil
+}
+
+// missingHops returns the answering hops of hops missing from other
+func missingHops(hops []string, other []string) (missing []string) {
+	for _, hop := range hops {
+		if hop != silentHop && !slices.Contains(other, hop) && !slices.Contains(missing, hop) {
+			missing = append(missing, hop)
+		}
+	}
+	return
+}
+
+// GetPathChanges returns the path changes since since, the latest first.
+// sensorId and target filter a sensor and a target when set.
+func GetPathChanges(db *gorm.DB, sensorId *uuid.UUID, target net.IP, since time.Time) (changes []TsTraceroutePathChange, err error) {
+	query := db.Where("time >= ?", since)
+	if sensorId != nil {
+		query = query.Where("sensor_id = ?", *sensorId)
+	}
+	if target != nil {
+		query = query.Where("target = ?", target.String())
+	}
+	err = query.Order("time DESC").Limit(maxPathChanges).Find(&changes).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the path changes: %v", err)
+	}
+	return
+}
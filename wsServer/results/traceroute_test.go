@@ -0,0 +1,140 @@
+package results
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"github.com/ping-42/server/wsServer/ipinfo"
+)
+
+// fakeIpInfo knows the addresses of its map
+type fakeIpInfo map[string]ipinfo.Info
+
+func (f fakeIpInfo) Lookup(ip net.IP) (ipinfo.Info, bool) {
+	info, ok := f[ip.String()]
+	return info, ok
+}
+
+const tracerouteResult = `{
+	"DestinationAdress": "10.0.3.1",
+	"Hops": [
+		{"Success": true, "Address": "10.0.1.1", "Host": "gw.example.net.", "TTL": 1, "ElapsedTime": 1000000},
+		{"Success": false, "TTL": 2},
+		{"Success": true, "Address": "10.0.2.1", "TTL": 3},
+		{"Success": true, "Address": "10.0.3.1", "TTL": 4}
+	]
+}`
+
+func tracerouteHandler() TracerouteHandler {
+	return TracerouteHandler{IpInfo: fakeIpInfo{
+		"10.0.1.1": {Asn: 64500, AsOrg: "Transit", Country: "DE"},
+		"10.0.2.1": {Asn: 64500, AsOrg: "Transit", Country: "DE"},
+		"10.0.3.1": {Asn: 64501, AsOrg: "Target", Country: "FR"},
+	}}
+}
+
+func TestTracerouteHandler(t *testing.T) {
+	store := &fakeStore{}
+	meta := testMeta()
+	if err := handle(t, tracerouteHandler(), store, meta, tracerouteResult); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+
+	results := inserted[models.TsTracerouteResult](store)
+	if len(results) != 1 || !results[0].DestinationAdress.Equal(net.ParseIP("10.0.3.1")) {
+		t.Errorf("TsTracerouteResult = %+v", results)
+	}
+	if hops := inserted[models.TsTracerouteResultHop](store); len(hops) != 4 || hops[0].Host != "gw.example.net." || hops[1].Success {
+		t.Errorf("TsTracerouteResultHop = %+v", hops)
+	}
+
+	// the silent hop has no info
+	infos := inserted[TsTracerouteHopInfo](store)
+	if len(infos) != 3 {
+		t.Fatalf("TsTracerouteHopInfo = %+v", infos)
+	}
+	if info := infos[0]; info.TTL != 1 || info.Asn != 64500 || info.AsOrg != "Transit" || info.Country != "DE" || info.Rdns != "gw.example.net" {
+		t.Errorf("first hop info = %+v", info)
+	}
+
+	paths := inserted[TsTraceroutePath](store)
+	if len(paths) != 1 {
+		t.Fatalf("TsTraceroutePath = %+v", paths)
+	}
+	path := paths[0]
+	if !reflect.DeepEqual(path.Hops, []string{"10.0.1.1", silentHop, "10.0.2.1", "10.0.3.1"}) {
+		t.Errorf("Hops = %v", path.Hops)
+	}
+	if !reflect.DeepEqual(path.AsPath, []uint32{64500, 64501}) || !path.Reached {
+		t.Errorf("path = %+v", path)
+	}
+	// no change without a previous path
+	if changes := inserted[TsTraceroutePathChange](store); len(changes) != 0 {
+		t.Errorf("TsTraceroutePathChange = %+v", changes)
+	}
+}
+
+func TestTracerouteHandlerWithoutIpInfo(t *testing.T) {
+	store := &fakeStore{}
+	if err := handle(t, TracerouteHandler{}, store, testMeta(), tracerouteResult); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	path := inserted[TsTraceroutePath](store)[0]
+	if len(path.AsPath) != 0 || len(path.Hops) != 4 {
+		t.Errorf("path = %+v", path)
+	}
+	if info := inserted[TsTracerouteHopInfo](store)[0]; info.Asn != 0 || info.Country != "" {
+		t.Errorf("hop info = %+v", info)
+	}
+}
+
+func TestTracerouteHandlerPathChange(t *testing.T) {
+	meta := testMeta()
+	prev := TsTraceroutePath{
+		TsSensorTaskBase: taskBase(Meta{SensorID: meta.SensorID, TaskID: uuid.New(), MeasuredAt: meta.MeasuredAt.Add(-time.Hour)}),
+		Target:           net.ParseIP("10.0.3.1"),
+		// a silent hop is not a change
+		Hops:   []string{"10.0.1.1", "10.0.9.1", silentHop, "10.0.3.1"},
+		AsPath: []uint32{64500, 64502, 64501},
+	}
+	store := &fakeStore{paths: []TsTraceroutePath{prev}}
+	if err := handle(t, tracerouteHandler(), store, meta, tracerouteResult); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+
+	changes := inserted[TsTraceroutePathChange](store)
+	if len(changes) != 1 {
+		t.Fatalf("TsTraceroutePathChange = %+v", changes)
+	}
+	change := changes[0]
+	if change.PreviousTaskID != prev.TaskID || !change.PreviousTime.Equal(prev.Time) || change.TaskID != meta.TaskID {
+		t.Errorf("change = %+v", change)
+	}
+	if !reflect.DeepEqual(change.HopsAdded, []string{"10.0.2.1"}) || !reflect.DeepEqual(change.HopsRemoved, []string{"10.0.9.1"}) {
+		t.Errorf("added %v, removed %v", change.HopsAdded, change.HopsRemoved)
+	}
+	if !change.AsPathChanged || !reflect.DeepEqual(change.PreviousAsPath, prev.AsPath) {
+		t.Errorf("change = %+v", change)
+	}
+}
+
+func TestTracerouteHandlerSamePath(t *testing.T) {
+	meta := testMeta()
+	prev := TsTraceroutePath{
+		TsSensorTaskBase: taskBase(Meta{SensorID: meta.SensorID, MeasuredAt: meta.MeasuredAt.Add(-time.Hour)}),
+		Target:           net.ParseIP("10.0.3.1"),
+		Hops:             []string{"10.0.1.1", "10.0.2.1", silentHop, "10.0.3.1"},
+		AsPath:           []uint32{64500, 64501},
+	}
+	store := &fakeStore{paths: []TsTraceroutePath{prev}}
+	if err := handle(t, tracerouteHandler(), store, meta, tracerouteResult); err != nil {
+		t.Fatalf("handle: %v", err)
+	}
+	if changes := inserted[TsTraceroutePathChange](store); len(changes) != 0 {
+		t.Errorf("TsTraceroutePathChange = %+v", changes)
+	}
+}
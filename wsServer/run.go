@@ -1,32 +1,222 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/containerd/log"
 	"github.com/go-redis/redis"
 	"github.com/google/uuid"
-	"github.com/ping-42/42lib/config/consts"
 	logger42 "github.com/ping-42/42lib/logger"
-	"github.com/ping-42/42lib/wss"
+	"github.com/ping-42/server/wsServer/blobstore"
+	"github.com/ping-42/server/wsServer/ipinfo"
+	"github.com/ping-42/server/wsServer/results"
 	"gorm.io/gorm"
 )
 
-func Init(dbClient *gorm.DB, redisClient *redis.Client, logger *log.Entry, port string) {
+// Options holds the server settings passed from the cli
+type Options struct {
+	// Port to listen for sensor connections
+	Port string
+	// AdminPort to listen for the internal admin api, the api is disabled when empty
+	AdminPort string
+	// AdminToken is the bearer token required by the admin api
+	AdminToken string
+	// InstanceId identifies this server instance, defaults to the hostname
+	InstanceId string
+	// LiveFeedToken is the bearer token required by the live feed, served on the admin port, it follows every subscription.
+	// The feed is disabled when empty and no LiveFeedSubscriptionTokens are set.
+	LiveFeedToken string
+	// LiveFeedSubscriptionTokens are the live feed tokens of the subscriptions, by subscription id.
+	// A token set for several subscriptions follows all of them.
+	LiveFeedSubscriptionTokens map[string]string
+	// OtlpEndpoint is the OTLP/HTTP collector url receiving the traces, tracing is disabled when empty
+	OtlpEndpoint string
+	// TrustedProxies are the proxy addresses or CIDRs allowed to set X-Real-IP and X-Forwarded-For
+	TrustedProxies []string
+	// JwtAudience is the aud claim required in the sensor tokens, defaults to DefaultJwtAudience
+	JwtAudience string
+	// JwtMaxLifetime is the max lifetime (exp - iat) of the sensor tokens, defaults to DefaultJwtMaxLifetime
+	JwtMaxLifetime time.Duration
+	// CredentialsCacheTtl is how long the sensor credentials are cached, defaults to DefaultCredentialsCacheTtl
+	CredentialsCacheTtl time.Duration
+	// TaskRouting is TaskRoutingBroadcast (default) or TaskRoutingTargeted
+	TaskRouting string
+	// TaskIntake is TaskIntakePubSub (default) or TaskIntakeStreams, the streams intake always routes the tasks
+	TaskIntake string
+	// TaskMaxDeliveries is the number of deliveries of a stream task before it is dead lettered, defaults to DefaultTaskMaxDeliveries
+	TaskMaxDeliveries int
+	// PendingTaskTtl is how long the tasks of an offline sensor wait for it when they carry no deadline, the queue is disabled when zero
+	PendingTaskTtl time.Duration
+	// TaskTimeouts overrides the time the sensors have to answer each task type, by task type name
+	TaskTimeouts map[string]time.Duration
+	// IngestQueueSize is the number of sensor messages waiting to be stored before the reads block, defaults to DefaultIngestQueueSize
+	IngestQueueSize int
+	// IngestWorkers is the number of workers storing the sensor messages, defaults to DefaultIngestWorkers
+	IngestWorkers int
+	// IngestBatchSize is the number of messages a worker stores in one flush, defaults to DefaultIngestBatchSize
+	IngestBatchSize int
+	// IngestFlushInterval is the max time a message waits for its flush, defaults to DefaultIngestFlushInterval
+	IngestFlushInterval time.Duration
+	// HttpBodyPolicy is the body storage policy of the subscriptions without one, defaults to results.HttpBodyTruncated
+	HttpBodyPolicy string
+	// HttpBodyMaxBytes is the length of the body kept by the truncated policy, defaults to results.DefaultHttpBodyMaxBytes
+	HttpBodyMaxBytes int
+	// BlobStore is where the full http bodies are kept, a directory, file:///path or s3://bucket/prefix, the full policy is stored truncated when empty
+	BlobStore string
+	// S3 is the endpoint, region and credentials of an s3:// blob store
+	S3 blobstore.S3Config
+	// IpDatasets are the MMDB or ip2asn files the traceroute hops are looked up in
+	IpDatasets []string
+}
+
+func Init(dbClient *gorm.DB, redisClient *redis.Client, logger *log.Entry, opts Options) {
+
+	instanceId := instanceIdOrDefault(opts.InstanceId)
+	if opts.TaskRouting != "" && opts.TaskRouting != TaskRoutingBroadcast && opts.TaskRouting != TaskRoutingTargeted {
+		logger.Error(fmt.Sprintf("unknown task routing %q", opts.TaskRouting))
+		return
+	}
+	if opts.TaskIntake != "" && opts.TaskIntake != TaskIntakePubSub && opts.TaskIntake != TaskIntakeStreams {
+		logger.Error(fmt.Sprintf("unknown task intake %q", opts.TaskIntake))
+		return
+	}
+
+	if err := validateTaskTimeouts(opts.TaskTimeouts); err != nil {
+		logger.Error(err.Error())
+		return
+	}
 
-	// subscribe to the redis channel
-	pubsub := redisClient.Subscribe(consts.SchedulerNewTaskChannel)
-	defer pubsub.Close()
+	blobs, resultHandlers, err := newResultHandlers(opts)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	// subscribe to the scheduler channel, or to the channel of this instance in targeted routing
+	var pubsub *redis.PubSub
+	if opts.TaskIntake != TaskIntakeStreams {
+		pubsub = subscribeTaskChannel(redisClient, opts.TaskRouting, instanceId)
+		defer pubsub.Close()
+	}
 
 	var ws42 = wsServer{
 		dbClient:          dbClient,
 		redisClient:       redisClient,
 		redisPubSub:       pubsub,
-		sensorConnections: make(map[uuid.UUID]wss.SensorConnection),
+		sensorConnections: make(map[uuid.UUID]*sensorConnection),
+		credentials:       newCredentialCache(opts.CredentialsCacheTtl),
+		resultHandlers:    resultHandlers,
+		blobs:             blobs,
 		serverLogger:      logger42.Base("server"),
+		instanceId:        instanceId,
+		opts:              opts,
+	}
+
+	trustedProxies, err := parseTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		ws42.serverLogger.Error(err.Error())
+		return
+	}
+	ws42.trustedProxies = trustedProxies
+
+	liveFeedScopes, err := parseLiveFeedTokens(opts.LiveFeedSubscriptionTokens)
+	if err != nil {
+		ws42.serverLogger.Error(err.Error())
+		return
+	}
+	ws42.liveFeedScopes = liveFeedScopes
+
+	// the sessions of a previous run were not closed if the instance crashed
+	err = ws42.closeStaleSensorSessions()
+	if err != nil {
+		ws42.serverLogger.Error(err.Error())
+	}
+
+	tracingShutdown, err := initTracing(context.Background(), opts.OtlpEndpoint, ws42.instanceId, dbClient)
+	if err != nil {
+		ws42.serverLogger.Error("unable to init tracing: ", err)
 	}
+	ws42.tracingShutdown = tracingShutdown
 
-	// start listening for tasks
-	go ws42.schedulerListener()
+	// start listening for tasks, in streams intake every instance routes the tasks of the scheduler stream
+	go ws42.instanceHeartbeat()
+	if ws42.taskIntake() == TaskIntakeStreams {
+		go ws42.streamsListener()
+		go ws42.streamsReclaimer()
+	} else {
+		go ws42.schedulerListener()
+		// a single instance routes the tasks in targeted routing
+		if ws42.taskRouting() == TaskRoutingTargeted {
+			go ws42.taskRouterElection()
+		}
+	}
+
+	// store the results and telemetry read from the sensors
+	ws42.startIngest()
+
+	// time out the tasks the sensors do not answer
+	go ws42.taskWatchdog()
+
+	// expire the tasks queued for the sensors that did not reconnect in time
+	go ws42.pendingTasksExpiry()
+
+	// close the sessions left open by the instances that died
+	go ws42.sensorSessionSweeper()
+
+	// drop the cached credentials changed by the cli or other instances
+	go ws42.credentialsListener()
+	go ws42.credentials.purgeExpired()
+
+	// start listening for admin commands forwarded from the other instances
+	go ws42.adminCommandListener()
+
+	// start passing the stored results and telemetry to the live feed subscribers
+	go ws42.liveFeedListener()
 
 	// run ws server
-	ws42.run(port)
+	ws42.run(opts.Port)
+}
+
+// newResultHandlers returns the handlers of the server, the default ones with the http handler
+// configured with the body policy and the blob store of the options, and the traceroute handler with the ip datasets
+func newResultHandlers(opts Options) (blobs blobstore.Store, handlers *results.Registry, err error) {
+	if opts.HttpBodyPolicy != "" && !results.ValidHttpBodyPolicy(opts.HttpBodyPolicy) {
+		err = fmt.Errorf("unknown http body policy %q", opts.HttpBodyPolicy)
+		return
+	}
+	if opts.BlobStore != "" {
+		blobs, err = blobstore.Open(opts.BlobStore, opts.S3)
+		if err != nil {
+			return
+		}
+	}
+
+	ipDatasets, err := ipinfo.Open(opts.IpDatasets)
+	if err != nil {
+		return
+	}
+
+	handlers = results.Default.Clone()
+	handlers.Replace(results.HttpHandler{
+		DefaultPolicy: opts.HttpBodyPolicy,
+		MaxBodyBytes:  opts.HttpBodyMaxBytes,
+		Blobs:         blobs,
+	})
+	handlers.Replace(results.TracerouteHandler{IpInfo: ipDatasets})
+	return
+}
+
+// instanceIdOrDefault falls back to the hostname, which is the pod name in kubernetes
+func instanceIdOrDefault(instanceId string) string {
+	if instanceId != "" {
+		return instanceId
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return uuid.New().String()
+	}
+	return hostname
 }
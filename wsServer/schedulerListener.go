@@ -1,63 +1,130 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/containerd/log"
-	"github.com/ping-42/42lib/db/models"
 	"github.com/ping-42/42lib/logger"
 	"github.com/ping-42/42lib/sensor"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (w *wsServer) schedulerListener() {
+	// the liveness probe fails once the listener stops
+	w.listenerRunning.Store(true)
+	defer func() {
+		w.listenerRunning.Store(false)
+		w.serverLogger.Error("Scheduler listener stopped, no more tasks will be dispatched")
+	}()
+
 	for {
 		msg, err := w.redisPubSub.ReceiveMessage()
 		if err != nil {
+			redisErrors.WithLabelValues("pubsub_receive").Inc()
 			logger.LogError(err.Error(), "pubsub.ReceiveMessage, error receiving message", w.serverLogger)
 			continue
 		}
 
-		var recevedTask sensor.Task
-		err = json.Unmarshal([]byte(msg.Payload), &recevedTask)
+		err = w.dispatchTask(msg.Payload)
 		if err != nil {
-			logger.LogError(err.Error(), fmt.Sprintf("pubsub.ReceiveMessage, error unmarshal message:%v", msg.Payload), w.serverLogger)
+			logger.LogError(err.Error(), "dispatchTask error", w.serverLogger)
 			continue
 		}
+	}
+}
 
-		var serverLogger = w.serverLogger.WithFields(log.Fields{
-			"sensorId": recevedTask.SensorId,
-			"taskId":   recevedTask.Id,
-		})
+// dispatchTask sends the task to the sensor if it is connected to this instance.
+// An error means the task was not sent and may be retried, the failures after the send are logged only.
+func (w *wsServer) dispatchTask(payload string) (err error) {
+	var recevedTask sensor.Task
+	err = json.Unmarshal([]byte(payload), &recevedTask)
+	if err != nil {
+		err = fmt.Errorf("error unmarshal message:%v, err:%v", payload, err)
+		return
+	}
 
-		serverLogger.Info("Receved a task submission from sensor")
+	var serverLogger = w.serverLogger.WithFields(log.Fields{
+		"sensorId": recevedTask.SensorId,
+		"taskId":   recevedTask.Id,
+	})
 
-		// the sensor may not be connected to this server, in this case just pass the task
-		wsConn, exists := w.getSensorWsConnection(recevedTask.SensorId)
-		if !exists {
-			serverLogger.Info("Not interested, passing task... The sensor is not connected to this server.")
-			continue
-		}
+	serverLogger.Info("Receved a task submission from sensor")
 
-		// update the task status to RECEIVED_BY_SERVER
-		updateTx := w.dbClient.Model(&models.Task{}).Where("id = ?", recevedTask.Id).Update("task_status_id", 3)
-		if updateTx.Error != nil {
-			serverLogger.Error("Error updating task to RECEIVED_BY_SERVER", updateTx.Error)
+	// the sensor may not be connected to this server, in this case just pass the task
+	wsConn, exists := w.getSensorWsConnection(recevedTask.SensorId)
+	if !exists {
+		// the task waits for the sensor if it is not connected to any instance
+		queued, queueErr := w.queueIfOffline(recevedTask, payload)
+		if queueErr != nil {
+			err = fmt.Errorf("Error queuing task of offline sensor: %v", queueErr)
 			return
 		}
-
-		// send the received message to the sensor
-		err = w.sendTaskToSensors(wsConn, []byte(msg.Payload))
-		if err != nil {
-			serverLogger.Error("Error sending task to sensor", err.Error())
-			return
+		if !queued {
+			serverLogger.Info("Not interested, passing task... The sensor is not connected to this server.")
 		}
+		return
+	}
 
-		// update the task status to SENT_TO_SENSOR_BY_SERVER
-		updateTx = w.dbClient.Model(&models.Task{}).Where("id = ?", recevedTask.Id).Update("task_status_id", 4)
-		if updateTx.Error != nil {
-			serverLogger.Error("Error updating task to SENT_TO_SENSOR_BY_SERVER", updateTx.Error)
-			return
-		}
+	// draining sensors only finish their in-flight tasks
+	if wsConn.draining.Load() {
+		serverLogger.Info("Sensor is draining, passing task...")
+		return
+	}
+
+	// the task must be allowed by the sensor policy
+	policyErr := w.authorizeTask(wsConn, recevedTask)
+	if policyErr != nil {
+		serverLogger.Error(fmt.Sprintf("Task not allowed for the sensor: %v", policyErr))
+		_, err = w.transitionTask(w.dbClient, recevedTask.Id, TaskError, fmt.Sprintf("policy denied: %v", policyErr))
+		return
+	}
+
+	// the scheduler may have put its span context in the task, the dispatch joins that trace
+	ctx, span := tracer.Start(extractTraceContext(context.Background(), []byte(payload)), "schedulerListener.dispatch",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("task.id", recevedTask.Id.String()),
+			attribute.String("task.name", string(recevedTask.Name)),
+			attribute.String("sensor.id", recevedTask.SensorId.String()),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+	dbClient := w.dbClient.WithContext(ctx)
+
+	// update the task status to RECEIVED_BY_SERVER, the returned created_at measures the pubsub lag
+	task, err := w.transitionTask(dbClient, recevedTask.Id, TaskReceivedByServer, "received by the instance holding the sensor")
+	if errors.Is(err, errInvalidTransition) {
+		// a task delivered twice is sent only once
+		serverLogger.Info(fmt.Sprintf("Task already handled, passing task... %v", err))
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	if !task.CreatedAt.IsZero() {
+		pubsubReceiveLag.Observe(time.Since(task.CreatedAt).Seconds())
+	}
+
+	// send the received message to the sensor, the watchdog times it out if it is not answered
+	w.trackSentTask(wsConn, recevedTask)
+	err = w.sendTaskToSensors(ctx, wsConn, []byte(payload))
+	if err != nil {
+		wsConn.untrackTask(recevedTask.Id)
+		err = fmt.Errorf("Error sending task to sensor: %v", err)
+		return
+	}
+	dispatchedTasks.WithLabelValues(string(recevedTask.Name)).Inc()
+
+	// update the task status to SENT_TO_SENSOR_BY_SERVER, the result may already be there
+	_, sentErr := w.transitionTask(dbClient, recevedTask.Id, TaskSentToSensor, "sent to the sensor")
+	if sentErr != nil {
+		serverLogger.Error(fmt.Sprintf("Error updating task to SENT_TO_SENSOR_BY_SERVER: %v", sentErr))
 	}
+	return
 }
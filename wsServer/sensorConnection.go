@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ws "github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/wss"
+)
+
+// sensorConnection is the server side state of a live sensor connection
+type sensorConnection struct {
+	wss.SensorConnection
+
+	remoteAddr     string
+	connectedSince time.Time
+
+	// draining sensors get no new tasks, but finish the ones in flight
+	draining atomic.Bool
+
+	// closeReason is set when the server closes the connection on purpose
+	closeReason atomic.Value
+
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+
+	// writeLock serializes the frames written to the connection,
+	// since tasks and replies are sent from different goroutines
+	writeLock sync.Mutex
+
+	// inFlight are the tasks sent and not answered yet, watched by the taskWatchdog
+	inFlight     map[uuid.UUID]inFlightTask
+	inFlightLock sync.Mutex
+
+	// pendingLock serializes the deliveries of the tasks queued while the sensor was offline
+	pendingLock sync.Mutex
+}
+
+// sensorPresence is stored in the active sensor Redis key. It extends wss.SensorConnection
+// with the details needed to see the sensor from any server instance.
+type sensorPresence struct {
+	wss.SensorConnection
+
+	InstanceId     string
+	RemoteAddr     string
+	ConnectedSince time.Time
+	Draining       bool
+	MessagesIn     uint64
+	MessagesOut    uint64
+	BytesIn        uint64
+	BytesOut       uint64
+	UpdatedAt      time.Time
+}
+
+// write sends a single text frame to the sensor
+func (c *sensorConnection) write(msg []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	err := wsutil.WriteServerMessage(c.Connection, ws.OpText, msg)
+	if err != nil {
+		return err
+	}
+	c.messagesOut.Add(1)
+	c.bytesOut.Add(uint64(len(msg)))
+	return nil
+}
+
+// received counts a message read from the sensor
+func (c *sensorConnection) received(msg []byte) {
+	c.messagesIn.Add(1)
+	c.bytesIn.Add(uint64(len(msg)))
+}
+
+// close sends a close frame with the reason and closes the connection,
+// the read loop then ends and the usual disconnect cleanup runs
+func (c *sensorConnection) close(reason string) error {
+	c.closeReason.Store(reason)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_ = ws.WriteFrame(c.Connection, ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, reason)))
+	return c.Connection.Close()
+}
+
+// closedByServer returns the reason passed to close, if the server closed the connection
+func (c *sensorConnection) closedByServer() (reason string, ok bool) {
+	reason, ok = c.closeReason.Load().(string)
+	return
+}
+
+func (c *sensorConnection) presence(instanceId string) sensorPresence {
+	return sensorPresence{
+		SensorConnection: c.SensorConnection,
+		InstanceId:       instanceId,
+		RemoteAddr:       c.remoteAddr,
+		ConnectedSince:   c.connectedSince,
+		Draining:         c.draining.Load(),
+		MessagesIn:       c.messagesIn.Load(),
+		MessagesOut:      c.messagesOut.Load(),
+		BytesIn:          c.bytesIn.Load(),
+		BytesOut:         c.bytesOut.Load(),
+		UpdatedAt:        time.Now().UTC(),
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/constants"
+	"github.com/ping-42/42lib/logger"
+	"gorm.io/gorm"
+)
+
+// SensorSession is the persisted history of a single sensor connection
+type SensorSession struct {
+	ConnectionID  uuid.UUID `gorm:"type:uuid;primaryKey"`
+	SensorID      uuid.UUID `gorm:"type:uuid;not null"`
+	SensorVersion string
+	InstanceID    string
+	RemoteAddr    string
+	ConnectedAt   time.Time `gorm:"type:TIMESTAMPTZ;not null"`
+	// DisconnectedAt stays NULL while the sensor is connected
+	DisconnectedAt   *time.Time `gorm:"type:TIMESTAMPTZ;"`
+	DisconnectReason string
+	MessagesIn       uint64
+	MessagesOut      uint64
+	BytesIn          uint64
+	BytesOut         uint64
+	// UpdatedAt is bumped with every telemetry, it ends the sessions of instances that died
+	UpdatedAt time.Time `gorm:"type:TIMESTAMPTZ;"`
+}
+
+// SensorUptime is the time a sensor was connected within a period
+type SensorUptime struct {
+	SensorID         uuid.UUID
+	Sessions         int
+	ConnectedSeconds float64
+	UptimePercent    float64
+}
+
+// SensorFlapping is a sensor reconnecting too often within a window
+type SensorFlapping struct {
+	SensorID          uuid.UUID
+	Sessions          int
+	AvgSessionSeconds float64
+	LastConnectedAt   time.Time
+}
+
+// sessionEnd is the end of a session, the open ones end at their last update
+const sessionEnd = "COALESCE(disconnected_at, updated_at)"
+
+const (
+	// sessionSweepPeriod is how often the sessions of the instances that died are closed
+	sessionSweepPeriod = time.Minute
+	// staleSessionAge closes an open session not updated for two telemetry periods, whatever its instance
+	staleSessionAge = 2 * (constants.TelemetryMonitorPeriod + constants.TelemetryMonitorPeriodThreshold)
+)
+
+// GetSensorSessions returns the latest sessions of a sensor, newest first
+func GetSensorSessions(db *gorm.DB, sensorId uuid.UUID, limit int) (sessions []SensorSession, err error) {
+	err = db.Where("sensor_id = ?", sensorId).
+		Order("connected_at DESC").
+		Limit(limit).
+		Find(&sessions).Error
+	return
+}
+
+// GetSensorUptime returns the connected time of the sensors between from and to.
+// Overlapping sessions, e.g. a reconnect before the old connection timed out, are counted once.
+func GetSensorUptime(db *gorm.DB, from, to time.Time, sensorIds []uuid.UUID) (uptimes []SensorUptime, err error) {
+	if !to.After(from) {
+		err = fmt.Errorf("invalid period, from %v is not before to %v", from, to)
+		return
+	}
+
+	err = db.Raw(`WITH merged AS (
+		SELECT sensor_id
+			,COUNT(*) AS sessions
+			,range_agg(tstzrange(GREATEST(connected_at, ?), LEAST(`+sessionEnd+`, ?))) AS ranges
+		FROM sensor_sessions
+		WHERE sensor_id IN ?
+		AND connected_at < ?
+		AND `+sessionEnd+` > ?
+		GROUP BY sensor_id
+	)
+	SELECT sensor_id
+		,sessions
+		,COALESCE((SELECT SUM(EXTRACT(EPOCH FROM upper(r) - lower(r))) FROM unnest(ranges) AS r), 0) AS connected_seconds
+	FROM merged;`,
+		from, to, sensorIds, to, from).Scan(&uptimes).Error
+	if err != nil {
+		return
+	}
+
+	period := to.Sub(from).Seconds()
+	for i := range uptimes {
+		uptimes[i].UptimePercent = uptimes[i].ConnectedSeconds / period * 100
+	}
+	return
+}
+
+// GetFlappingSensors returns the sensors with at least minSessions connections within the window
+func GetFlappingSensors(db *gorm.DB, window time.Duration, minSessions int) (flapping []SensorFlapping, err error) {
+	err = db.Raw(`SELECT sensor_id
+		,COUNT(*) AS sessions
+		,avg(EXTRACT(EPOCH FROM `+sessionEnd+` - connected_at)) AS avg_session_seconds
+		,max(connected_at) AS last_connected_at
+	FROM sensor_sessions
+	WHERE connected_at > now() - ?::interval
+	GROUP BY sensor_id
+	HAVING COUNT(*) >= ?
+	ORDER BY sessions DESC;`,
+		fmt.Sprintf("%d seconds", int(window.Seconds())), minSessions).Scan(&flapping).Error
+	return
+}
+
+// openSensorSession stores the session of a new connection
+func (w *wsServer) openSensorSession(conn *sensorConnection) (err error) {
+	p := conn.presence(w.instanceId)
+	session := SensorSession{
+		ConnectionID:  conn.ConnectionId,
+		SensorID:      conn.SensorId,
+		SensorVersion: conn.SensorVersion,
+		InstanceID:    w.instanceId,
+		RemoteAddr:    conn.remoteAddr,
+		ConnectedAt:   conn.connectedSince,
+		UpdatedAt:     p.UpdatedAt,
+	}
+	err = w.dbClient.Create(&session).Error
+	if err != nil {
+		dbErrors.WithLabelValues("insert_session").Inc()
+		err = fmt.Errorf("failed to store sensor session:%v", err)
+	}
+	return
+}
+
+// updateSensorSession stores the traffic counters of the connection
+func (w *wsServer) updateSensorSession(conn *sensorConnection) (err error) {
+	err = w.dbClient.Model(&SensorSession{}).
+		Where("connection_id = ?", conn.ConnectionId).
+		Updates(sessionCounters(conn.presence(w.instanceId))).Error
+	if err != nil {
+		dbErrors.WithLabelValues("update_session").Inc()
+		err = fmt.Errorf("failed to update sensor session:%v", err)
+	}
+	return
+}
+
+// closeSensorSession stores the disconnect time and reason of the connection
+func (w *wsServer) closeSensorSession(conn *sensorConnection, reason string) (err error) {
+	p := conn.presence(w.instanceId)
+	fields := sessionCounters(p)
+	fields["disconnected_at"] = p.UpdatedAt
+	fields["disconnect_reason"] = reason
+
+	err = w.dbClient.Model(&SensorSession{}).
+		Where("connection_id = ?", conn.ConnectionId).
+		Updates(fields).Error
+	if err != nil {
+		dbErrors.WithLabelValues("update_session").Inc()
+		err = fmt.Errorf("failed to close sensor session:%v", err)
+	}
+	return
+}
+
+// closeStaleSensorSessions ends the sessions left open by a previous run of this instance
+func (w *wsServer) closeStaleSensorSessions() (err error) {
+	err = w.dbClient.Model(&SensorSession{}).
+		Where("instance_id = ? AND disconnected_at IS NULL", w.instanceId).
+		Updates(map[string]interface{}{
+			"disconnected_at":   gorm.Expr("updated_at"),
+			"disconnect_reason": "server_restart",
+		}).Error
+	if err != nil {
+		dbErrors.WithLabelValues("update_session").Inc()
+		err = fmt.Errorf("failed to close stale sensor sessions:%v", err)
+	}
+	return
+}
+
+// sensorSessionSweeper closes the sessions of the instances that died, e.g. the crashed pods of a rollout,
+// which never run again with the same instance id
+func (w *wsServer) sensorSessionSweeper() {
+	for {
+		time.Sleep(sessionSweepPeriod)
+
+		err := w.closeOrphanedSensorSessions()
+		if err != nil {
+			logger.LogError(err.Error(), "sensorSessionSweeper", w.serverLogger)
+		}
+	}
+}
+
+// closeOrphanedSensorSessions ends the open sessions not updated for staleSessionAge,
+// and those of the instances missing from the registry, at their last update
+func (w *wsServer) closeOrphanedSensorSessions() (err error) {
+	instances, err := w.listInstances()
+	if err != nil {
+		return
+	}
+	alive := []string{w.instanceId}
+	for _, instance := range instances {
+		alive = append(alive, instance.InstanceId)
+	}
+
+	now := time.Now().UTC()
+	// an instance may have opened a session right before its first heartbeat
+	err = w.dbClient.Model(&SensorSession{}).
+		Where("disconnected_at IS NULL").
+		Where("updated_at < ? OR (instance_id NOT IN ? AND updated_at < ?)", now.Add(-staleSessionAge), alive, now.Add(-instanceHeartbeatTtl)).
+		Updates(map[string]interface{}{
+			"disconnected_at":   gorm.Expr("updated_at"),
+			"disconnect_reason": "instance_gone",
+		}).Error
+	if err != nil {
+		dbErrors.WithLabelValues("update_session").Inc()
+		err = fmt.Errorf("failed to close orphaned sensor sessions:%v", err)
+	}
+	return
+}
+
+func sessionCounters(p sensorPresence) map[string]interface{} {
+	return map[string]interface{}{
+		"messages_in":  p.MessagesIn,
+		"messages_out": p.MessagesOut,
+		"bytes_in":     p.BytesIn,
+		"bytes_out":    p.BytesOut,
+		"updated_at":   p.UpdatedAt,
+	}
+}
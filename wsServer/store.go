@@ -2,162 +2,141 @@ package server
 
 import (
 	"fmt"
-	"strings"
+	"net"
+	"reflect"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/ping-42/42lib/db/models"
-	"github.com/ping-42/42lib/dns"
-	"github.com/ping-42/42lib/http"
-	"github.com/ping-42/42lib/icmp"
 	"github.com/ping-42/42lib/sensor"
-	"github.com/ping-42/42lib/traceroute"
+	"github.com/ping-42/server/wsServer/results"
+	"gorm.io/gorm"
 )
 
-func (w *wsServer) storeIcmpResults(sensorID uuid.UUID, taskID uuid.UUID, icmpRes icmp.Result) (err error) {
-
-	for _, res := range icmpRes.ResultPerIp {
-		icmpResult := models.TsIcmpResult{
-			TsSensorTaskBase: models.TsSensorTaskBase{
-				Time:     time.Now().UTC(),
-				SensorID: sensorID,
-				TaskID:   taskID,
-			},
-			IPAddr:          res.IPAddr,
-			PacketsSent:     res.PacketsSent,
-			PacketsReceived: res.PacketsReceived,
-			BytesWritten:    res.BytesWritten,
-			BytesRead:       res.BytesRead,
-			TotalRTT:        res.TotalRTT,
-			MinRTT:          res.MinRTT,
-			MaxRTT:          res.MaxRTT,
-			AverageRTT:      res.AverageRTT,
-			Loss:            res.Loss,
-			FailureMessages: strings.Join(res.FailureMessages, ";"),
+// insertBatchSize is the max number of rows in a single INSERT
+const insertBatchSize = 500
+
+// ingestRows collects the rows of one or more messages, flush inserts them with one statement per table
+type ingestRows struct {
+	// tables holds a slice of rows per model type, in the order of their first insert
+	tables []reflect.Value
+	// afterCommit runs once the rows are committed, e.g. the post processing of the results
+	afterCommit []func()
+	// pending are the rows of the other messages of the flush, not inserted yet
+	pending *ingestRows
+}
+
+// Insert adds rows, a model or a slice of models
+func (r *ingestRows) Insert(rows any) {
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice {
+		v = reflect.Append(reflect.MakeSlice(reflect.SliceOf(v.Type()), 0, 1), v)
+	}
+	if v.Len() == 0 {
+		return
+	}
+	for i, table := range r.tables {
+		if table.Type() == v.Type() {
+			r.tables[i] = reflect.AppendSlice(table, v)
+			return
 		}
-		err = w.dbClient.Create(&icmpResult).Error
+	}
+	r.tables = append(r.tables, reflect.AppendSlice(reflect.MakeSlice(v.Type(), 0, v.Len()), v))
+}
+
+// merge appends the rows of o, collected for a single message
+func (r *ingestRows) merge(o *ingestRows) {
+	for _, table := range o.tables {
+		r.Insert(table.Interface())
+	}
+	r.afterCommit = append(r.afterCommit, o.afterCommit...)
+}
+
+// flush inserts the collected rows using the given db handle
+func (r *ingestRows) flush(tx *gorm.DB) error {
+	for _, table := range r.tables {
+		err := tx.CreateInBatches(table.Interface(), insertBatchSize).Error
 		if err != nil {
-			return fmt.Errorf("failed to insert dns result: %v", err)
+			dbErrors.WithLabelValues("insert_rows").Inc()
+			return fmt.Errorf("failed to insert %v %v rows: %v", table.Len(), table.Type().Elem().Name(), err)
 		}
 	}
-	return
+	return nil
 }
 
-func (w *wsServer) storeHttpResults(sensorID uuid.UUID, taskID uuid.UUID, httpRes http.Result, headersJson []byte) (err error) {
-	httpResult := models.TsHttpResult{
-		TsSensorTaskBase: models.TsSensorTaskBase{
-			Time:     time.Now().UTC(),
-			SensorID: sensorID,
-			TaskID:   taskID,
-		},
-		ResponseCode:     httpRes.ResponseCode,
-		DNSLookup:        httpRes.DNSLookup,
-		TCPConnection:    httpRes.TCPConnection,
-		TLSHandshake:     httpRes.TLSHandshake,
-		ServerProcessing: httpRes.ServerProcessing,
-		NameLookup:       httpRes.NameLookup,
-		Connect:          httpRes.Connect,
-		Pretransfer:      httpRes.Pretransfer,
-		StartTransfer:    httpRes.StartTransfer,
-		//
-		ResponseBody:    httpRes.ResponseBody,
-		ResponseHeaders: headersJson,
+// pendingRows returns the rows of type T collected so far
+func pendingRows[T any](r *ingestRows) []T {
+	if r == nil {
+		return nil
 	}
-	err = w.dbClient.Create(&httpResult).Error
-	if err != nil {
-		return fmt.Errorf("failed to insert dns result: %v", err)
+	for _, table := range r.tables {
+		if rows, ok := table.Interface().([]T); ok {
+			return rows
+		}
 	}
-
-	return
+	return nil
 }
 
-func (w *wsServer) storeDnsResults(sensorID uuid.UUID, taskID uuid.UUID, dnsRes dns.Result) (err error) {
-	taskBase := models.TsSensorTaskBase{
-		Time:     time.Now().UTC(),
-		SensorID: sensorID,
-		TaskID:   taskID,
+// committed runs the afterCommit functions, once the transaction of the rows is committed
+func (r *ingestRows) committed() {
+	for _, fn := range r.afterCommit {
+		fn()
 	}
+}
 
-	dnsResult := models.TsDnsResult{
-		TsSensorTaskBase: taskBase,
-		QueryRtt:         dnsRes.QueryRtt.Milliseconds(),
-		SocketRtt:        dnsRes.SockRtt.Milliseconds(),
-		RespSize:         dnsRes.RespSize,
-		Proto:            dnsRes.Proto,
-	}
-	err = w.dbClient.Create(&dnsResult).Error
-	if err != nil {
-		return fmt.Errorf("failed to insert TsDnsResult result: %v", err)
-	}
+// resultStore is the results.Store of a result, its rows are inserted in the transaction of the DBReader
+type resultStore struct {
+	results.DBReader
+	rows *ingestRows
+}
 
-	// store AnswerA per DNS
-	for _, answer := range dnsRes.AnswerA {
-		httpResultAnswer := models.TsDnsResultAnswer{
-			TsSensorTaskBase: taskBase,
-			HdrName:          answer.Hdr.Name,
-			HdrRrtype:        answer.Hdr.Rrtype,
-			HdrClass:         answer.Hdr.Class,
-			HdrTtl:           answer.Hdr.Ttl,
-			HdrRdlength:      answer.Hdr.Rrtype,
-			A:                answer.A,
-		}
+func (s resultStore) Insert(rows any) { s.rows.Insert(rows) }
 
-		err := w.dbClient.Create(&httpResultAnswer).Error
-		if err != nil {
-			return fmt.Errorf("failed to insert TsDnsResultAnswer answer: %v", err)
+// PreviousHttpBody also looks at the bodies pending in the flush, the previous check of the sensor may be one of them
+func (s resultStore) PreviousHttpBody(sensorId uuid.UUID, url string, before time.Time) (body results.TsHttpBody, ok bool, err error) {
+	body, ok, err = s.DBReader.PreviousHttpBody(sensorId, url, before)
+	if err != nil {
+		return
+	}
+	for _, pending := range pendingRows[results.TsHttpBody](s.rows.pending) {
+		if pending.SensorID == sensorId && pending.Url == url && pending.Time.Before(before) && pending.BodySha256 != "" &&
+			(!ok || pending.Time.After(body.Time)) {
+			body, ok = pending, true
 		}
 	}
 	return
 }
 
-func (w *wsServer) storeTracerouteResults(sensorID uuid.UUID, taskID uuid.UUID, tracerouteRes traceroute.Result) (err error) {
-	// high level traceroute result
-	tracerouteResult := models.TsTracerouteResult{
-		TsSensorTaskBase: models.TsSensorTaskBase{
-			Time:     time.Now().UTC(),
-			SensorID: sensorID,
-			TaskID:   taskID,
-		},
-		DestinationAdress: tracerouteRes.DestinationAdress,
-	}
-
-	// save the TsTracerouteResult
-	err = w.dbClient.Create(&tracerouteResult).Error
+// PreviousTraceroutePath also looks at the paths pending in the flush, the previous run of the sensor may be one of them
+func (s resultStore) PreviousTraceroutePath(sensorId uuid.UUID, target net.IP, before time.Time) (path results.TsTraceroutePath, ok bool, err error) {
+	path, ok, err = s.DBReader.PreviousTraceroutePath(sensorId, target, before)
 	if err != nil {
-		return fmt.Errorf("failed to insert TsTracerouteResult: %v", err)
+		return
 	}
-
-	// sinsert hop one by one
-	for _, hop := range tracerouteRes.Hops {
-		tracerouteHop := models.TsTracerouteResultHop{
-			TsSensorTaskBase: models.TsSensorTaskBase{
-				Time:     time.Now().UTC(),
-				SensorID: sensorID,
-				TaskID:   taskID,
-			},
-			Success:       hop.Success,
-			Address:       hop.Address,
-			Host:          hop.Host,
-			BytesReceived: hop.BytesReceived,
-			ElapsedTime:   hop.ElapsedTime,
-			TTL:           hop.TTL,
-			Error:         fmt.Sprint(hop.Error),
+	for _, pending := range pendingRows[results.TsTraceroutePath](s.rows.pending) {
+		if pending.SensorID == sensorId && pending.Target.Equal(target) && pending.Time.Before(before) &&
+			(!ok || pending.Time.After(path.Time)) {
+			path, ok = pending, true
 		}
+	}
+	return
+}
 
-		// save each hop
-		err = w.dbClient.Create(&tracerouteHop).Error
-		if err != nil {
-			return fmt.Errorf("failed to insert TsTracerouteResultHop: %v", err)
+// HttpResponseBody also looks at the http results pending in the flush
+func (s resultStore) HttpResponseBody(taskId uuid.UUID, sensorId uuid.UUID, at time.Time) (body string, ok bool, err error) {
+	for _, pending := range pendingRows[models.TsHttpResult](s.rows.pending) {
+		if pending.TaskID == taskId && pending.SensorID == sensorId && pending.Time.Equal(at) {
+			return pending.ResponseBody, true, nil
 		}
 	}
-
-	return nil
+	return s.DBReader.HttpResponseBody(taskId, sensorId, at)
 }
 
-func (w *wsServer) storeHostRuntimeStat(sensorID uuid.UUID, ht sensor.HostTelemetry, time time.Time) (err error) {
-	runtimeStats := models.TsHostRuntimeStat{
+// addTelemetry collects the runtime and network stats of a single telemetry sample
+func (r *ingestRows) addTelemetry(sensorID uuid.UUID, ht sensor.HostTelemetry, measuredAt time.Time) {
+	r.Insert(models.TsHostRuntimeStat{
 		SensorID:       sensorID,
-		Time:           time,
+		Time:           measuredAt,
 		GoRoutineCount: ht.GoRoutines,
 		CpuCores:       ht.Cpu.Cores,
 		CpuUsage:       ht.Cpu.CpuUsage,
@@ -166,33 +145,19 @@ func (w *wsServer) storeHostRuntimeStat(sensorID uuid.UUID, ht sensor.HostTeleme
 		MemUsed:        ht.Memory.Used,
 		MemFree:        ht.Memory.Free,
 		MemUsedPercent: ht.Memory.UsedPercent,
-	}
+	})
 
-	err = w.dbClient.Create(&runtimeStats).Error
-	if err != nil {
-		return fmt.Errorf("failed to insert runtime stats: %v", err)
-	}
-	return
-}
-
-func (w *wsServer) storeHostNetworkStats(sensorID uuid.UUID, networkTelemetry []sensor.Network, time time.Time) (err error) {
 	// high level network stat result
 	hostNetworkStat := models.TsHostNetworkStat{
-		Time:     time,
+		Time:     measuredAt,
 		SensorID: sensorID,
 	}
+	r.Insert(hostNetworkStat)
 
-	// savehost network stat
-	err = w.dbClient.Create(&hostNetworkStat).Error
-	if err != nil {
-		return fmt.Errorf("failed to insert TsHostNetworkStat: %v", err)
-	}
-
-	// prepare to store stats for each interface.
-	var networkInterfaceStats []models.TsNetworkInterfaceStat
-	for _, netStat := range networkTelemetry {
-		// append network interface's stats to the list.
-		networkInterfaceStats = append(networkInterfaceStats, models.TsNetworkInterfaceStat{
+	// stats for each interface
+	interfaceStats := make([]models.TsNetworkInterfaceStat, 0, len(ht.Network))
+	for _, netStat := range ht.Network {
+		interfaceStats = append(interfaceStats, models.TsNetworkInterfaceStat{
 			NetworkStatID: hostNetworkStat.SensorID,
 			InterfaceName: netStat.Name,
 			BytesSent:     netStat.BytesSent,
@@ -201,12 +166,5 @@ func (w *wsServer) storeHostNetworkStats(sensorID uuid.UUID, networkTelemetry []
 			PacketsRecv:   netStat.PacketsRecv,
 		})
 	}
-
-	// save collected network interface stats
-	err = w.dbClient.Create(&networkInterfaceStats).Error
-	if err != nil {
-		return fmt.Errorf("failed to insert TsNetworkInterfaceStat: %v", err)
-	}
-
-	return nil
+	r.Insert(interfaceStats)
 }
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/server/wsServer/results"
+)
+
+func TestPendingRows(t *testing.T) {
+	var rows ingestRows
+	if pending := pendingRows[results.TsHttpBody](&rows); len(pending) != 0 {
+		t.Errorf("pending rows of an empty flush = %+v", pending)
+	}
+	if pending := pendingRows[results.TsHttpBody](nil); len(pending) != 0 {
+		t.Errorf("pending rows without a flush = %+v", pending)
+	}
+
+	rows.Insert(results.TsHttpBody{Url: "https://example.com/"})
+	var itemRows ingestRows
+	itemRows.Insert([]results.TsHttpBody{{Url: "https://example.com/a"}, {Url: "https://example.com/b"}})
+	itemRows.Insert(results.TsTraceroutePath{})
+	rows.merge(&itemRows)
+
+	pending := pendingRows[results.TsHttpBody](&rows)
+	if len(pending) != 3 || pending[0].Url != "https://example.com/" || pending[2].Url != "https://example.com/b" {
+		t.Errorf("pending bodies = %+v", pending)
+	}
+	if pending := pendingRows[results.TsTraceroutePath](&rows); len(pending) != 1 {
+		t.Errorf("pending paths = %+v", pending)
+	}
+}
+
+func TestIngestQueueOf(t *testing.T) {
+	p := ingestPipeline{queues: make([]chan ingestItem, 4)}
+	for i := range p.queues {
+		p.queues[i] = make(chan ingestItem, 1)
+	}
+	used := map[chan ingestItem]bool{}
+	for i := 0; i < 100; i++ {
+		sensorId := uuid.New()
+		queue := p.queueOf(sensorId)
+		if p.queueOf(sensorId) != queue {
+			t.Fatalf("the messages of %v go to several queues", sensorId)
+		}
+		used[queue] = true
+	}
+	if len(used) != len(p.queues) {
+		t.Errorf("%v of the %v queues used", len(used), len(p.queues))
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/ping-42/42lib/config/consts"
+	"github.com/ping-42/42lib/logger"
+	"github.com/ping-42/42lib/sensor"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// redisRouterLeaderKey is held by the instance routing the scheduler tasks
+	redisRouterLeaderKey = "server_task_router_leader"
+	routerLeaderTtl      = 15 * time.Second
+	routerLeaderRenew    = 5 * time.Second
+)
+
+// renewLeaderScript extends the leadership only if this instance still holds it
+var renewLeaderScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseLeaderScript drops the leadership only if this instance still holds it
+var releaseLeaderScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// taskRouterElection runs the task router on a single instance at a time, in targeted routing.
+// Another instance takes over once the leader stops renewing its key.
+func (w *wsServer) taskRouterElection() {
+	var pubsub *redis.PubSub
+	var stop chan struct{}
+	for {
+		leader, err := w.renewRouterLeadership()
+		if err != nil {
+			w.serverLogger.Error(err.Error())
+		}
+		w.routerLeader.Store(leader)
+
+		switch {
+		case leader && pubsub == nil:
+			w.serverLogger.Info("Became the task router leader")
+			pubsub = w.redisClient.Subscribe(consts.SchedulerNewTaskChannel)
+			stop = make(chan struct{})
+			go w.taskRouter(pubsub, stop)
+		case !leader && pubsub != nil:
+			w.serverLogger.Info("Lost the task router leadership")
+			close(stop)
+			_ = pubsub.Close()
+			pubsub = nil
+		}
+
+		time.Sleep(routerLeaderRenew)
+	}
+}
+
+// renewRouterLeadership acquires or extends the router leadership
+func (w *wsServer) renewRouterLeadership() (leader bool, err error) {
+	acquired, err := w.redisClient.SetNX(redisRouterLeaderKey, w.instanceId, routerLeaderTtl).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("router_leader").Inc()
+		return false, fmt.Errorf("failed to acquire the router leadership:%v", err)
+	}
+	if acquired {
+		return true, nil
+	}
+
+	renewed, err := renewLeaderScript.Run(w.redisClient, []string{redisRouterLeaderKey}, w.instanceId, routerLeaderTtl.Milliseconds()).Int64()
+	if err != nil {
+		redisErrors.WithLabelValues("router_leader").Inc()
+		return false, fmt.Errorf("failed to renew the router leadership:%v", err)
+	}
+	return renewed == 1, nil
+}
+
+// taskRouter forwards the scheduler tasks to the channel of the instance holding the sensor
+func (w *wsServer) taskRouter(pubsub *redis.PubSub, stop <-chan struct{}) {
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			redisErrors.WithLabelValues("pubsub_receive").Inc()
+			logger.LogError(err.Error(), "taskRouter, error receiving message", w.serverLogger)
+			continue
+		}
+
+		err = w.routeTask(msg.Payload)
+		if err != nil {
+			logger.LogError(err.Error(), "taskRouter, error routing task", w.serverLogger)
+		}
+	}
+}
+
+// routeTask publishes the task on the channel of the instance holding the sensor
+func (w *wsServer) routeTask(payload string) (err error) {
+	instanceId, ok, err := w.taskOwner(payload)
+	if err != nil || !ok {
+		return
+	}
+
+	err = w.redisClient.Publish(instanceTaskChannel(instanceId), payload).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("publish_task").Inc()
+		return fmt.Errorf("failed to route the task to instance %v:%v", instanceId, err)
+	}
+	routedTasks.WithLabelValues(routeRouted).Inc()
+	return
+}
+
+// taskOwner returns the live instance holding the sensor of the task, ok is false if there is none
+func (w *wsServer) taskOwner(payload string) (instanceId string, ok bool, err error) {
+	var task sensor.Task
+	err = json.Unmarshal([]byte(payload), &task)
+	if err != nil {
+		err = fmt.Errorf("error unmarshal message:%v, err:%v", payload, err)
+		return
+	}
+
+	var serverLogger = w.serverLogger.WithFields(log.Fields{
+		"sensorId": task.SensorId,
+		"taskId":   task.Id,
+	})
+
+	presence, exists, err := w.getSensorPresence(task.SensorId)
+	if err != nil {
+		return
+	}
+	if !exists {
+		routedTasks.WithLabelValues(routeSensorOffline).Inc()
+		err = w.queuePendingTask(task, payload)
+		return
+	}
+
+	alive, err := w.isInstanceAlive(presence.InstanceId)
+	if err != nil {
+		return
+	}
+	if !alive {
+		routedTasks.WithLabelValues(routeInstanceDown).Inc()
+		// the sensor reconnects to another instance
+		serverLogger.Info(fmt.Sprintf("The instance %v holding the sensor is down, queuing task", presence.InstanceId))
+		err = w.queuePendingTask(task, payload)
+		return
+	}
+	return presence.InstanceId, true, nil
+}
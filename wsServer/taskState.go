@@ -0,0 +1,155 @@
+package server
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/db/models"
+	"gorm.io/gorm"
+)
+
+// TaskState is the task_status_id of a task, the values match lv_task_statuses
+type TaskState uint8
+
+const (
+	TaskInitiated        TaskState = models.TASK_STATUS_INITIATED_BY_SCHEDULER
+	TaskPublished        TaskState = models.TASK_STATUS_PUBLISHED_TO_REDIS_BY_SCHEDULER
+	TaskReceivedByServer TaskState = models.TASK_STATUS_RECEIVED_BY_SERVER
+	TaskSentToSensor     TaskState = models.TASK_STATUS_SENT_TO_SENSOR_BY_SERVER
+	TaskReceivedBySensor TaskState = models.TASK_STATUS_RECEIVED_BY_SENSOR
+	TaskResultsSent      TaskState = models.TASK_STATUS_RESULTS_SENT_TO_SERVER_BY_SENSOR
+	TaskResultsReceived  TaskState = models.TASK_STATUS_RESULTS_RECEIVED_BY_SERVER
+	TaskDone             TaskState = models.TASK_STATUS_DONE
+	TaskError            TaskState = models.TASK_STATUS_ERROR
+	// TaskExpired is set on the tasks that were still queued for their offline sensor at their deadline
+	TaskExpired TaskState = 10
+	// TaskTimedOut is set on the tasks sent to a sensor that did not answer before the deadline of the task type
+	TaskTimedOut TaskState = 11
+)
+
+var taskStateNames = map[TaskState]string{
+	TaskInitiated:        "INITIATED_BY_SCHEDULER",
+	TaskPublished:        "PUBLISHED_TO_REDIS_BY_SCHEDULER",
+	TaskReceivedByServer: "RECEIVED_BY_SERVER",
+	TaskSentToSensor:     "SENT_TO_SENSOR_BY_SERVER",
+	TaskReceivedBySensor: "RECEIVED_BY_SENSOR",
+	TaskResultsSent:      "RESULTS_SENT_TO_SERVER_BY_SENSOR",
+	TaskResultsReceived:  "RESULTS_RECEIVED_BY_SERVER",
+	TaskDone:             "DONE",
+	TaskError:            "ERROR",
+	TaskExpired:          "EXPIRED",
+	TaskTimedOut:         "TIMED_OUT",
+}
+
+func (s TaskState) String() string {
+	if name, ok := taskStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("TaskState(%d)", uint8(s))
+}
+
+// Value stores the state as its id, not as its name
+func (s TaskState) Value() (driver.Value, error) {
+	return int64(s), nil
+}
+
+// taskTransitions lists the states each state may be reached from
+var taskTransitions = map[TaskState][]TaskState{
+	// a task may be received again when its delivery is retried
+	TaskReceivedByServer: {TaskInitiated, TaskPublished, TaskReceivedByServer},
+	TaskSentToSensor:     {TaskReceivedByServer},
+	// the result may come before the SENT status is written. TIMED_OUT is terminal, a late result is rejected.
+	TaskResultsReceived: {TaskReceivedByServer, TaskSentToSensor, TaskReceivedBySensor, TaskResultsSent},
+	TaskDone:            {TaskResultsReceived},
+	TaskError:           {TaskInitiated, TaskPublished, TaskReceivedByServer, TaskSentToSensor, TaskReceivedBySensor, TaskResultsSent, TaskResultsReceived},
+	TaskExpired:         {TaskInitiated, TaskPublished, TaskReceivedByServer},
+	TaskTimedOut:        {TaskSentToSensor, TaskReceivedBySensor, TaskResultsSent},
+}
+
+// errInvalidTransition is returned when the task is not in a state the target state may be reached from,
+// e.g. a duplicate result of a task already DONE
+var errInvalidTransition = errors.New("invalid task state transition")
+
+// TaskTransition is the history of the task states, written with each transition
+type TaskTransition struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement"`
+	TaskID     uuid.UUID `gorm:"type:uuid;not null"`
+	FromState  TaskState `gorm:"not null"`
+	ToState    TaskState `gorm:"not null"`
+	Time       time.Time `gorm:"type:TIMESTAMPTZ;not null"`
+	InstanceID string
+	Reason     string
+}
+
+// transitionResult is returned by the conditional update
+type transitionResult struct {
+	FromState      TaskState
+	SubscriptionID uint64
+	CreatedAt      time.Time
+}
+
+// transitionTask moves the task to the state if its current state allows it, and records the transition.
+// The task columns needed by the callers are returned. errInvalidTransition is returned with the current state
+// if the move is not allowed, nothing is changed then.
+func (w *wsServer) transitionTask(db *gorm.DB, taskId uuid.UUID, to TaskState, reason string) (task transitionResult, err error) {
+	from, ok := taskTransitions[to]
+	if !ok {
+		return task, fmt.Errorf("%w: no transition to %v", errInvalidTransition, to)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// the row lock makes the check and the update atomic, and returns the previous state
+		res := tx.Raw(`
+			UPDATE tasks t SET task_status_id = @to
+			FROM (SELECT id, task_status_id FROM tasks WHERE id = @id FOR UPDATE) prev
+			WHERE t.id = prev.id AND prev.task_status_id IN @from
+			RETURNING prev.task_status_id AS from_state, t.subscription_id, t.created_at`,
+			map[string]interface{}{"to": to, "id": taskId, "from": from},
+		).Scan(&task)
+		if res.Error != nil {
+			dbErrors.WithLabelValues("update_task_status").Inc()
+			return fmt.Errorf("error updating task %v to %v: %v", taskId, to, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return w.rejectedTransition(tx, taskId, to)
+		}
+
+		err := tx.Create(&TaskTransition{
+			TaskID:     taskId,
+			FromState:  task.FromState,
+			ToState:    to,
+			Time:       time.Now().UTC(),
+			InstanceID: w.instanceId,
+			Reason:     reason,
+		}).Error
+		if err != nil {
+			dbErrors.WithLabelValues("insert_task_transition").Inc()
+			return fmt.Errorf("error storing the transition of task %v to %v: %v", taskId, to, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	observeTaskStatus(to)
+	return
+}
+
+// rejectedTransition builds the error of a transition not allowed from the current state of the task
+func (w *wsServer) rejectedTransition(tx *gorm.DB, taskId uuid.UUID, to TaskState) error {
+	taskTransitionsRejected.WithLabelValues(to.String()).Inc()
+
+	var current []uint8
+	err := tx.Model(&models.Task{}).Where("id = ?", taskId).Pluck("task_status_id", &current).Error
+	if err != nil {
+		dbErrors.WithLabelValues("load_task").Inc()
+		return fmt.Errorf("%w to %v of task %v, loading the current state err:%v", errInvalidTransition, to, taskId, err)
+	}
+	if len(current) == 0 {
+		return fmt.Errorf("%w to %v, task %v not found", errInvalidTransition, to, taskId)
+	}
+	return fmt.Errorf("%w from %v to %v of task %v", errInvalidTransition, TaskState(current[0]), to, taskId)
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/ping-42/42lib/logger"
+	"github.com/ping-42/42lib/sensor"
+)
+
+const (
+	// SchedulerTaskStream is the stream the scheduler adds the tasks to in streams intake,
+	// the task json is in the TaskStreamField of the entry
+	SchedulerTaskStream = "SCHEDULER_TASK_STREAM"
+	// InstanceTaskStreamPrefix + instance id is the stream the tasks of the sensors held by the instance are routed to
+	InstanceTaskStreamPrefix = "SERVER_INSTANCE_TASK_STREAM_"
+	// TaskDeadLetterStream receives the tasks that could not be delivered after TaskMaxDeliveries attempts
+	TaskDeadLetterStream = "SERVER_TASK_DEAD_LETTER_STREAM"
+	// TaskStreamField holds the task json in the stream entries
+	TaskStreamField = "task"
+	// DefaultTaskMaxDeliveries is the number of deliveries of a task before it is dead lettered
+	DefaultTaskMaxDeliveries = 5
+
+	// taskStreamGroup is the consumer group of all the instances, each instance is a consumer named by its id
+	taskStreamGroup = "ping42-server"
+	// taskAttemptsField counts the deliveries of the task across the streams it went through
+	taskAttemptsField = "attempts"
+	// redisStreamReclaimKeyPrefix + instance id is held by the instance moving the tasks of a dead instance
+	redisStreamReclaimKeyPrefix = "server_stream_reclaim_"
+
+	taskStreamReadBlock     = 5 * time.Second
+	taskStreamReadCount     = 100
+	taskStreamReclaimIdle   = time.Minute
+	taskStreamReclaimPeriod = 30 * time.Second
+	deadLetterMaxLen        = 10000
+)
+
+// Task intake modes
+const (
+	// TaskIntakePubSub receives the tasks from the scheduler pubsub channel, the tasks published while no instance listens are lost
+	TaskIntakePubSub = "pubsub"
+	// TaskIntakeStreams receives the tasks from the scheduler stream and acks them once sent to the sensor
+	TaskIntakeStreams = "streams"
+)
+
+func instanceTaskStream(instanceId string) string {
+	return InstanceTaskStreamPrefix + instanceId
+}
+
+// taskIntake returns the configured intake mode, pubsub by default
+func (w *wsServer) taskIntake() string {
+	if w.opts.TaskIntake == "" {
+		return TaskIntakePubSub
+	}
+	return w.opts.TaskIntake
+}
+
+func (w *wsServer) taskMaxDeliveries() int64 {
+	if w.opts.TaskMaxDeliveries <= 0 {
+		return DefaultTaskMaxDeliveries
+	}
+	return int64(w.opts.TaskMaxDeliveries)
+}
+
+// ensureStreamGroup creates the consumer group and the stream if missing
+func (w *wsServer) ensureStreamGroup(stream string) (err error) {
+	err = w.redisClient.XGroupCreateMkStream(stream, taskStreamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		redisErrors.WithLabelValues("stream_group").Inc()
+		return fmt.Errorf("failed to create the consumer group of %v:%v", stream, err)
+	}
+	return nil
+}
+
+// streamsListener reads the scheduler stream, where any instance may route the task,
+// and the stream of this instance, where the tasks are sent to the sensors.
+// The entries are acked once handled, the others stay pending and are reclaimed.
+func (w *wsServer) streamsListener() {
+	// the liveness probe fails once the listener stops
+	w.listenerRunning.Store(true)
+	defer func() {
+		w.listenerRunning.Store(false)
+		w.serverLogger.Error("Scheduler stream listener stopped, no more tasks will be dispatched")
+	}()
+
+	ownStream := instanceTaskStream(w.instanceId)
+	for _, stream := range []string{SchedulerTaskStream, ownStream} {
+		for {
+			err := w.ensureStreamGroup(stream)
+			if err == nil {
+				break
+			}
+			logger.LogError(err.Error(), "streamsListener", w.serverLogger)
+			time.Sleep(taskStreamReadBlock)
+		}
+	}
+
+	for {
+		streams, err := w.redisClient.XReadGroup(&redis.XReadGroupArgs{
+			Group:    taskStreamGroup,
+			Consumer: w.instanceId,
+			Streams:  []string{SchedulerTaskStream, ownStream, ">", ">"},
+			Count:    taskStreamReadCount,
+			Block:    taskStreamReadBlock,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			redisErrors.WithLabelValues("stream_read").Inc()
+			logger.LogError(err.Error(), "XReadGroup, error reading the task streams", w.serverLogger)
+			// the group is gone if the stream was deleted
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				_ = w.ensureStreamGroup(SchedulerTaskStream)
+				_ = w.ensureStreamGroup(ownStream)
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				w.handleStreamTask(stream.Stream, msg, 1)
+			}
+		}
+	}
+}
+
+// handleStreamTask routes or dispatches the entry, deliveries is the number of times the group delivered it
+func (w *wsServer) handleStreamTask(stream string, msg redis.XMessage, deliveries int64) {
+	payload, _ := msg.Values[TaskStreamField].(string)
+	attempts := streamTaskAttempts(msg) + deliveries
+
+	if attempts > w.taskMaxDeliveries() {
+		err := w.deadLetterTask(stream, msg, attempts, "max deliveries reached")
+		if err != nil {
+			logger.LogError(err.Error(), "handleStreamTask, error dead lettering the task", w.serverLogger)
+		}
+		return
+	}
+
+	var err error
+	if stream == SchedulerTaskStream {
+		err = w.routeStreamTask(payload, attempts)
+	} else {
+		err = w.dispatchTask(payload)
+	}
+	if err != nil {
+		streamTasks.WithLabelValues(streamTaskRetry).Inc()
+		logger.LogError(err.Error(), fmt.Sprintf("handleStreamTask, the task %v stays pending in %v", msg.ID, stream), w.serverLogger)
+		return
+	}
+
+	err = w.ackStreamTask(stream, msg.ID)
+	if err != nil {
+		logger.LogError(err.Error(), "handleStreamTask", w.serverLogger)
+		return
+	}
+	streamTasks.WithLabelValues(streamTaskAcked).Inc()
+}
+
+// routeStreamTask adds the task to the stream of the instance holding the sensor
+func (w *wsServer) routeStreamTask(payload string, attempts int64) (err error) {
+	instanceId, ok, err := w.taskOwner(payload)
+	if err != nil || !ok {
+		return
+	}
+
+	err = w.redisClient.XAdd(&redis.XAddArgs{
+		Stream: instanceTaskStream(instanceId),
+		Values: map[string]interface{}{TaskStreamField: payload, taskAttemptsField: attempts},
+	}).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_add").Inc()
+		return fmt.Errorf("failed to route the task to the stream of instance %v:%v", instanceId, err)
+	}
+	routedTasks.WithLabelValues(routeRouted).Inc()
+	return
+}
+
+// ackStreamTask acks and deletes the entry, so the streams only hold the tasks not handled yet
+func (w *wsServer) ackStreamTask(stream string, id string) (err error) {
+	_, err = w.redisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAck(stream, taskStreamGroup, id)
+		pipe.XDel(stream, id)
+		return nil
+	})
+	if err != nil {
+		redisErrors.WithLabelValues("stream_ack").Inc()
+		err = fmt.Errorf("failed to ack the task %v in %v:%v", id, stream, err)
+	}
+	return
+}
+
+// deadLetterTask moves the entry to the dead letter stream and marks the task as failed
+func (w *wsServer) deadLetterTask(stream string, msg redis.XMessage, attempts int64, reason string) (err error) {
+	payload, _ := msg.Values[TaskStreamField].(string)
+	err = w.redisClient.XAdd(&redis.XAddArgs{
+		Stream:       TaskDeadLetterStream,
+		MaxLenApprox: deadLetterMaxLen,
+		Values: map[string]interface{}{
+			TaskStreamField:   payload,
+			taskAttemptsField: attempts,
+			"stream":          stream,
+			"id":              msg.ID,
+			"reason":          reason,
+			"instance":        w.instanceId,
+		},
+	}).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_add").Inc()
+		return fmt.Errorf("failed to dead letter the task %v:%v", msg.ID, err)
+	}
+	streamTasks.WithLabelValues(streamTaskDeadLettered).Inc()
+	w.serverLogger.Warn(fmt.Sprintf("task %v of %v dead lettered after %v attempts: %v", msg.ID, stream, attempts, reason))
+
+	err = w.ackStreamTask(stream, msg.ID)
+	if err != nil {
+		return
+	}
+
+	var task sensor.Task
+	if jsonErr := json.Unmarshal([]byte(payload), &task); jsonErr != nil {
+		return fmt.Errorf("error unmarshal dead lettered task:%v, err:%v", payload, jsonErr)
+	}
+	_, err = w.transitionTask(w.dbClient, task.Id, TaskError, fmt.Sprintf("dead lettered after %v attempts: %v", attempts, reason))
+	return
+}
+
+// streamTaskAttempts returns the deliveries the task had in the streams it was moved from
+func streamTaskAttempts(msg redis.XMessage) int64 {
+	s, _ := msg.Values[taskAttemptsField].(string)
+	attempts, _ := strconv.ParseInt(s, 10, 64)
+	return attempts
+}
+
+// streamsReclaimer periodically takes over the entries left pending by crashed consumers,
+// and moves the tasks of the dead instances back to the scheduler stream
+func (w *wsServer) streamsReclaimer() {
+	for {
+		time.Sleep(taskStreamReclaimPeriod)
+
+		for _, stream := range []string{SchedulerTaskStream, instanceTaskStream(w.instanceId)} {
+			err := w.reclaimPendingTasks(stream)
+			if err != nil {
+				logger.LogError(err.Error(), "streamsReclaimer", w.serverLogger)
+			}
+		}
+
+		err := w.reclaimDeadInstanceStreams()
+		if err != nil {
+			logger.LogError(err.Error(), "streamsReclaimer", w.serverLogger)
+		}
+	}
+}
+
+// reclaimPendingTasks claims the entries pending for longer than taskStreamReclaimIdle and handles them again
+func (w *wsServer) reclaimPendingTasks(stream string) (err error) {
+	pending, err := w.redisClient.XPendingExt(&redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  taskStreamGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  taskStreamReadCount,
+	}).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_pending").Inc()
+		return fmt.Errorf("failed to list the pending tasks of %v:%v", stream, err)
+	}
+
+	var ids []string
+	retries := make(map[string]int64)
+	for _, p := range pending {
+		if p.Idle < taskStreamReclaimIdle {
+			continue
+		}
+		ids = append(ids, p.Id)
+		retries[p.Id] = p.RetryCount
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	// the claim fails for the entries another instance claimed in between
+	msgs, err := w.redisClient.XClaim(&redis.XClaimArgs{
+		Stream:   stream,
+		Group:    taskStreamGroup,
+		Consumer: w.instanceId,
+		MinIdle:  taskStreamReclaimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_claim").Inc()
+		return fmt.Errorf("failed to claim the pending tasks of %v:%v", stream, err)
+	}
+
+	for _, msg := range msgs {
+		streamTasks.WithLabelValues(streamTaskReclaimed).Inc()
+		// the claim counts as one more delivery
+		w.handleStreamTask(stream, msg, retries[msg.ID]+1)
+	}
+	return
+}
+
+// reclaimDeadInstanceStreams moves the tasks left in the streams of the dead instances to the scheduler stream,
+// where they are routed again to the instance the sensor reconnected to
+func (w *wsServer) reclaimDeadInstanceStreams() (err error) {
+	iter := w.redisClient.Scan(0, InstanceTaskStreamPrefix+"*", 100).Iterator()
+	for iter.Next() {
+		stream := iter.Val()
+		instanceId := strings.TrimPrefix(stream, InstanceTaskStreamPrefix)
+		if instanceId == w.instanceId {
+			continue
+		}
+
+		alive, aliveErr := w.isInstanceAlive(instanceId)
+		if aliveErr != nil {
+			return aliveErr
+		}
+		if alive {
+			continue
+		}
+
+		moveErr := w.moveDeadInstanceStream(stream, instanceId)
+		if moveErr != nil {
+			logger.LogError(moveErr.Error(), "reclaimDeadInstanceStreams", w.serverLogger)
+		}
+	}
+	if err = iter.Err(); err != nil {
+		redisErrors.WithLabelValues("scan_instances").Inc()
+		err = fmt.Errorf("failed to scan the instance task streams in Redis:%v", err)
+	}
+	return
+}
+
+func (w *wsServer) moveDeadInstanceStream(stream string, instanceId string) (err error) {
+	// a single instance moves the stream
+	locked, err := w.redisClient.SetNX(redisStreamReclaimKeyPrefix+instanceId, w.instanceId, taskStreamReclaimPeriod).Result()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_reclaim").Inc()
+		return fmt.Errorf("failed to lock the stream of instance %v:%v", instanceId, err)
+	}
+	if !locked {
+		return
+	}
+
+	// the acked entries are deleted, what is left was not sent to the sensors
+	msgs, err := w.redisClient.XRange(stream, "-", "+").Result()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_read").Inc()
+		return fmt.Errorf("failed to read the stream of instance %v:%v", instanceId, err)
+	}
+
+	for _, msg := range msgs {
+		err = w.redisClient.XAdd(&redis.XAddArgs{
+			Stream: SchedulerTaskStream,
+			Values: map[string]interface{}{
+				TaskStreamField:   msg.Values[TaskStreamField],
+				taskAttemptsField: streamTaskAttempts(msg) + 1,
+			},
+		}).Err()
+		if err != nil {
+			redisErrors.WithLabelValues("stream_add").Inc()
+			return fmt.Errorf("failed to move the task %v of instance %v:%v", msg.ID, instanceId, err)
+		}
+		err = w.redisClient.XDel(stream, msg.ID).Err()
+		if err != nil {
+			redisErrors.WithLabelValues("stream_ack").Inc()
+			return fmt.Errorf("failed to delete the moved task %v of instance %v:%v", msg.ID, instanceId, err)
+		}
+		streamTasks.WithLabelValues(streamTaskReclaimed).Inc()
+	}
+
+	w.serverLogger.Info(fmt.Sprintf("Moved %v tasks of the dead instance %v to the scheduler stream", len(msgs), instanceId))
+	err = w.redisClient.Del(stream).Err()
+	if err != nil {
+		redisErrors.WithLabelValues("stream_reclaim").Inc()
+		err = fmt.Errorf("failed to delete the stream of instance %v:%v", instanceId, err)
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	gormtracing "gorm.io/plugin/opentelemetry/tracing"
+)
+
+const tracerName = "github.com/ping-42/server/wsServer"
+
+var tracer = otel.Tracer(tracerName)
+
+// traceEnvelope carries the W3C trace context in the task sent to the sensor,
+// the sensor echoes it back in the result so both ends join the same trace
+type traceEnvelope struct {
+	TraceContext propagation.MapCarrier `json:",omitempty"`
+}
+
+// initTracing exports the spans via OTLP/HTTP to otlpEndpoint, tracing stays a no-op when it is empty.
+// The returned shutdown flushes the pending spans.
+func initTracing(ctx context.Context, otlpEndpoint string, instanceId string, dbClient *gorm.DB) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	shutdown = func(context.Context) error { return nil }
+
+	if otlpEndpoint == "" {
+		return
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(otlpEndpoint))
+	if err != nil {
+		err = fmt.Errorf("otlp exporter err:%v", err)
+		return
+	}
+
+	resource, err := sdkresource.Merge(sdkresource.Default(), sdkresource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("ping42-server"),
+		semconv.ServiceInstanceID(instanceId),
+	))
+	if err != nil {
+		err = fmt.Errorf("otel resource err:%v", err)
+		return
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource),
+	)
+	otel.SetTracerProvider(provider)
+
+	// db spans for every query made with a context
+	err = dbClient.Use(gormtracing.NewPlugin(gormtracing.WithoutMetrics()))
+	if err != nil {
+		err = fmt.Errorf("gorm tracing plugin err:%v", err)
+		return
+	}
+
+	return provider.Shutdown, nil
+}
+
+// extractTraceContext returns ctx with the remote span context found in the message, if any
+func extractTraceContext(ctx context.Context, msg []byte) context.Context {
+	var envelope traceEnvelope
+	if err := json.Unmarshal(msg, &envelope); err != nil || len(envelope.TraceContext) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, envelope.TraceContext)
+}
+
+// injectTraceContext adds the span context of ctx to the JSON object in msg
+func injectTraceContext(ctx context.Context, msg []byte) ([]byte, error) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return msg, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil, fmt.Errorf("unmarshal message err:%v", err)
+	}
+	traceContext, err := json.Marshal(carrier)
+	if err != nil {
+		return nil, fmt.Errorf("marshal trace context err:%v", err)
+	}
+	fields["TraceContext"] = traceContext
+	return json.Marshal(fields)
+}
+
+// startRedisSpan is used around the Redis calls, the client has no tracing hooks
+func startRedisSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "redis."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "redis"), attribute.String("db.operation", operation)),
+	)
+}
+
+// endSpan records err on the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
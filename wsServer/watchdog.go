@@ -0,0 +1,311 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/dns"
+	"github.com/ping-42/42lib/http"
+	"github.com/ping-42/42lib/icmp"
+	"github.com/ping-42/42lib/sensor"
+	"github.com/ping-42/42lib/traceroute"
+	"github.com/ping-42/server/wsServer/results"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTaskTimeout applies to the task types without a timeout in defaultTaskTimeouts or in the options
+const DefaultTaskTimeout = 2 * time.Minute
+
+// defaultTaskTimeouts is how long a sensor has to answer each task type
+var defaultTaskTimeouts = map[sensor.TaskName]time.Duration{
+	dns.TaskName:        30 * time.Second,
+	icmp.TaskName:       time.Minute,
+	http.TaskName:       time.Minute,
+	traceroute.TaskName: 3 * time.Minute,
+	results.TlsTaskName: 30 * time.Second,
+	results.TcpTaskName: 30 * time.Second,
+}
+
+const watchdogPeriod = 5 * time.Second
+
+// farFuture is after the deadline of any task
+var farFuture = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Task timeout reasons
+const (
+	timeoutDeadline           = "deadline"
+	timeoutSensorDisconnected = "sensor_disconnected"
+)
+
+// inFlightTask is a task sent to the sensor and not answered yet
+type inFlightTask struct {
+	TaskId   uuid.UUID
+	TaskName sensor.TaskName
+	SentAt   time.Time
+	Deadline time.Time
+}
+
+// trackTask starts watching the task sent on the connection
+func (c *sensorConnection) trackTask(task inFlightTask) {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+	if c.inFlight == nil {
+		c.inFlight = make(map[uuid.UUID]inFlightTask)
+	}
+	c.inFlight[task.TaskId] = task
+}
+
+// untrackTask stops watching the task, tracked is false if it was not in flight on the connection
+func (c *sensorConnection) untrackTask(taskId uuid.UUID) (task inFlightTask, tracked bool) {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+	task, tracked = c.inFlight[taskId]
+	delete(c.inFlight, taskId)
+	return
+}
+
+// takeOverdueTasks stops watching and returns the tasks past their deadline at now
+func (c *sensorConnection) takeOverdueTasks(now time.Time) (overdue []inFlightTask) {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+	for id, task := range c.inFlight {
+		if now.Before(task.Deadline) {
+			continue
+		}
+		overdue = append(overdue, task)
+		delete(c.inFlight, id)
+	}
+	return
+}
+
+// takeInFlightTasks stops watching and returns all the tasks in flight
+func (c *sensorConnection) takeInFlightTasks() (tasks []inFlightTask) {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+	for _, task := range c.inFlight {
+		tasks = append(tasks, task)
+	}
+	c.inFlight = nil
+	return
+}
+
+// disconnectedTasks keeps the tasks in flight on the closed connections until their deadline, the sensor
+// may still send their results once it reconnects, in a batch if it measured them offline
+type disconnectedTasks struct {
+	sync.Mutex
+	bySensor map[uuid.UUID]map[uuid.UUID]inFlightTask
+}
+
+// park keeps the tasks of the sensor until they are answered, adopted or overdue
+func (d *disconnectedTasks) park(sensorId uuid.UUID, tasks []inFlightTask) {
+	if len(tasks) == 0 {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.bySensor == nil {
+		d.bySensor = make(map[uuid.UUID]map[uuid.UUID]inFlightTask)
+	}
+	if d.bySensor[sensorId] == nil {
+		d.bySensor[sensorId] = make(map[uuid.UUID]inFlightTask)
+	}
+	for _, task := range tasks {
+		d.bySensor[sensorId][task.TaskId] = task
+	}
+}
+
+// take returns and forgets the parked tasks of the sensor
+func (d *disconnectedTasks) take(sensorId uuid.UUID) (tasks []inFlightTask) {
+	d.Lock()
+	defer d.Unlock()
+	for _, task := range d.bySensor[sensorId] {
+		tasks = append(tasks, task)
+	}
+	delete(d.bySensor, sensorId)
+	return
+}
+
+// remove forgets the parked task, parked is false if the task was not parked for the sensor
+func (d *disconnectedTasks) remove(sensorId uuid.UUID, taskId uuid.UUID) (task inFlightTask, parked bool) {
+	d.Lock()
+	defer d.Unlock()
+	task, parked = d.bySensor[sensorId][taskId]
+	if !parked {
+		return
+	}
+	delete(d.bySensor[sensorId], taskId)
+	if len(d.bySensor[sensorId]) == 0 {
+		delete(d.bySensor, sensorId)
+	}
+	return
+}
+
+// takeOverdue returns and forgets the parked tasks past their deadline at now, by sensor
+func (d *disconnectedTasks) takeOverdue(now time.Time) (overdue map[uuid.UUID][]inFlightTask) {
+	d.Lock()
+	defer d.Unlock()
+	for sensorId, tasks := range d.bySensor {
+		for id, task := range tasks {
+			if now.Before(task.Deadline) {
+				continue
+			}
+			if overdue == nil {
+				overdue = make(map[uuid.UUID][]inFlightTask)
+			}
+			overdue[sensorId] = append(overdue[sensorId], task)
+			delete(tasks, id)
+		}
+		if len(tasks) == 0 {
+			delete(d.bySensor, sensorId)
+		}
+	}
+	return
+}
+
+// taskTimeout returns the time the sensor has to answer the task type
+func (w *wsServer) taskTimeout(taskName sensor.TaskName) time.Duration {
+	if timeout, ok := w.opts.TaskTimeouts[string(taskName)]; ok && timeout > 0 {
+		return timeout
+	}
+	if timeout, ok := defaultTaskTimeouts[taskName]; ok {
+		return timeout
+	}
+	return DefaultTaskTimeout
+}
+
+// validateTaskTimeouts checks the configured timeouts are for known task types
+func validateTaskTimeouts(timeouts map[string]time.Duration) error {
+	for taskType, timeout := range timeouts {
+		if !knownTaskType(sensor.TaskName(taskType)) {
+			return fmt.Errorf("task timeout of unknown task type %q", taskType)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("task timeout of %v must be positive", taskType)
+		}
+	}
+	return nil
+}
+
+// trackSentTask watches the task about to be sent to the sensor
+func (w *wsServer) trackSentTask(wsConn *sensorConnection, task sensor.Task) {
+	now := time.Now().UTC()
+	wsConn.trackTask(inFlightTask{
+		TaskId:   task.Id,
+		TaskName: task.Name,
+		SentAt:   now,
+		Deadline: now.Add(w.taskTimeout(task.Name)),
+	})
+}
+
+// taskAnswered stops watching the task once the sensor sent its result
+func (w *wsServer) taskAnswered(conn *sensorConnection, taskId uuid.UUID) {
+	task, tracked := w.disconnected.remove(conn.SensorId, taskId)
+	if !tracked {
+		task, tracked = conn.untrackTask(taskId)
+	}
+	if tracked {
+		taskAnswerDuration.WithLabelValues(string(task.TaskName)).Observe(time.Since(task.SentAt).Seconds())
+	}
+}
+
+// resultsQueued stops watching the tasks answered by a result or batch message as soon as it is queued,
+// the result must not be timed out while it waits for the ingest workers or for a slow database
+func (w *wsServer) resultsQueued(conn *sensorConnection, kind string, msg []byte) {
+	switch kind {
+	case ingestResult:
+		var result struct{ TaskId uuid.UUID }
+		if err := json.Unmarshal(msg, &result); err == nil {
+			w.taskAnswered(conn, result.TaskId)
+		}
+	case ingestBatch:
+		var batch struct{ Results []struct{ TaskId uuid.UUID } }
+		if err := json.Unmarshal(msg, &batch); err == nil {
+			for _, result := range batch.Results {
+				w.taskAnswered(conn, result.TaskId)
+			}
+		}
+	}
+}
+
+// taskWatchdog times out the tasks the sensors did not answer in time
+func (w *wsServer) taskWatchdog() {
+	for {
+		time.Sleep(watchdogPeriod)
+
+		w.connLock.Lock()
+		conns := make([]*sensorConnection, 0, len(w.sensorConnections))
+		for _, conn := range w.sensorConnections {
+			conns = append(conns, conn)
+		}
+		w.connLock.Unlock()
+
+		now := time.Now().UTC()
+		for _, conn := range conns {
+			for _, task := range conn.takeOverdueTasks(now) {
+				w.timeOutTask(conn.SensorId, task, timeoutDeadline)
+			}
+		}
+		for sensorId, tasks := range w.disconnected.takeOverdue(now) {
+			for _, task := range tasks {
+				w.timeOutTask(sensorId, task, timeoutSensorDisconnected)
+			}
+		}
+	}
+}
+
+// parkInFlightTasks keeps the tasks of a closed connection until their deadline, the sensor may reconnect and answer them
+func (w *wsServer) parkInFlightTasks(conn *sensorConnection) {
+	w.disconnected.park(conn.SensorId, conn.takeInFlightTasks())
+}
+
+// adoptParkedTasks watches the tasks parked on the sensor's previous connection on its new one
+func (w *wsServer) adoptParkedTasks(conn *sensorConnection) {
+	for _, task := range w.disconnected.take(conn.SensorId) {
+		conn.trackTask(task)
+	}
+}
+
+// timeOutParkedTasks times out all the parked tasks, no watchdog of this instance will follow them anymore
+func (w *wsServer) timeOutParkedTasks() {
+	for sensorId, tasks := range w.disconnected.takeOverdue(farFuture) {
+		for _, task := range tasks {
+			w.timeOutTask(sensorId, task, timeoutSensorDisconnected)
+		}
+	}
+}
+
+// timeOutTask sets the TIMED_OUT status, unless the task was answered meanwhile, and emits a live feed event
+func (w *wsServer) timeOutTask(sensorId uuid.UUID, task inFlightTask, reason string) {
+	var serverLogger = w.serverLogger.WithFields(log.Fields{
+		"sensorId": sensorId,
+		"taskId":   task.TaskId,
+		"taskName": task.TaskName,
+	})
+
+	t, err := w.transitionTask(w.dbClient, task.TaskId, TaskTimedOut, reason)
+	// the result arrived meanwhile
+	if errors.Is(err, errInvalidTransition) {
+		return
+	}
+	if err != nil {
+		serverLogger.Error(fmt.Sprintf("Error updating task to TIMED_OUT: %v", err))
+		return
+	}
+	taskTimeouts.WithLabelValues(string(task.TaskName), reason).Inc()
+	serverLogger.Warn(fmt.Sprintf("Task timed out, reason: %v, sent at: %v", reason, task.SentAt.Format(time.RFC3339)))
+
+	w.publishLiveEvent(context.Background(), LiveEvent{
+		Kind:           LiveEventTimeout,
+		Time:           time.Now().UTC(),
+		SensorId:       sensorId,
+		TaskId:         task.TaskId,
+		TaskName:       task.TaskName,
+		SubscriptionId: t.SubscriptionID,
+		Error:          fmt.Sprintf("task timed out: %v", reason),
+	})
+}
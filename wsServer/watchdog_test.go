@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDisconnectedTasks(t *testing.T) {
+	var (
+		d        disconnectedTasks
+		now      = time.Now().UTC()
+		sensorId = uuid.New()
+		overdue  = inFlightTask{TaskId: uuid.New(), Deadline: now.Add(-time.Second)}
+		pending  = inFlightTask{TaskId: uuid.New(), Deadline: now.Add(time.Minute)}
+		answered = inFlightTask{TaskId: uuid.New(), Deadline: now.Add(-time.Second)}
+	)
+	d.park(sensorId, []inFlightTask{overdue, pending, answered})
+
+	if _, parked := d.remove(sensorId, answered.TaskId); !parked {
+		t.Errorf("answered task was not parked")
+	}
+	if _, parked := d.remove(uuid.New(), pending.TaskId); parked {
+		t.Errorf("task parked for another sensor")
+	}
+
+	timedOut := d.takeOverdue(now)
+	if len(timedOut) != 1 || len(timedOut[sensorId]) != 1 || timedOut[sensorId][0].TaskId != overdue.TaskId {
+		t.Errorf("overdue tasks = %+v", timedOut)
+	}
+
+	adopted := d.take(sensorId)
+	if len(adopted) != 1 || adopted[0].TaskId != pending.TaskId {
+		t.Errorf("adopted tasks = %+v", adopted)
+	}
+	if left := d.takeOverdue(farFuture); len(left) != 0 {
+		t.Errorf("tasks left after adoption = %+v", left)
+	}
+}
+
+func TestResultsQueued(t *testing.T) {
+	var (
+		w        wsServer
+		conn     = &sensorConnection{}
+		now      = time.Now().UTC()
+		sent     = inFlightTask{TaskId: uuid.New(), Deadline: now.Add(time.Minute)}
+		batched  = inFlightTask{TaskId: uuid.New(), Deadline: now.Add(time.Minute)}
+		parked   = inFlightTask{TaskId: uuid.New(), Deadline: now.Add(time.Minute)}
+		unsent   = inFlightTask{TaskId: uuid.New(), Deadline: now.Add(time.Minute)}
+		sensorId = uuid.New()
+	)
+	conn.SensorId = sensorId
+	conn.trackTask(sent)
+	conn.trackTask(batched)
+	conn.trackTask(unsent)
+	w.disconnected.park(sensorId, []inFlightTask{parked})
+
+	w.resultsQueued(conn, ingestResult, []byte(`{"TaskId":"`+sent.TaskId.String()+`"}`))
+	w.resultsQueued(conn, ingestBatch, []byte(`{"Results":[{"TaskId":"`+batched.TaskId.String()+`"},{"TaskId":"`+parked.TaskId.String()+`"}]}`))
+	w.resultsQueued(conn, ingestTelemetry, []byte(`{"TaskId":"`+unsent.TaskId.String()+`"}`))
+
+	inFlight := conn.takeInFlightTasks()
+	if len(inFlight) != 1 || inFlight[0].TaskId != unsent.TaskId {
+		t.Errorf("tasks in flight = %+v", inFlight)
+	}
+	if left := w.disconnected.take(sensorId); len(left) != 0 {
+		t.Errorf("parked tasks = %+v", left)
+	}
+}
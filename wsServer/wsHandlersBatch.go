@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ping-42/42lib/sensor"
+	"github.com/ping-42/42lib/wss"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// maxBatchItems limits the results + telemetry samples accepted in a single batch
+const maxBatchItems = 5000
+
+// maxBatchTelemetryAge is the oldest telemetry sample accepted in a batch
+const maxBatchTelemetryAge = 7 * 24 * time.Hour
+
+// Batch item kinds, as reported in the BatchReply
+const (
+	BatchItemResult    = "result"
+	BatchItemTelemetry = "telemetry"
+)
+
+// Batch item statuses, as reported in the BatchReply
+const (
+	BatchItemStored = "stored"
+	BatchItemFailed = "failed"
+	// BatchItemDuplicate is a result the server already has, or no longer accepts, the sensor should not resend it
+	BatchItemDuplicate = "duplicate"
+	// BatchItemRejected is a result for a task that was not dispatched to the sensor,
+	// or an item measured in the future or, for a result, before its task was created
+	BatchItemRejected = "rejected"
+)
+
+// BatchMessage is sent by sensors reconnecting after an outage with everything queued in the meantime
+type BatchMessage struct {
+	// MessageGeneralType is required for all messages sent via WSS
+	wss.MessageGeneralType
+
+	// BatchId is echoed back in the reply, so the sensor can drop the uploaded items
+	BatchId   uuid.UUID
+	Results   []BatchResult
+	Telemetry []BatchTelemetry
+}
+
+// BatchResult is a task result together with the time it was measured,
+// TraceContext is the one received with the task
+type BatchResult struct {
+	MeasuredAt   time.Time
+	TraceContext propagation.MapCarrier `json:",omitempty"`
+	sensor.TResult
+}
+
+// BatchTelemetry is a telemetry sample together with the time it was measured
+type BatchTelemetry struct {
+	MeasuredAt time.Time
+	sensor.HostTelemetry
+}
+
+// BatchReply reports the outcome of each item of a BatchMessage
+type BatchReply struct {
+	// MessageGeneralType is required for all messages sent via WSS
+	wss.MessageGeneralType
+
+	BatchId uuid.UUID
+	Items   []BatchItemStatus
+}
+
+// BatchItemStatus is the outcome of a single batch item, Index is the position in Results or Telemetry
+type BatchItemStatus struct {
+	Kind   string
+	Index  int
+	TaskId uuid.UUID
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+func (w *wsServer) handleBatchMessage(conn *sensorConnection, msg []byte) (err error) {
+	var batch BatchMessage
+	err = json.Unmarshal(msg, &batch)
+	if err != nil {
+		err = fmt.Errorf("Unmarshal BatchMessage err:%v", err)
+		return
+	}
+
+	if len(batch.Results)+len(batch.Telemetry) > maxBatchItems {
+		err = fmt.Errorf("batch %v has %v items, max allowed is %v", batch.BatchId, len(batch.Results)+len(batch.Telemetry), maxBatchItems)
+		return
+	}
+
+	var serverLogger = w.serverLogger.WithFields(log.Fields{
+		"connectionId": conn.ConnectionId.String(),
+		"sensorId":     conn.SensorId,
+		"batchId":      batch.BatchId,
+	})
+
+	reply := BatchReply{
+		MessageGeneralType: MessageTypeBatchReply,
+		BatchId:            batch.BatchId,
+	}
+
+	ctx, span := tracer.Start(context.Background(), "handleBatchMessage",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("sensor.id", conn.SensorId.String()),
+			attribute.String("batch.id", batch.BatchId.String()),
+			attribute.Int("batch.results", len(batch.Results)),
+			attribute.Int("batch.telemetry", len(batch.Telemetry)),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	// the live events are published only once the batch is committed
+	var liveEvents []LiveEvent
+
+	// all items are stored in one transaction, the task status of each result behind a savepoint,
+	// so a broken item is rolled back alone and reported in the reply.
+	// The rows of the stored items are inserted at the end, with one statement per table.
+	// the blob store I/O is done before the transaction, a result failing here is reported as failed
+	preStored := make([]any, len(batch.Results))
+	preStoreErrs := make([]error, len(batch.Results))
+	for i, res := range batch.Results {
+		preStored[i], preStoreErrs[i] = w.preStoreResult(ctx, conn.SensorId, res.TResult, measuredAtOrNow(res.MeasuredAt))
+	}
+
+	var rows ingestRows
+	err = w.dbClient.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, res := range batch.Results {
+			if preStoreErrs[i] != nil {
+				reply.Items = append(reply.Items, newBatchItemStatus(BatchItemResult, i, res.TaskId, preStoreErrs[i]))
+				continue
+			}
+			measuredAt := measuredAtOrNow(res.MeasuredAt)
+			itemErr := w.storeBatchItem(tx, fmt.Sprintf("batch_result_%d", i), func() error {
+				// each result joins the trace of its task, linked to the batch span
+				itemCtx, itemSpan := tracer.Start(otel.GetTextMapPropagator().Extract(context.Background(), res.TraceContext), "handleBatchMessage.result",
+					trace.WithLinks(trace.LinkFromContext(ctx)),
+					trace.WithAttributes(attribute.String("sensor.id", conn.SensorId.String())),
+				)
+				itemRows := ingestRows{pending: &rows}
+				liveEvent, err := w.processTaskResult(itemCtx, tx, &itemRows, conn.SensorId, res.TResult, preStored[i], measuredAt)
+				endSpan(itemSpan, err)
+				if err != nil {
+					return err
+				}
+				rows.merge(&itemRows)
+				liveEvents = append(liveEvents, liveEvent)
+				return nil
+			})
+			reply.Items = append(reply.Items, newBatchItemStatus(BatchItemResult, i, res.TaskId, itemErr))
+		}
+
+		for i, tel := range batch.Telemetry {
+			measuredAt := measuredAtOrNow(tel.MeasuredAt)
+			if err := validTelemetryTime(measuredAt, time.Now()); err != nil {
+				reply.Items = append(reply.Items, newBatchItemStatus(BatchItemTelemetry, i, uuid.Nil, err))
+				continue
+			}
+			rows.addTelemetry(conn.SensorId, tel.HostTelemetry, measuredAt)
+			liveEvents = append(liveEvents, newTelemetryLiveEvent(conn.SensorId, tel.HostTelemetry, measuredAt))
+			reply.Items = append(reply.Items, newBatchItemStatus(BatchItemTelemetry, i, uuid.Nil, nil))
+		}
+		return rows.flush(tx)
+	})
+	if err == nil {
+		rows.committed()
+		for _, liveEvent := range liveEvents {
+			w.publishLiveEvent(ctx, liveEvent)
+		}
+	} else {
+		// the whole batch is lost, mark every item as failed
+		for i := range reply.Items {
+			reply.Items[i].Status = BatchItemFailed
+			reply.Items[i].Error = err.Error()
+		}
+		err = fmt.Errorf("batch transaction err:%v", err)
+	}
+
+	serverLogger.Info(fmt.Sprintf("Batch processed, results:%v, telemetry:%v", len(batch.Results), len(batch.Telemetry)))
+
+	replyMsg, marshalErr := json.Marshal(reply)
+	if marshalErr != nil {
+		return fmt.Errorf("marshal BatchReply err:%v", marshalErr)
+	}
+	writeErr := conn.write(replyMsg)
+	if writeErr != nil {
+		return fmt.Errorf("error sending BatchReply to sensor:%v", writeErr)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if len(batch.Telemetry) > 0 {
+		return w.telemetryStored(ctx, conn)
+	}
+	return
+}
+
+// storeBatchItem runs store inside a savepoint and rolls back to it on failure
+func (w *wsServer) storeBatchItem(tx *gorm.DB, savePoint string, store func() error) error {
+	if err := tx.SavePoint(savePoint).Error; err != nil {
+		return fmt.Errorf("savepoint err:%v", err)
+	}
+
+	err := store()
+	if err != nil {
+		if rbErr := tx.RollbackTo(savePoint).Error; rbErr != nil {
+			return fmt.Errorf("%v, rollback to savepoint err:%v", err, rbErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func newBatchItemStatus(kind string, index int, taskId uuid.UUID, err error) BatchItemStatus {
+	status := BatchItemStatus{
+		Kind:   kind,
+		Index:  index,
+		TaskId: taskId,
+		Status: BatchItemStored,
+	}
+	if errors.Is(err, errResultRejected) {
+		status.Status = BatchItemRejected
+		status.Error = err.Error()
+		return status
+	}
+	if errors.Is(err, errInvalidTransition) {
+		status.Status = BatchItemDuplicate
+		status.Error = err.Error()
+		return status
+	}
+	if err != nil {
+		status.Status = BatchItemFailed
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// validTelemetryTime rejects a sample measured in the future, or older than maxBatchTelemetryAge
+func validTelemetryTime(measuredAt time.Time, now time.Time) error {
+	if measuredAt.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("%w: telemetry measured in the future, at %v", errResultRejected, measuredAt.Format(time.RFC3339))
+	}
+	if measuredAt.Before(now.Add(-maxBatchTelemetryAge)) {
+		return fmt.Errorf("%w: telemetry measured at %v, older than %v", errResultRejected, measuredAt.Format(time.RFC3339), maxBatchTelemetryAge)
+	}
+	return nil
+}
+
+// measuredAtOrNow falls back to the receive time for items sent without a timestamp
+func measuredAtOrNow(measuredAt time.Time) time.Time {
+	if measuredAt.IsZero() {
+		return time.Now().UTC()
+	}
+	return measuredAt.UTC()
+}
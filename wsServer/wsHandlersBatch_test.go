@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestValidTelemetryTime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		measuredAt time.Time
+		valid      bool
+	}{
+		{now, true},
+		{now.Add(-time.Hour), true},
+		{now.Add(time.Minute), true},
+		{now.Add(time.Hour), false},
+		{now.Add(-8 * 24 * time.Hour), false},
+		{time.Date(1, 1, 1, 0, 0, 0, 1, time.UTC), false},
+		{time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		err := validTelemetryTime(test.measuredAt, now)
+		if (err == nil) != test.valid {
+			t.Errorf("validTelemetryTime(%v) = %v", test.measuredAt, err)
+		}
+		if err != nil {
+			if status := newBatchItemStatus(BatchItemTelemetry, 0, uuid.Nil, err); status.Status != BatchItemRejected {
+				t.Errorf("status of %v = %+v", test.measuredAt, status)
+			}
+		}
+	}
+}
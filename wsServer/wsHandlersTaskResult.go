@@ -1,22 +1,24 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/ping-42/42lib/db/models"
-	"github.com/ping-42/42lib/dns"
-	"github.com/ping-42/42lib/http"
-	"github.com/ping-42/42lib/icmp"
 	"github.com/ping-42/42lib/logger"
 	"github.com/ping-42/42lib/sensor"
-	"github.com/ping-42/42lib/traceroute"
+	"github.com/ping-42/server/wsServer/results"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
 )
 
-func (w *wsServer) handleTaskResultMessage(sensorId uuid.UUID, msg []byte) (err error) {
+// handleTaskResultMessage stores a single result in its own transaction, receivedAt is the time it was read
+func (w *wsServer) handleTaskResultMessage(sensorId uuid.UUID, msg []byte, receivedAt time.Time) (err error) {
 	// parse the base result
 	var sensorResult = sensor.TResult{}
 	err = json.Unmarshal(msg, &sensorResult)
@@ -25,6 +27,48 @@ func (w *wsServer) handleTaskResultMessage(sensorId uuid.UUID, msg []byte) (err
 		return
 	}
 
+	// the sensor echoes the trace context of the task, the result joins the dispatch trace
+	ctx, span := tracer.Start(extractTraceContext(context.Background(), msg), "handleTaskResultMessage",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("sensor.id", sensorId.String())),
+	)
+	defer func() { endSpan(span, err) }()
+
+	// the result, its task status and the subscription count are committed together,
+	// a result that still can not be stored is kept in the dead letter stream
+	liveEvent, attempts, err := w.storeTaskResult(ctx, sensorId, sensorResult, receivedAt)
+	if !resultHandled(err) {
+		if dlErr := w.deadLetterResult(sensorId, sensorResult, receivedAt, attempts, err); dlErr != nil {
+			logger.LogError(dlErr.Error(), "handleTaskResultMessage, deadLetterResult", w.serverLogger)
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	w.publishLiveEvent(ctx, liveEvent)
+	return
+}
+
+// processTaskResult updates the task status using the given db handle and collects the result rows,
+// which the caller inserts with rows.flush in the same transaction.
+// preStored is the result returned by preStoreResult before the transaction opened.
+// measuredAt is the time the result was produced by the sensor.
+// The returned LiveEvent should be published once the result is committed.
+func (w *wsServer) processTaskResult(ctx context.Context, tx *gorm.DB, rows *ingestRows, sensorId uuid.UUID, sensorResult sensor.TResult, preStored any, measuredAt time.Time) (liveEvent LiveEvent, err error) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("task.id", sensorResult.TaskId.String()),
+		attribute.String("task.name", string(sensorResult.TaskName)),
+	)
+	tx = tx.WithContext(ctx)
+
+	// the task id and the measure time come from the sensor, it must be one of its own tasks
+	err = w.verifyResultOwner(tx, sensorId, sensorResult, measuredAt)
+	if err != nil {
+		return
+	}
+
 	// init the logger
 	var serverLogger = w.serverLogger.WithFields(log.Fields{
 		"task_name": sensorResult.TaskName,
@@ -32,194 +76,141 @@ func (w *wsServer) handleTaskResultMessage(sensorId uuid.UUID, msg []byte) (err
 		"sensor_id": sensorId,
 	})
 
-	// Update the task status to RESULTS_RECEIVED_BY_SERVER
-	updateTx := w.dbClient.Model(&models.Task{}).Where("id = ?", sensorResult.TaskId).Update("task_status_id", 7)
-	if updateTx.Error != nil {
-		err = fmt.Errorf("error updating to RESULTS_RECEIVED_BY_SERVER")
-		logger.LogError(updateTx.Error.Error(), "error updating to RESULTS_RECEIVED_BY_SERVER", serverLogger)
+	// Update the task status to RESULTS_RECEIVED_BY_SERVER, the subscription is returned for the live feed.
+	// A duplicate result, or the result of a task already failed, is rejected here.
+	task, err := w.transitionTask(tx, sensorResult.TaskId, TaskResultsReceived, "result received from the sensor")
+	if err != nil {
+		logger.LogError(err.Error(), "error updating to RESULTS_RECEIVED_BY_SERVER", serverLogger)
 		return
 	}
 
+	liveEvent = newResultLiveEvent(sensorId, task.SubscriptionID, sensorResult, measuredAt)
+
 	// if we have error from the sernsor
 	if sensorResult.Error != "" {
 		logger.LogError(sensorResult.Error, "sensor error", serverLogger)
 		// update the task status to ERROR
-		updateTx := w.dbClient.Model(&models.Task{}).Where("id = ?", sensorResult.TaskId).Update("task_status_id", 9)
-		if updateTx.Error != nil {
-			err = fmt.Errorf("error updating to ERROR")
-			logger.LogError(updateTx.Error.Error(), "error updating to ERROR", serverLogger)
+		_, err = w.transitionTask(tx, sensorResult.TaskId, TaskError, fmt.Sprintf("sensor error: %v", sensorResult.Error))
+		if err != nil {
+			logger.LogError(err.Error(), "error updating to ERROR", serverLogger)
 			return
 		}
 		return
 	}
 
-	// handle & insert the result to the db
-	err = w.handleSensorResult(sensorResult, sensorId)
+	// handle & collect the rows of the result
+	err = w.handleSensorResult(ctx, tx, rows, sensorResult, preStored, sensorId, measuredAt)
 	if err != nil {
 		return
 	}
 
 	// update the task status to DONE & increment the Client Subscription
-	err = w.taskDone(sensorResult.TaskId)
+	err = w.taskDone(ctx, tx, sensorResult.TaskId)
 	if err != nil {
 		return
 	}
 	return
 }
 
-func (w *wsServer) handleSensorResult(sensorResult sensor.TResult, sensorId uuid.UUID) (err error) {
-
-	// based on the type parse the actual res
-	switch sensorResult.TaskName {
-	case dns.TaskName:
-
-		err = w.handleDnsResult(sensorResult, sensorId)
-		if err != nil {
-			err = fmt.Errorf("handleDnsResult error:%v", err)
-			return
-		}
-
-	case icmp.TaskName:
-
-		err = w.handleIcmpResult(sensorResult, sensorId)
-		if err != nil {
-			err = fmt.Errorf("handleIcmpResult error:%v", err)
-			return
-		}
-
-	case http.TaskName:
-
-		err = w.handleHttpResult(sensorResult, sensorId)
-		if err != nil {
-			err = fmt.Errorf("handleHttpResult error:%v", err)
-			return
-		}
-	case traceroute.TaskName:
-
-		err = w.handleTracerouteResult(sensorResult, sensorId)
-		if err != nil {
-			err = fmt.Errorf("handleTracerouteResult error:%v", err)
-			return
-		}
-
-	default:
-		err = fmt.Errorf("msg unexpected TaskName:%v, ResponseReceived:%+v", sensorResult.TaskName, sensorResult)
+// preStoreResult runs the I/O of the result handler before the transaction of the result opens, e.g. the blob store
+// writes, so the task and subscription rows are not locked meanwhile. It returns the result passed to Store,
+// nil when the handler has nothing to do beforehand, or when the result is malformed, which the transaction reports.
+func (w *wsServer) preStoreResult(ctx context.Context, sensorId uuid.UUID, sensorResult sensor.TResult, measuredAt time.Time) (preStored any, err error) {
+	if sensorResult.Error != "" {
 		return
 	}
-	return
-}
-
-func (w *wsServer) handleDnsResult(sensorResult sensor.TResult, sensorID uuid.UUID) (err error) {
-
-	var dnsRes = dns.Result{}
-	err = json.Unmarshal(sensorResult.Result, &dnsRes)
-	if err != nil {
-		return fmt.Errorf("Unmarshal dns.Result{} err:%v", err)
+	handler, ok := w.resultHandlers.Lookup(sensorResult.TaskName)
+	if !ok {
+		return
 	}
-
-	err = w.storeDnsResults(sensorID, sensorResult.TaskId, dnsRes)
-	if err != nil {
+	preStorer, ok := handler.(results.PreStorer)
+	if !ok {
 		return
 	}
 
-	w.serverLogger.Info("DNS result saved successfully for task id:", sensorResult.TaskId)
-	return
-}
+	ctx, span := tracer.Start(ctx, "preStoreResult", trace.WithAttributes(attribute.String("task.name", string(sensorResult.TaskName))))
+	defer func() { endSpan(span, err) }()
 
-func (w *wsServer) handleIcmpResult(sensorResult sensor.TResult, sensorID uuid.UUID) (err error) {
-
-	var icmpRes icmp.Result
-	err = json.Unmarshal(sensorResult.Result, &icmpRes)
-	if err != nil {
-		return fmt.Errorf("Unmarshal icmp.Result{} err:%v", err)
-	}
-
-	// store DNS task result in case we have domain in the opts
-	if icmpRes.DnsResult.Proto != 0 { // todo implement check for empty
-		err = w.storeDnsResults(sensorID, sensorResult.TaskId, icmpRes.DnsResult)
-		if err != nil {
-			return
-		}
+	res, decodeErr := handler.Decode(sensorResult.Result)
+	if decodeErr != nil || handler.Validate(res) != nil {
+		return
 	}
-
-	err = w.storeIcmpResults(sensorID, sensorResult.TaskId, icmpRes)
+	meta := results.Meta{SensorID: sensorId, TaskID: sensorResult.TaskId, MeasuredAt: measuredAt}
+	preStored, err = preStorer.PreStore(ctx, results.DBReader{DB: w.dbClient.WithContext(ctx)}, meta, res)
 	if err != nil {
-		return
+		err = fmt.Errorf("pre store %v result err:%w", sensorResult.TaskName, err)
 	}
-
-	w.serverLogger.Info("ICMP result saved successfully for task id:", sensorResult.TaskId)
-
 	return
 }
 
-func (w *wsServer) handleHttpResult(sensorResult sensor.TResult, sensorID uuid.UUID) (err error) {
-
-	var httpRes = http.Result{}
-	err = json.Unmarshal(sensorResult.Result, &httpRes)
-	if err != nil {
-		return fmt.Errorf("Unmarshal http.Result{} err:%v", err)
-	}
-
-	headersJson, err := json.Marshal(httpRes.ResponseHeaders)
-	if err != nil {
-		err = fmt.Errorf("Marshal httpRes.ResponseHeaders err:%v", err)
+// handleSensorResult decodes the result with the handler registered for its task name,
+// and collects its rows in the transaction tx. A result pre stored was already decoded.
+func (w *wsServer) handleSensorResult(ctx context.Context, tx *gorm.DB, rows *ingestRows, sensorResult sensor.TResult, preStored any, sensorId uuid.UUID, measuredAt time.Time) (err error) {
+	ctx, span := tracer.Start(ctx, "handleSensorResult", trace.WithAttributes(attribute.String("task.name", string(sensorResult.TaskName))))
+	defer func() { endSpan(span, err) }()
+	// observed for each result, whether it is stored alone, in a flush or in a batch
+	defer observeStoreDuration(w.resultTaskTypeLabel(sensorResult.TaskName), time.Now())
+
+	handler, ok := w.resultHandlers.Lookup(sensorResult.TaskName)
+	if !ok {
+		err = fmt.Errorf("%w: msg unexpected TaskName:%v, ResponseReceived:%+v", errMalformedResult, sensorResult.TaskName, sensorResult)
 		return
 	}
 
-	err = w.storeHttpResults(sensorID, sensorResult.TaskId, httpRes, headersJson)
-	if err != nil {
-		return
+	res := preStored
+	if res == nil {
+		res, err = handler.Decode(sensorResult.Result)
+		if err != nil {
+			return fmt.Errorf("%w: decode %v result err:%v", errMalformedResult, sensorResult.TaskName, err)
+		}
+		err = handler.Validate(res)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %v result err:%v", errMalformedResult, sensorResult.TaskName, err)
+		}
 	}
 
-	w.serverLogger.Info("HTTP result saved successfully for task id:", sensorResult.TaskId)
-	return
-}
-
-func (w *wsServer) handleTracerouteResult(sensorResult sensor.TResult, sensorID uuid.UUID) (err error) {
-
-	var tracerouteRes traceroute.Result
-	err = json.Unmarshal(sensorResult.Result, &tracerouteRes)
+	meta := results.Meta{SensorID: sensorId, TaskID: sensorResult.TaskId, MeasuredAt: measuredAt}
+	err = handler.Store(ctx, resultStore{DBReader: results.DBReader{DB: tx}, rows: rows}, meta, res)
 	if err != nil {
-		return fmt.Errorf("Unmarshal icmp.Result{} err:%v", err)
+		return fmt.Errorf("store %v result err:%w", sensorResult.TaskName, err)
 	}
 
-	err = w.storeTracerouteResults(sensorID, sensorResult.TaskId, tracerouteRes)
-	if err != nil {
-		return
+	if postProcessor, ok := handler.(results.PostProcessor); ok {
+		rows.afterCommit = append(rows.afterCommit, func() {
+			if ppErr := postProcessor.PostProcess(ctx, meta, res); ppErr != nil {
+				logger.LogError(ppErr.Error(), fmt.Sprintf("post processing the %v result of task %v", sensorResult.TaskName, sensorResult.TaskId), w.serverLogger)
+			}
+		})
 	}
-
-	w.serverLogger.Info("ICMP result saved successfully for task id:", sensorResult.TaskId)
-
 	return
 }
 
-func (w *wsServer) taskDone(taskId uuid.UUID) (err error) {
-	// 1. Laod the task
-	var task models.Task
-	if err = w.dbClient.First(&task, "id = ?", taskId).Error; err != nil {
-		err = fmt.Errorf("Failed to load Task record, TaskStatusID:%v, to DONE err:%v", taskId, err)
-		return
-	}
+// taskDone moves the task to DONE and increments its subscription, once per task.
+// The counter is incremented in SQL, concurrent results of the same subscription do not overwrite each other.
+func (w *wsServer) taskDone(ctx context.Context, tx *gorm.DB, taskId uuid.UUID) (err error) {
+	ctx, span := tracer.Start(ctx, "taskDone", trace.WithAttributes(attribute.String("task.id", taskId.String())))
+	defer func() { endSpan(span, err) }()
+	tx = tx.WithContext(ctx)
 
-	// 2. Load the associated Subscriptions records
-	var clientSubscription models.Subscription
-	if err = w.dbClient.First(&clientSubscription, "id = ?", task.SubscriptionID).Error; err != nil {
-		err = fmt.Errorf("Failed to load Subscription record,  TaskStatusID:%v, to DONE err:%v", taskId, err)
+	// 1. Update the task status to DONE, only a task with its result received gets there
+	task, err := w.transitionTask(tx, taskId, TaskDone, "result stored")
+	if err != nil {
+		err = fmt.Errorf("Failed to update Task status, TaskStatusID:%v, to DONE err:%w", taskId, err)
 		return
 	}
 
-	// 3. Increment the TestsCountExecuted field by one
-	clientSubscription.TestsCountExecuted++
-	clientSubscription.LastExecutionCompleted = time.Now()
-	if err = w.dbClient.Save(&clientSubscription).Error; err != nil {
-		err = fmt.Errorf("Failed to update TestsCountExecuted, TaskStatusID:%v, to DONE err:%v", taskId, err)
+	// 2. Increment the TestsCountExecuted of the associated Subscription
+	res := tx.Model(&models.Subscription{}).Where("id = ?", task.SubscriptionID).Updates(map[string]interface{}{
+		"tests_count_executed":     gorm.Expr("tests_count_executed + 1"),
+		"last_execution_completed": time.Now(),
+	})
+	if res.Error != nil {
+		dbErrors.WithLabelValues("update_subscription").Inc()
+		err = fmt.Errorf("Failed to update TestsCountExecuted, TaskStatusID:%v, to DONE err:%v", taskId, res.Error)
 		return
 	}
-
-	// 4. Update the task status to DONE
-	task.TaskStatusID = 8
-	if err = w.dbClient.Save(&task).Error; err != nil {
-		err = fmt.Errorf("Failed to update Task status, TaskStatusID:%v, to DONE err:%v", taskId, err)
+	if res.RowsAffected == 0 {
+		err = fmt.Errorf("Failed to update TestsCountExecuted, TaskStatusID:%v, subscription %v not found", taskId, task.SubscriptionID)
 		return
 	}
 	return
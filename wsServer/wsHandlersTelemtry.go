@@ -1,17 +1,20 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"time"
 
-	"github.com/ping-42/42lib/constants"
+	"github.com/google/uuid"
 	"github.com/ping-42/42lib/sensor"
-	"github.com/ping-42/42lib/wss"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
 )
 
-func (w *wsServer) handleTelemtryMessage(conn wss.SensorConnection, msg []byte) (err error) {
-	var time = time.Now().UTC()
+// handleTelemtryMessage stores a single telemetry sample, receivedAt is the time it was read
+func (w *wsServer) handleTelemtryMessage(conn *sensorConnection, msg []byte, receivedAt time.Time) (err error) {
 	var hostTelemetryMsg sensor.HostTelemetry
 	err = json.Unmarshal(msg, &hostTelemetryMsg)
 	if err != nil {
@@ -19,30 +22,37 @@ func (w *wsServer) handleTelemtryMessage(conn wss.SensorConnection, msg []byte)
 		return
 	}
 
-	err = w.storeHostRuntimeStat(conn.SensorId, hostTelemetryMsg, time)
-	if err != nil {
-		return
-	}
+	ctx, span := tracer.Start(context.Background(), "handleTelemtryMessage",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("sensor.id", conn.SensorId.String())),
+	)
+	defer func() { endSpan(span, err) }()
 
-	err = w.storeHostNetworkStats(conn.SensorId, hostTelemetryMsg.Network, time)
+	err = w.storeTelemetry(w.dbClient.WithContext(ctx), conn.SensorId, hostTelemetryMsg, receivedAt)
 	if err != nil {
 		return
 	}
+	w.publishLiveEvent(ctx, newTelemetryLiveEvent(conn.SensorId, hostTelemetryMsg, receivedAt))
 
-	// Store active connection data in Redis with ttl
-	activeSensor, err := json.Marshal(conn)
-	if err != nil {
-		w.serverLogger.Error("marshal RedisDataActiveSensor err:", err.Error())
-		return
-	}
-	err = w.redisClient.Set(
-		constants.RedisActiveSensorsKeyPrefix+conn.SensorId.String(),
-		activeSensor,
-		constants.TelemetryMonitorPeriod+constants.TelemetryMonitorPeriodThreshold).Err()
+	return w.telemetryStored(ctx, conn)
+}
+
+// telemetryStored refreshes the presence and the session of the sensor once its telemetry is committed
+func (w *wsServer) telemetryStored(ctx context.Context, conn *sensorConnection) (err error) {
+	_, redisSpan := startRedisSpan(ctx, "set_active_sensor")
+	err = w.refreshActiveSensor(conn)
+	endSpan(redisSpan, err)
 	if err != nil {
-		err = fmt.Errorf("failed to store active connection data in Redis:%v", err)
 		return
 	}
 
-	return
+	return w.updateSensorSession(conn)
+}
+
+// storeTelemetry stores the runtime and network stats of a single telemetry sample
+func (w *wsServer) storeTelemetry(tx *gorm.DB, sensorId uuid.UUID, hostTelemetryMsg sensor.HostTelemetry, measuredAt time.Time) (err error) {
+	defer observeStoreDuration(telemetryMetricLabel, time.Now())
+	var rows ingestRows
+	rows.addTelemetry(sensorId, hostTelemetryMsg, measuredAt)
+	return rows.flush(tx)
 }
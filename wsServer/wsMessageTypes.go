@@ -0,0 +1,30 @@
+package server
+
+import "github.com/ping-42/42lib/wss"
+
+// Server specific WSS message types, continuing after the ones defined in wss
+const (
+	// MessageTypeBatch carries queued results and telemetry samples, sent by the sensor after an outage
+	MessageTypeBatch wss.MessageGeneralType = iota + wss.MessageTypeTelemtry + 1
+	// MessageTypeBatchReply is sent back to the sensor with the status of each batch item
+	MessageTypeBatchReply
+	// MessageTypeControl is a ControlRequest sent from the server to the sensor
+	MessageTypeControl
+	// MessageTypeControlReply is the sensor response to a ControlRequest
+	MessageTypeControlReply
+)
+
+// messageTypeName extends wss.MessageGeneralType.String with the server specific types
+func messageTypeName(t wss.MessageGeneralType) string {
+	switch t {
+	case MessageTypeBatch:
+		return "MessageTypeBatch"
+	case MessageTypeBatchReply:
+		return "MessageTypeBatchReply"
+	case MessageTypeControl:
+		return "MessageTypeControl"
+	case MessageTypeControlReply:
+		return "MessageTypeControlReply"
+	}
+	return t.String()
+}
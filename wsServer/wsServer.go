@@ -8,22 +8,27 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-redis/redis"
 	ws "github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/ping-42/42lib/constants"
-	"github.com/ping-42/42lib/db/models"
 	"github.com/ping-42/42lib/wss"
+	"github.com/ping-42/server/wsServer/blobstore"
+	"github.com/ping-42/server/wsServer/results"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
@@ -31,15 +36,39 @@ type wsServer struct {
 	dbClient          *gorm.DB
 	redisClient       *redis.Client
 	redisPubSub       *redis.PubSub
-	sensorConnections map[uuid.UUID]wss.SensorConnection
+	sensorConnections map[uuid.UUID]*sensorConnection
 	connLock          sync.Mutex
-	serverLogger      *logrus.Entry
+	controlReplies    controlReplies
+	// disconnected keeps the tasks in flight on the closed connections
+	disconnected    disconnectedTasks
+	credentials     *credentialCache
+	liveFeed        liveFeed
+	instanceId      string
+	listenerRunning atomic.Bool
+	routerLeader    atomic.Bool
+	serverLogger    *logrus.Entry
+	opts            Options
+	// trustedProxies may set the X-Real-IP and X-Forwarded-For headers
+	trustedProxies []netip.Prefix
+	// liveFeedScopes are the subscriptions each live feed subscription token may follow
+	liveFeedScopes map[string]map[uint64]bool
+	// tracingShutdown flushes the pending spans
+	tracingShutdown func(context.Context) error
+	// ingest stores the results and telemetry read from the sensors
+	ingest ingestPipeline
+	// resultHandlers decode and store the results, by task name
+	resultHandlers *results.Registry
+	// blobs keeps the full http bodies, nil when no blob store is configured
+	blobs blobstore.Store
 }
 
 func (w *wsServer) run(port string) {
 
 	// set up a handler function for incoming requests
 	http.HandleFunc("/", w.handleIncomingClient)
+	http.HandleFunc("/healthz", w.handleLiveness)
+	http.HandleFunc("/readyz", w.handleReadiness)
+	http.Handle("/metrics", promhttp.Handler())
 
 	// start listening for incoming requests
 	ln, err := net.Listen("tcp", port)
@@ -50,6 +79,16 @@ func (w *wsServer) run(port string) {
 
 	w.serverLogger.Info("Listening", ln.Addr())
 
+	// the admin api is optional and runs on its own listener
+	var adminServer *http.Server
+	if w.opts.AdminPort != "" {
+		adminServer, err = w.runAdminApi()
+		if err != nil {
+			w.serverLogger.Error("unable to start the admin api: ", err)
+			return
+		}
+	}
+
 	// set up a server to handle incoming clients
 	var (
 		s     = new(http.Server)
@@ -68,11 +107,27 @@ func (w *wsServer) run(port string) {
 
 		w.serverLogger.Info(fmt.Sprintf("signal %q received; shutting down with %s timeout", sig, timeout))
 
+		w.deregisterInstance()
+
 		ctx, ctxCancel := context.WithTimeout(context.Background(), timeout)
 		defer ctxCancel()
+		if adminServer != nil {
+			if err := adminServer.Shutdown(ctx); err != nil {
+				w.serverLogger.Error("admin api shutdown error: ", err)
+			}
+		}
 		if err := s.Shutdown(ctx); err != nil {
 			w.serverLogger.Fatal(err)
 		}
+		if err := w.stopIngest(ctx); err != nil {
+			w.serverLogger.Error("ingest shutdown error: ", err)
+		}
+		w.timeOutParkedTasks()
+		if w.tracingShutdown != nil {
+			if err := w.tracingShutdown(ctx); err != nil {
+				w.serverLogger.Error("tracing shutdown error: ", err)
+			}
+		}
 	}
 }
 
@@ -84,8 +139,9 @@ func (w *wsServer) handleIncomingClient(wr http.ResponseWriter, r *http.Request)
 	jwtToken := r.Header.Get("Authorization")
 	if jwtToken == "" {
 		w.serverLogger.WithFields(log.Fields{
-			"clientAddr": r.Header.Get("X-Real-IP"),
+			"clientAddr": w.clientAddr(r),
 		}).Error("No JWT Token received from client")
+		authFailures.WithLabelValues(authMissingToken).Inc()
 		http.Error(wr, "Invalid sensor token received", http.StatusBadRequest)
 		return
 	}
@@ -93,16 +149,32 @@ func (w *wsServer) handleIncomingClient(wr http.ResponseWriter, r *http.Request)
 	sensorId, err := w.parseAndValidateJwtToken(jwtToken)
 	if err != nil {
 		w.serverLogger.WithFields(log.Fields{
-			"clientAddr": r.Header.Get("X-Real-IP"),
+			"clientAddr": w.clientAddr(r),
 		}).Error(fmt.Sprintf("Unable to parse JWT token: %v", err))
+		if errors.Is(err, errTokenReplayed) {
+			authFailures.WithLabelValues(authReplayedToken).Inc()
+		} else {
+			authFailures.WithLabelValues(authInvalidToken).Inc()
+		}
 		http.Error(wr, "Invalid sensor token received", http.StatusUnauthorized)
 		return
 	}
 
+	err = w.authorizeConnection(sensorId, w.clientAddr(r))
+	if err != nil {
+		w.serverLogger.WithFields(log.Fields{
+			"clientAddr": w.clientAddr(r),
+			"sensorId":   sensorId,
+		}).Error(fmt.Sprintf("Sensor connection not allowed: %v", err))
+		authFailures.WithLabelValues(authPolicyDenied).Inc()
+		http.Error(wr, "Sensor connection not allowed", http.StatusForbidden)
+		return
+	}
+
 	sensorVersion := r.Header.Get("SensorVersion")
 	if sensorVersion == "" {
 		w.serverLogger.WithFields(log.Fields{
-			"clientAddr": r.Header.Get("X-Real-IP"),
+			"clientAddr": w.clientAddr(r),
 			"sensorId":   sensorId,
 		}).Info("missing sensorId in connection request")
 	}
@@ -110,22 +182,57 @@ func (w *wsServer) handleIncomingClient(wr http.ResponseWriter, r *http.Request)
 	conn, _, _, err := ws.UpgradeHTTP(r, wr)
 	if err != nil {
 		w.serverLogger.WithFields(log.Fields{
-			"clientAddr": r.Header.Get("X-Real-IP"),
+			"clientAddr": w.clientAddr(r),
 		}).Error("UpgradeHTTP error", err)
 		http.Error(wr, "Unable to upgrade HTTP connection", http.StatusInternalServerError)
 		return
 	}
 
-	defer func() {
+	sensorConn := &sensorConnection{
+		SensorConnection: wss.SensorConnection{
+			ConnectionId:  connectionId,
+			Connection:    conn,
+			SensorId:      sensorId,
+			SensorVersion: sensorVersion,
+		},
+		remoteAddr:     w.clientAddr(r),
+		connectedSince: time.Now().UTC(),
+	}
+
+	drained, err := w.isSensorDrained(sensorId)
+	if err != nil {
+		w.serverLogger.Error("Failed to load the sensor drain flag: ", err.Error(), sensorId)
+	}
+	sensorConn.draining.Store(drained)
 
-		// delete active sensor from redis
-		err := w.redisClient.Del(constants.RedisActiveSensorsKeyPrefix + sensorId.String()).Err()
+	// set once the read loop ends
+	var disconnectReason string
+
+	// the same label value must be decremented on disconnect
+	versionLabel := sensorVersionLabel(sensorVersion)
+
+	defer func() {
+		err := w.closeSensorSession(sensorConn, disconnectReason)
 		if err != nil {
-			w.serverLogger.Error("Error deleting Redis active sensor key: ", err)
+			w.serverLogger.Error(err.Error(), sensorId)
 		}
 
+		// the sensor may still answer the tasks in flight once it reconnects, until their deadline
+		w.parkInFlightTasks(sensorConn)
+
 		w.connLock.Lock()
-		delete(w.sensorConnections, sensorId)
+		// the sensor may have already reconnected, its new connection must stay
+		if current, ok := w.sensorConnections[sensorId]; ok && current == sensorConn {
+			delete(w.sensorConnections, sensorId)
+
+			// delete active sensor from redis
+			err := w.redisClient.Del(constants.RedisActiveSensorsKeyPrefix + sensorId.String()).Err()
+			if err != nil {
+				redisErrors.WithLabelValues("delete_active_sensor").Inc()
+				w.serverLogger.Error("Error deleting Redis active sensor key: ", err)
+			}
+		}
+		connectedSensors.WithLabelValues(versionLabel).Dec()
 		w.serverLogger.WithFields(log.Fields{
 			"connectionId": connectionId.String(),
 			"sensorId":     sensorId,
@@ -134,33 +241,29 @@ func (w *wsServer) handleIncomingClient(wr http.ResponseWriter, r *http.Request)
 		w.connLock.Unlock()
 		err = conn.Close()
 		if err != nil {
-			w.serverLogger.Error("conn.Close() err: ", err.Error())
+			if _, closedByServer := sensorConn.closedByServer(); !closedByServer {
+				w.serverLogger.Error("conn.Close() err: ", err.Error())
+			}
 			return
 		}
 	}()
 
 	w.connLock.Lock()
-	w.sensorConnections[sensorId] = wss.SensorConnection{
-		ConnectionId:  connectionId,
-		Connection:    conn,
-		SensorId:      sensorId,
-		SensorVersion: sensorVersion,
-	}
+	w.sensorConnections[sensorId] = sensorConn
 	w.connLock.Unlock()
+	w.adoptParkedTasks(sensorConn)
+	sensorConnects.Inc()
+	connectedSensors.WithLabelValues(versionLabel).Inc()
 
 	// add active sensor to redis
-	activeSensor, err := json.Marshal(w.sensorConnections[sensorId])
+	err = w.refreshActiveSensor(sensorConn)
 	if err != nil {
-		w.serverLogger.Error("marshal RedisDataActiveSensor err:", err.Error())
-		return
+		w.serverLogger.Error("Failed to store active connection data in Redis: ", err.Error(), sensorId)
 	}
-	err = w.redisClient.Set(
-		constants.RedisActiveSensorsKeyPrefix+sensorId.String(),
-		activeSensor,
-		constants.TelemetryMonitorPeriod+constants.TelemetryMonitorPeriodThreshold,
-	).Err()
+
+	err = w.openSensorSession(sensorConn)
 	if err != nil {
-		w.serverLogger.Error("Failed to store active connection data in Redis: ", err.Error(), sensorId)
+		w.serverLogger.Error(err.Error(), sensorId)
 	}
 
 	w.serverLogger.WithFields(log.Fields{
@@ -168,10 +271,14 @@ func (w *wsServer) handleIncomingClient(wr http.ResponseWriter, r *http.Request)
 		"sensorId":     sensorId,
 	}).Info("Added new sensor connection")
 
-	w.listenForMessages(w.sensorConnections[sensorId]) // TODO maybe in goroutine?
+	// send the tasks queued while the sensor was offline
+	go w.deliverPendingTasks(sensorConn)
+
+	disconnectReason = w.listenForMessages(sensorConn) // TODO maybe in goroutine?
 }
 
-func (w *wsServer) listenForMessages(conn wss.SensorConnection) {
+// listenForMessages handles the sensor messages until the connection ends, and returns the disconnect reason
+func (w *wsServer) listenForMessages(conn *sensorConnection) (disconnectReason string) {
 	for {
 		msg, _, err := wsutil.ReadClientData(conn.Connection)
 		if err != nil {
@@ -180,15 +287,28 @@ func (w *wsServer) listenForMessages(conn wss.SensorConnection) {
 					"connectionId": conn.ConnectionId.String(),
 					"sensorId":     conn.SensorId,
 				}).Info("Sensor disconnected")
+				sensorDisconnects.WithLabelValues(disconnectEOF).Inc()
 
-				break // client disconnected, break out of the loop
+				return disconnectEOF // client disconnected, break out of the loop
+			}
+			if reason, closedByServer := conn.closedByServer(); closedByServer {
+				w.serverLogger.WithFields(log.Fields{
+					"connectionId": conn.ConnectionId.String(),
+					"sensorId":     conn.SensorId,
+				}).Info(fmt.Sprintf("Sensor disconnected by the server, reason: %v", reason))
+				sensorDisconnects.WithLabelValues(disconnectByServer).Inc()
+				return fmt.Sprintf("%v: %v", disconnectByServer, reason)
 			}
 			w.serverLogger.WithFields(log.Fields{
 				"connectionId": conn.ConnectionId.String(),
 				"sensorId":     conn.SensorId,
 			}).Error(fmt.Sprintf("Read message error: %v", err))
-			continue
+			sensorDisconnects.WithLabelValues(disconnectReadError).Inc()
+
+			// the frame stream can not be recovered after a read error
+			return fmt.Sprintf("%v: %v", disconnectReadError, err)
 		}
+		conn.received(msg)
 
 		w.serverLogger.WithFields(
 			log.Fields{
@@ -206,27 +326,27 @@ func (w *wsServer) listenForMessages(conn wss.SensorConnection) {
 			}).Error(fmt.Sprintf("Unmarshal WssMessageType err: %v, msg: %v", err, string(msg)))
 			continue
 		}
+		inboundMessages.WithLabelValues(messageTypeName(generalMessage.MessageGeneralType)).Inc()
 
 		switch generalMessage.MessageGeneralType {
+		// the results and telemetry are stored by the ingest workers, the reads go on meanwhile
 		case wss.MessageTypeTaskResult:
-
-			err = w.handleTaskResultMessage(conn.SensorId, msg)
-			if err != nil {
-				w.serverLogger.WithFields(log.Fields{
-					"connectionId": conn.ConnectionId.String(),
-					"sensorId":     conn.SensorId,
-				}).Error(fmt.Sprintf("handleSensorResultMessage err: %v, msg: %v", err, string(msg)))
-				continue
-			}
+			w.enqueueIngest(conn, ingestResult, msg)
 
 		case wss.MessageTypeTelemtry:
+			w.enqueueIngest(conn, ingestTelemetry, msg)
 
-			err = w.handleTelemtryMessage(conn, msg)
+		case MessageTypeBatch:
+			w.enqueueIngest(conn, ingestBatch, msg)
+
+		case MessageTypeControlReply:
+
+			err = w.handleControlReplyMessage(conn, msg)
 			if err != nil {
 				w.serverLogger.WithFields(log.Fields{
 					"connectionId": conn.ConnectionId.String(),
 					"sensorId":     conn.SensorId,
-				}).Error(fmt.Sprintf("handleTelemtryMessage err: %v, msg: %v", err, string(msg)))
+				}).Error(fmt.Sprintf("handleControlReplyMessage err: %v, msg: %v", err, string(msg)))
 				continue
 			}
 
@@ -241,87 +361,37 @@ func (w *wsServer) listenForMessages(conn wss.SensorConnection) {
 
 }
 
-func (w *wsServer) getSensorWsConnection(sensorId uuid.UUID) (con wss.SensorConnection, exists bool) {
+func (w *wsServer) getSensorWsConnection(sensorId uuid.UUID) (con *sensorConnection, exists bool) {
+	w.connLock.Lock()
+	defer w.connLock.Unlock()
 	con, exists = w.sensorConnections[sensorId]
 	return con, exists
 }
 
-func (w *wsServer) sendTaskToSensors(wsConn wss.SensorConnection, tt []byte) error {
+// sendTaskToSensors writes the task to the sensor, with the span context of ctx added
+// so the sensor can echo it back in the result
+func (w *wsServer) sendTaskToSensors(ctx context.Context, wsConn *sensorConnection, tt []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "sendTaskToSensors",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("sensor.id", wsConn.SensorId.String()),
+			attribute.String("connection.id", wsConn.ConnectionId.String()),
+		),
+	)
+	defer func() { endSpan(span, err) }()
+
+	tt, err = injectTraceContext(ctx, tt)
+	if err != nil {
+		return fmt.Errorf("injectTraceContext err: %v", err)
+	}
+
 	w.serverLogger.WithFields(log.Fields{
 		"connectionId": wsConn.ConnectionId.String(),
 		"sensorId":     wsConn.SensorId.String(),
 	}).Info(fmt.Sprintf("Dispatching task: %s", string(tt)))
-	err := wsutil.WriteServerMessage(wsConn.Connection, ws.OpText, tt)
+	err = wsConn.write(tt)
 	if err != nil {
 		return fmt.Errorf("Error WriteServerMessage newTask to sensor: %v, %v", wsConn.ConnectionId.String(), err)
 	}
 	return nil
 }
-
-func (w *wsServer) parseAndValidateJwtToken(jwtToken string) (sensorId uuid.UUID, err error) {
-
-	// Parse the token without validation in order to get the sensorId
-	token, _, err := new(jwt.Parser).ParseUnverified(jwtToken, jwt.MapClaims{})
-	if err != nil {
-		err = fmt.Errorf("ParseUnverified: %v", err)
-		return
-	}
-
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		err = fmt.Errorf("Failed to parse claims")
-		return
-	}
-
-	// Access the NOT validated claims
-	sId, ok := claims["sensorId"].(string)
-	if !ok {
-		err = fmt.Errorf("sensorId is not a string")
-		return
-	}
-	sensorIdNotValidated, err := uuid.ParseBytes([]byte(sId))
-	if err != nil {
-		err = fmt.Errorf("sensorId claim not found or not uuid.UUID: %v", err)
-		return
-	}
-
-	// select the NOT VALIDATED sensor and validate with the secret
-	var sensor models.Sensor
-	if err = w.dbClient.First(&sensor, "id = ?", sensorIdNotValidated).Error; err != nil {
-		err = fmt.Errorf("Failed to load Sensor record, sensorIdNotValidated: %v, err: %v", sensorIdNotValidated, err)
-		return
-	}
-	if sensor.Secret == "" {
-		err = fmt.Errorf("Empty sensor.Secret, sensorIdNotValidated: %v", sensorIdNotValidated)
-		return
-	}
-
-	secret := []byte(sensor.Secret)
-
-	// Now validate the token
-	token, err = jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-		// Check if the signing method is what you expect
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return secret, nil
-	})
-
-	switch {
-	case token.Valid:
-		sensorId = sensorIdNotValidated
-		return
-	case errors.Is(err, jwt.ErrTokenMalformed):
-		err = fmt.Errorf("That's not even a JWT token, per sensorIdNotValidated: %v", sensorIdNotValidated)
-		return
-	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
-		err = fmt.Errorf("Invalid JWT signature, per sensorIdNotValidated: %v", sensorIdNotValidated)
-		return
-	case errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet):
-		err = fmt.Errorf("JWT Token is either expired or not active yet, per sensorIdNotValidated: %v", sensorIdNotValidated)
-		return
-	default:
-		err = fmt.Errorf("JWT Couldn't handle this token: %v, per sensorIdNotValidated: %v", err, sensorIdNotValidated)
-		return
-	}
-}